@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/spf13/cast"
+	"github.com/zbysir/writeflow/pkg/export"
+	"github.com/zbysir/writeflow_plugin_llm/util"
+)
+
+// newAgentCallCmd 实现 agent_call，函数的实现是 tools 或者与函数同名的动态输入
+func newAgentCallCmd() export.CMDer {
+	return util.NewFun(func(ctx context.Context, params map[string]interface{}) (rsp map[string]interface{}, err error) {
+		llm, ok := params["llm"].(util.LLM)
+		if !ok {
+			return nil, fmt.Errorf("llm must be a langchain/llm, got %T", params["llm"])
+		}
+		if !llm.Capabilities().Functions {
+			return nil, fmt.Errorf("llm %T does not support functions", llm)
+		}
+		options, err := util.ParseChatOptions(params)
+		if err != nil {
+			return nil, err
+		}
+		options = fitContextWindow(llm, options)
+		functions, err := util.ParseFunctions(params["functions"])
+		if err != nil {
+			return nil, err
+		}
+		tools, err := util.ParseTools(params["tools"])
+		if err != nil {
+			return nil, err
+		}
+		functions, impls, err := withTools(functions, tools)
+		if err != nil {
+			return nil, err
+		}
+		if len(functions) == 0 {
+			return nil, fmt.Errorf("functions is empty")
+		}
+		maxIterations, err := intParam(params, "max_iterations")
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range functions {
+			if _, ok := impls[f.Name]; ok {
+				continue
+			}
+			impl, ok := params[f.Name].(export.CMDer)
+			if !ok {
+				return nil, fmt.Errorf("function %s needs an input named %s as its implementation, got %T", f.Name, f.Name, params[f.Name])
+			}
+			impls[f.Name] = impl
+		}
+
+		var chatMemory util.ChatMemory
+		if params["chat_memory"] != nil {
+			chatMemory, ok = params["chat_memory"].(util.ChatMemory)
+			if !ok {
+				return nil, fmt.Errorf("chat_memory must be a langchain/chat_memory, got %T", params["chat_memory"])
+			}
+		}
+
+		promptI := params["prompt"]
+		if promptI == nil {
+			return nil, fmt.Errorf("prompt is nil")
+		}
+		userMsg := util.Message{Content: cast.ToString(promptI), Role: util.RoleUser}
+
+		budget := historyBudget(llm, options, functions, util.Messages{userMsg})
+		history, err := loadHistory(ctx, chatMemory, util.HistoryQuery{TokenBudget: budget, Prompt: userMsg.Content})
+		if err != nil {
+			return nil, fmt.Errorf("get history error: %w", err)
+		}
+
+		// 函数调用的过程与回复一起写入，之后的对话可以看到函数的结果
+		tx := util.NewChatMemoryTx(chatMemory)
+		tx.Stage(userMsg)
+		recordError := cast.ToString(params["on_error"]) == callOnErrorRecord
+
+		res, err := util.NewAgent(llm, impls, maxIterations).Run(ctx, util.ChatRequest{
+			ChatOptions: options,
+			Messages:    append(history, userMsg),
+			Functions:   functions,
+		})
+		if err != nil {
+			// 失败前已经执行的函数调用也一起记录
+			tx.Stage(answeredMessages(res.Messages)...)
+			if e := tx.Fail(ctx, err, recordError); e != nil {
+				return nil, fmt.Errorf("%w, and append history error: %v", err, e)
+			}
+			// 超过最大轮数时输出已经执行的部分，下游可以根据 error 决定如何处理
+			if errors.Is(err, util.ErrAgentMaxIterations) {
+				return map[string]interface{}{"default": "", "trace": res.Trace, "error": err.Error()}, nil
+			}
+			return nil, err
+		}
+
+		tx.Stage(res.Messages...)
+		err = tx.Commit(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("append history error: %w", err)
+		}
+
+		return map[string]interface{}{"default": res.Response.Message.Content, "trace": res.Trace, "error": ""}, nil
+	})
+}
+
+// answeredMessages 去掉最后一条没有执行的 function_call，历史中的 function_call 总是有结果
+func answeredMessages(ms util.Messages) util.Messages {
+	if n := len(ms); n != 0 && ms[n-1].FunctionCall != nil {
+		return ms[:n-1]
+	}
+	return ms
+}
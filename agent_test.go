@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"github.com/zbysir/writeflow_plugin_llm/util"
+	"strings"
+	"testing"
+)
+
+func TestAgentCall(t *testing.T) {
+	ctx := context.Background()
+	memory := newRecordMemory()
+	weather := util.NewFun(func(ctx context.Context, params map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{"default": map[string]interface{}{"city": params["city"], "temp": 20}}, nil
+	})
+	params := map[string]interface{}{
+		"llm": &fakeLLM{replies: util.Messages{
+			{Role: util.RoleAssistant, FunctionCall: &util.FunctionCall{Name: "get_weather", Arguments: `{"city":"Paris"}`}},
+			{Role: util.RoleAssistant, Content: "It is 20 degrees."},
+		}},
+		"chat_memory": memory,
+		"functions":   `[{"name":"get_weather","parameters":{"type":"object"}}]`,
+		"prompt":      "Weather in Paris?",
+		"get_weather": weather,
+	}
+	rsp, err := newAgentCallCmd().Exec(ctx, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp["default"] != "It is 20 degrees." {
+		t.Errorf("unexpected answer %v", rsp["default"])
+	}
+	trace := rsp["trace"].([]util.AgentStep)
+	if len(trace) != 1 || trace[0].Arguments != `{"city":"Paris"}` || trace[0].Result != `{"city":"Paris","temp":20}` {
+		t.Errorf("unexpected trace %+v", trace)
+	}
+
+	history, _ := memory.GetHistory(ctx)
+	if len(history) != 4 || history[0].Content != "Weather in Paris?" || history[2].Role != util.RoleFunction || history[3].Content != "It is 20 degrees." {
+		t.Errorf("unexpected history %+v", history)
+	}
+
+	delete(params, "get_weather")
+	_, err = newAgentCallCmd().Exec(ctx, params)
+	if err == nil || !strings.Contains(err.Error(), "get_weather") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestAgentCallMaxIterations(t *testing.T) {
+	ctx := context.Background()
+	add := util.NewFun(func(ctx context.Context, params map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{"default": 2}, nil
+	})
+	loop := util.Message{Role: util.RoleAssistant, FunctionCall: &util.FunctionCall{Name: "add", Arguments: `{"a":1,"b":1}`}}
+
+	for _, onError := range []string{callOnErrorDiscard, callOnErrorRecord} {
+		memory := newRecordMemory()
+		rsp, err := newAgentCallCmd().Exec(ctx, map[string]interface{}{
+			"llm":            &fakeLLM{replies: util.Messages{loop, loop, loop}},
+			"chat_memory":    memory,
+			"functions":      `[{"name":"add","parameters":{"type":"object"}}]`,
+			"prompt":         "1 + 1?",
+			"add":            add,
+			"max_iterations": 2,
+			"on_error":       onError,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 超过最大轮数不是节点的错误，输出已经执行的部分与错误
+		if trace := rsp["trace"].([]util.AgentStep); len(trace) != 2 {
+			t.Errorf("%s: unexpected trace %+v", onError, trace)
+		}
+		if !strings.Contains(rsp["error"].(string), "max iterations") {
+			t.Errorf("%s: unexpected error %v", onError, rsp["error"])
+		}
+
+		history, _ := memory.GetHistory(ctx)
+		if onError == callOnErrorDiscard {
+			if len(history) != 0 {
+				t.Errorf("%s: history should be discarded, got %+v", onError, history)
+			}
+			continue
+		}
+		// 用户消息、两次执行的函数与错误，没有执行的 function_call 不写入
+		if len(history) != 6 || history[4].Role != util.RoleFunction || !strings.Contains(history[5].Content, "[failed:") {
+			t.Errorf("%s: unexpected history %+v", onError, history)
+		}
+	}
+}
@@ -0,0 +1,412 @@
+package anthropic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cast"
+	"github.com/zbysir/writeflow/pkg/export"
+	"github.com/zbysir/writeflow_plugin_llm/util"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	DefaultBaseURL = "https://api.anthropic.com"
+	DefaultVersion = "2023-06-01"
+	// DefaultModel 在 new_anthropic 与 langchain_call 都没有选择 Claude 模型时使用
+	DefaultModel = "claude-3-5-sonnet-latest"
+)
+
+// contextWindow 是 Claude 3 及之后的模型的上下文长度
+const contextWindow = 200000
+
+// unansweredToolResult 是没有结果的 tool_use 的占位结果
+const unansweredToolResult = "(the function was called, but its result is not available)"
+
+// NewAnthropicCmd 实现 new_anthropic，输出 util.LLM
+func NewAnthropicCmd() export.CMDer {
+	return util.NewFun(func(ctx context.Context, params map[string]interface{}) (rsp map[string]interface{}, err error) {
+		key := cast.ToString(params["api_key"])
+		if key == "" {
+			return nil, fmt.Errorf("api_key is required")
+		}
+		return map[string]interface{}{"default": NewLLM(Config{
+			APIKey:  key,
+			BaseURL: cast.ToString(params["base_url"]),
+			Version: cast.ToString(params["version"]),
+			Model:   cast.ToString(params["model"]),
+		})}, nil
+	})
+}
+
+type Config struct {
+	APIKey  string
+	BaseURL string
+	// Version is sent as the anthropic-version header
+	Version string
+	// Model overrides the model selected in langchain_call if not empty,
+	// otherwise DefaultModel is used unless langchain_call selects a Claude model
+	Model      string
+	HTTPClient *http.Client
+}
+
+// LLM implement util.LLM by Anthropic Messages API
+// See https://docs.anthropic.com/en/api/messages
+type LLM struct {
+	config Config
+}
+
+func NewLLM(config Config) *LLM {
+	if config.BaseURL == "" {
+		config.BaseURL = DefaultBaseURL
+	}
+	if config.Version == "" {
+		config.Version = DefaultVersion
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+	return &LLM{config: config}
+}
+
+var _ util.LLM = (*LLM)(nil)
+
+func (l *LLM) ChatCompletion(ctx context.Context, req util.ChatRequest) (util.ChatResponse, error) {
+	body, err := l.buildRequest(req, false)
+	if err != nil {
+		return util.ChatResponse{}, err
+	}
+
+	httpRsp, err := l.do(ctx, body)
+	if err != nil {
+		return util.ChatResponse{}, err
+	}
+	defer httpRsp.Body.Close()
+
+	var rsp messageResponse
+	err = json.NewDecoder(httpRsp.Body).Decode(&rsp)
+	if err != nil {
+		return util.ChatResponse{}, fmt.Errorf("decode response error: %w", err)
+	}
+
+	return util.ChatResponse{
+		Message:      coverContentToBase(rsp.Content),
+		FinishReason: coverStopReason(rsp.StopReason),
+		Usage: util.Usage{
+			PromptTokens:     rsp.Usage.InputTokens,
+			CompletionTokens: rsp.Usage.OutputTokens,
+			TotalTokens:      rsp.Usage.InputTokens + rsp.Usage.OutputTokens,
+		},
+	}, nil
+}
+
+func (l *LLM) ChatCompletionStream(ctx context.Context, req util.ChatRequest) (*util.StreamResponse, error) {
+	body, err := l.buildRequest(req, true)
+	if err != nil {
+		return nil, err
+	}
+
+	httpRsp, err := l.do(ctx, body)
+	if err != nil {
+		return nil, err
+	}
+
+	steam := util.NewSteamResponse()
+	go func() {
+		defer httpRsp.Body.Close()
+		steam.Close(readStream(httpRsp.Body, steam))
+	}()
+
+	return steam, nil
+}
+
+// readStream 读取 SSE 并写入 steam，返回 nil 表示正常结束
+func readStream(body io.Reader, steam *util.StreamResponse) error {
+	r := util.NewSSEReader(body)
+	// util.FunctionCall 只能表示一个调用，只转发第一个 tool_use 的增量
+	toolIndex := -1
+	var u util.Usage
+	for {
+		e, err := r.Next()
+		if err != nil {
+			if err == io.EOF {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+
+		var event streamEvent
+		err = json.Unmarshal([]byte(e.Data), &event)
+		if err != nil {
+			return fmt.Errorf("decode stream event error: %w", err)
+		}
+
+		switch event.Type {
+		case "message_start":
+			if event.Message != nil {
+				u.PromptTokens = event.Message.Usage.InputTokens
+			}
+		case "content_block_start":
+			if event.ContentBlock != nil && event.ContentBlock.Type == "tool_use" && toolIndex == -1 {
+				toolIndex = event.Index
+				steam.AppendEvent(util.StreamEvent{
+					Type:         util.StreamEventFunctionCall,
+					FunctionCall: &util.FunctionCall{Name: event.ContentBlock.Name},
+				})
+			}
+		case "content_block_delta":
+			switch event.Delta.Type {
+			case "text_delta":
+				if event.Delta.Text != "" {
+					steam.Append(event.Delta.Text)
+				}
+			case "input_json_delta":
+				if event.Index == toolIndex && event.Delta.PartialJSON != "" {
+					steam.AppendEvent(util.StreamEvent{
+						Type:         util.StreamEventFunctionCall,
+						FunctionCall: &util.FunctionCall{Arguments: event.Delta.PartialJSON},
+					})
+				}
+			}
+		case "message_delta":
+			if event.Usage != nil {
+				u.CompletionTokens = event.Usage.OutputTokens
+				u.TotalTokens = u.PromptTokens + u.CompletionTokens
+				usage := u
+				steam.AppendEvent(util.StreamEvent{Type: util.StreamEventUsage, Usage: &usage})
+			}
+			if event.Delta.StopReason != "" {
+				steam.AppendEvent(util.StreamEvent{Type: util.StreamEventFinish, FinishReason: coverStopReason(event.Delta.StopReason)})
+			}
+		case "error":
+			if event.Error == nil {
+				return fmt.Errorf("anthropic: unknown stream error: %s", e.Data)
+			}
+			return event.Error
+		case "message_stop":
+			return nil
+		}
+	}
+}
+
+// Embedding is not provided by Anthropic
+func (l *LLM) Embedding(ctx context.Context, req util.EmbeddingRequest) ([][]float32, error) {
+	return nil, fmt.Errorf("embedding is not supported by anthropic")
+}
+
+func (l *LLM) Capabilities() util.Capabilities {
+	return util.Capabilities{
+		Stream:    true,
+		Functions: true,
+		Embedding: false,
+	}
+}
+
+// ContextWindow 返回 Claude 模型的上下文长度，langchain_call 选择的模型通常是 OpenAI 的，不能用来查表
+func (l *LLM) ContextWindow() int {
+	return contextWindow
+}
+
+func (l *LLM) do(ctx context.Context, body *messageRequest) (*http.Response, error) {
+	bs, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(l.config.BaseURL, "/")+"/v1/messages", bytes.NewReader(bs))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("x-api-key", l.config.APIKey)
+	httpReq.Header.Set("anthropic-version", l.config.Version)
+
+	httpRsp, err := l.config.HTTPClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	if httpRsp.StatusCode >= 400 {
+		defer httpRsp.Body.Close()
+		var e errorResponse
+		bs, _ := io.ReadAll(httpRsp.Body)
+		if json.Unmarshal(bs, &e) != nil || e.Error == nil {
+			return nil, fmt.Errorf("anthropic: status %d: %s", httpRsp.StatusCode, bs)
+		}
+		return nil, e.Error
+	}
+
+	return httpRsp, nil
+}
+
+func (l *LLM) buildRequest(req util.ChatRequest, stream bool) (*messageRequest, error) {
+	// langchain_call 的 Model 默认是 OpenAI 的模型，不能发送给 Anthropic
+	model := req.Model
+	if l.config.Model != "" {
+		model = l.config.Model
+	} else if !strings.HasPrefix(model, "claude") {
+		model = DefaultModel
+	}
+	if req.Temperature > 1 {
+		return nil, fmt.Errorf("temperature must be between 0 and 1 for anthropic, got %v", req.Temperature)
+	}
+	maxTokens := req.MaxTokens
+	if maxTokens == 0 {
+		maxTokens = util.DefaultMaxTokens
+	}
+
+	system, messages := coverMessageListToSDK(req.Messages)
+	body := &messageRequest{
+		Model:         model,
+		MaxTokens:     maxTokens,
+		System:        system,
+		Messages:      messages,
+		StopSequences: req.Stop,
+		Stream:        stream,
+	}
+	temperature := req.Temperature
+	body.Temperature = &temperature
+	// Anthropic 不建议同时设置 temperature 和 top_p，只有在修改过默认值时才发送 top_p
+	if req.TopP != 0 && req.TopP != util.DefaultTopP {
+		topP := req.TopP
+		body.TopP = &topP
+	}
+	if req.User != "" {
+		body.Metadata = &metadata{UserID: req.User}
+	}
+
+	for _, f := range req.Functions {
+		schema := f.Parameters
+		if len(schema) == 0 {
+			schema = json.RawMessage(`{"type":"object","properties":{}}`)
+		}
+		body.Tools = append(body.Tools, tool{
+			Name:        f.Name,
+			Description: f.Description,
+			InputSchema: schema,
+		})
+	}
+
+	return body, nil
+}
+
+// coverMessageListToSDK 将 util.Message 转换为 Anthropic 的格式:
+//   - system 消息合并为顶层的 system 参数
+//   - 第一条 user 消息之前的 assistant 与 function 消息会被丢弃，Anthropic 要求第一条消息是 user，
+//     被 max_size 或者 token 窗口截断的历史可能以 assistant 开头
+//   - assistant 的 FunctionCall 转换为 tool_use
+//   - function 消息转换为 user 的 tool_result，并关联到同名的上一个 tool_use
+//   - 没有结果的 tool_use（如 function_call 交给了下游节点执行）会补上一个占位的 tool_result，
+//     Anthropic 要求每个 tool_use 之后紧跟它的 tool_result
+//   - Anthropic 要求 user 与 assistant 交替出现，所以相邻的同角色消息会被合并
+func coverMessageListToSDK(as []util.Message) (string, []message) {
+	var system []string
+	var bs []message
+	// pending 是上一条 assistant 消息中还没有结果的 tool_use，函数名 -> id
+	pending := map[string]string{}
+	var pendingOrder []string
+	started := false
+
+	push := func(role string, blocks ...contentBlock) {
+		if len(blocks) == 0 {
+			return
+		}
+		if len(bs) != 0 && bs[len(bs)-1].Role == role {
+			bs[len(bs)-1].Content = append(bs[len(bs)-1].Content, blocks...)
+			return
+		}
+		bs = append(bs, message{Role: role, Content: blocks})
+	}
+	flush := func() {
+		for _, name := range pendingOrder {
+			if id, ok := pending[name]; ok {
+				push("user", contentBlock{Type: "tool_result", ToolUseID: id, Content: unansweredToolResult})
+			}
+		}
+		pending = map[string]string{}
+		pendingOrder = nil
+	}
+
+	for i, a := range as {
+		if a.Role == util.RoleSystem {
+			if a.Content != "" {
+				system = append(system, a.Content)
+			}
+			continue
+		}
+		if !started {
+			if a.Role != util.RoleUser && a.Role != "" {
+				continue
+			}
+			started = true
+		}
+
+		switch a.Role {
+		case util.RoleAssistant:
+			flush()
+			var blocks []contentBlock
+			if a.Content != "" {
+				blocks = append(blocks, contentBlock{Type: "text", Text: a.Content})
+			}
+			if a.FunctionCall != nil {
+				id := fmt.Sprintf("toolu_%d", i)
+				pending[a.FunctionCall.Name] = id
+				pendingOrder = append(pendingOrder, a.FunctionCall.Name)
+				input := json.RawMessage(a.FunctionCall.Arguments)
+				if !json.Valid(input) {
+					input = json.RawMessage("{}")
+				}
+				blocks = append(blocks, contentBlock{Type: "tool_use", ID: id, Name: a.FunctionCall.Name, Input: input})
+			}
+			push("assistant", blocks...)
+		case util.RoleFunction:
+			id, ok := pending[a.Name]
+			if !ok {
+				// 没有对应的 tool_use 时，Anthropic 会拒绝 tool_result，退化为普通文本
+				push("user", contentBlock{Type: "text", Text: fmt.Sprintf("Result of function %s: %s", a.Name, a.Content)})
+				continue
+			}
+			delete(pending, a.Name)
+			push("user", contentBlock{Type: "tool_result", ToolUseID: id, Content: a.Content})
+		default:
+			flush()
+			if a.Content != "" {
+				push("user", contentBlock{Type: "text", Text: a.Content})
+			}
+		}
+	}
+	flush()
+
+	return strings.Join(system, "\n\n"), bs
+}
+
+func coverContentToBase(blocks []contentBlock) util.Message {
+	m := util.Message{Role: util.RoleAssistant}
+	for _, b := range blocks {
+		switch b.Type {
+		case "text":
+			m.Content += b.Text
+		case "tool_use":
+			// util.Message 只能表示一个 function_call，只保留第一个
+			if m.FunctionCall == nil {
+				m.FunctionCall = &util.FunctionCall{Name: b.Name, Arguments: string(b.Input)}
+			}
+		}
+	}
+	return m
+}
+
+// coverStopReason 将 stop_reason 转换为 OpenAI 的 finish_reason
+func coverStopReason(s string) string {
+	switch s {
+	case "end_turn", "stop_sequence":
+		return "stop"
+	case "max_tokens":
+		return "length"
+	case "tool_use":
+		return "function_call"
+	}
+	return s
+}
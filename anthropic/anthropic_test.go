@@ -0,0 +1,281 @@
+package anthropic
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/zbysir/writeflow_plugin_llm/util"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestChatCompletion(t *testing.T) {
+	var got messageRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/messages" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if r.Header.Get("x-api-key") != "key" {
+			t.Errorf("unexpected x-api-key %q", r.Header.Get("x-api-key"))
+		}
+		if r.Header.Get("anthropic-version") != DefaultVersion {
+			t.Errorf("unexpected anthropic-version %q", r.Header.Get("anthropic-version"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+
+		_, _ = io.WriteString(w, `{
+			"id": "msg_1",
+			"type": "message",
+			"role": "assistant",
+			"content": [
+				{"type": "text", "text": "Let me check."},
+				{"type": "tool_use", "id": "toolu_x", "name": "get_weather", "input": {"city": "Paris"}}
+			],
+			"stop_reason": "tool_use",
+			"usage": {"input_tokens": 10, "output_tokens": 5}
+		}`)
+	}))
+	defer srv.Close()
+
+	l := NewLLM(Config{APIKey: "key", BaseURL: srv.URL, Model: "claude-test"})
+	rsp, err := l.ChatCompletion(context.Background(), util.ChatRequest{
+		ChatOptions: util.DefaultChatOptions(),
+		Messages: util.Messages{
+			{Role: util.RoleSystem, Content: "You are a bot."},
+			{Role: util.RoleUser, Content: "Weather in London?"},
+			{Role: util.RoleAssistant, FunctionCall: &util.FunctionCall{Name: "get_weather", Arguments: `{"city":"London"}`}},
+			{Role: util.RoleFunction, Name: "get_weather", Content: `{"temp":20}`},
+			{Role: util.RoleAssistant, Content: "It is 20 degrees."},
+			{Role: util.RoleUser, Content: "And Paris?"},
+		},
+		Functions: []util.FunctionDefine{
+			{Name: "get_weather", Description: "get weather", Parameters: json.RawMessage(`{"type":"object","properties":{"city":{"type":"string"}}}`)},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Model != "claude-test" {
+		t.Errorf("model should be overridden by config, got %s", got.Model)
+	}
+	if got.System != "You are a bot." {
+		t.Errorf("unexpected system %q", got.System)
+	}
+	if got.TopP != nil {
+		t.Errorf("default top_p should not be sent")
+	}
+	if len(got.Tools) != 1 || got.Tools[0].Name != "get_weather" || !strings.Contains(string(got.Tools[0].InputSchema), "city") {
+		t.Errorf("unexpected tools %+v", got.Tools)
+	}
+
+	roles := []string{"user", "assistant", "user", "assistant", "user"}
+	if len(got.Messages) != len(roles) {
+		t.Fatalf("unexpected messages %+v", got.Messages)
+	}
+	for i, role := range roles {
+		if got.Messages[i].Role != role {
+			t.Errorf("message %d: expect role %s, got %s", i, role, got.Messages[i].Role)
+		}
+	}
+	toolUse := got.Messages[1].Content[0]
+	toolResult := got.Messages[2].Content[0]
+	if toolUse.Type != "tool_use" || toolUse.Name != "get_weather" || string(toolUse.Input) != `{"city":"London"}` {
+		t.Errorf("unexpected tool_use %+v", toolUse)
+	}
+	if toolResult.Type != "tool_result" || toolResult.ToolUseID != toolUse.ID || toolResult.Content != `{"temp":20}` {
+		t.Errorf("unexpected tool_result %+v", toolResult)
+	}
+
+	if rsp.Message.Role != util.RoleAssistant || rsp.Message.Content != "Let me check." {
+		t.Errorf("unexpected message %+v", rsp.Message)
+	}
+	if rsp.Message.FunctionCall == nil || rsp.Message.FunctionCall.Name != "get_weather" || rsp.Message.FunctionCall.Arguments != `{"city": "Paris"}` {
+		t.Errorf("unexpected function_call %+v", rsp.Message.FunctionCall)
+	}
+	if rsp.FinishReason != "function_call" {
+		t.Errorf("unexpected finish reason %s", rsp.FinishReason)
+	}
+	if rsp.Usage.TotalTokens != 15 {
+		t.Errorf("unexpected usage %+v", rsp.Usage)
+	}
+}
+
+func TestChatCompletionError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = io.WriteString(w, `{"type":"error","error":{"type":"invalid_request_error","message":"max_tokens: field required"}}`)
+	}))
+	defer srv.Close()
+
+	l := NewLLM(Config{APIKey: "key", BaseURL: srv.URL})
+	_, err := l.ChatCompletion(context.Background(), util.ChatRequest{ChatOptions: util.DefaultChatOptions()})
+	if err == nil || !strings.Contains(err.Error(), "max_tokens: field required") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestChatCompletionStream(t *testing.T) {
+	events := []string{
+		`event: message_start
+data: {"type":"message_start","message":{"id":"msg_1","role":"assistant","content":[],"usage":{"input_tokens":10,"output_tokens":1}}}`,
+		`event: content_block_start
+data: {"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`event: ping
+data: {"type": "ping"}`,
+		`event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello"}}`,
+		`event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":", John"}}`,
+		`event: content_block_stop
+data: {"type":"content_block_stop","index":0}`,
+		`event: content_block_start
+data: {"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{}}}`,
+		`event: content_block_delta
+data: {"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"city\": "}}`,
+		`event: content_block_delta
+data: {"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"\"Paris\"}"}}`,
+		`event: content_block_stop
+data: {"type":"content_block_stop","index":1}`,
+		`event: message_delta
+data: {"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":3}}`,
+		`event: message_stop
+data: {"type":"message_stop"}`,
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body messageRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if !body.Stream {
+			t.Errorf("stream should be true")
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, e := range events {
+			_, _ = io.WriteString(w, e+"\n\n")
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer srv.Close()
+
+	l := NewLLM(Config{APIKey: "key", BaseURL: srv.URL})
+	s, err := l.ChatCompletionStream(context.Background(), util.ChatRequest{
+		ChatOptions: util.DefaultChatOptions(),
+		Messages:    util.Messages{{Role: util.RoleUser, Content: "Hi"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := s.NewReader().ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(data, "") != "Hello, John" {
+		t.Errorf("unexpected content %q", data)
+	}
+
+	var fc util.FunctionCall
+	var finish string
+	var usage *util.Usage
+	for _, e := range s.NewEventReader().ReadAll() {
+		switch e.Type {
+		case util.StreamEventFunctionCall:
+			fc.Name += e.FunctionCall.Name
+			fc.Arguments += e.FunctionCall.Arguments
+		case util.StreamEventFinish:
+			finish = e.FinishReason
+		case util.StreamEventUsage:
+			usage = e.Usage
+		}
+	}
+	if fc.Name != "get_weather" || fc.Arguments != `{"city": "Paris"}` {
+		t.Errorf("unexpected function_call %+v", fc)
+	}
+	if finish != "function_call" {
+		t.Errorf("unexpected finish reason %s", finish)
+	}
+	if usage == nil || usage.TotalTokens != 13 {
+		t.Errorf("unexpected usage %+v", usage)
+	}
+}
+
+func TestChatCompletionStreamError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"Hel\"}}\n\n")
+		_, _ = io.WriteString(w, "event: error\ndata: {\"type\":\"error\",\"error\":{\"type\":\"overloaded_error\",\"message\":\"Overloaded\"}}\n\n")
+	}))
+	defer srv.Close()
+
+	l := NewLLM(Config{APIKey: "key", BaseURL: srv.URL})
+	s, err := l.ChatCompletionStream(context.Background(), util.ChatRequest{ChatOptions: util.DefaultChatOptions()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.NewReader().ReadAll()
+	if err == nil || !strings.Contains(err.Error(), "Overloaded") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestCoverMessageList(t *testing.T) {
+	_, ms := coverMessageListToSDK(util.Messages{
+		// 被截断的历史以 assistant 开头
+		{Role: util.RoleAssistant, Content: "old answer"},
+		{Role: util.RoleFunction, Name: "get_weather", Content: `{"temp":20}`},
+		{Role: util.RoleSystem, Content: "You are a bot."},
+		{Role: util.RoleUser, Content: "Weather in Paris?"},
+		// function_call 交给了下游节点，历史中没有结果
+		{Role: util.RoleAssistant, FunctionCall: &util.FunctionCall{Name: "get_weather", Arguments: `{"city":"Paris"}`}},
+		{Role: util.RoleUser, Content: "Never mind."},
+	})
+
+	roles := []string{"user", "assistant", "user"}
+	if len(ms) != len(roles) {
+		t.Fatalf("unexpected messages %+v", ms)
+	}
+	for i, role := range roles {
+		if ms[i].Role != role {
+			t.Errorf("message %d: expect role %s, got %s", i, role, ms[i].Role)
+		}
+	}
+	if ms[0].Content[0].Text != "Weather in Paris?" {
+		t.Errorf("unexpected first message %+v", ms[0])
+	}
+	toolUse := ms[1].Content[0]
+	last := ms[2].Content
+	if len(last) != 2 || last[0].Type != "tool_result" || last[0].ToolUseID != toolUse.ID || last[1].Text != "Never mind." {
+		t.Errorf("unanswered tool_use should get a tool_result, got %+v", last)
+	}
+}
+
+func TestBuildRequest(t *testing.T) {
+	l := NewLLM(Config{APIKey: "key"})
+	body, err := l.buildRequest(util.ChatRequest{ChatOptions: util.DefaultChatOptions()}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body.Model != DefaultModel {
+		t.Errorf("OpenAI model should not be sent to anthropic, got %s", body.Model)
+	}
+
+	options := util.DefaultChatOptions()
+	options.Model = "claude-3-opus-latest"
+	body, err = l.buildRequest(util.ChatRequest{ChatOptions: options}, false)
+	if err != nil || body.Model != "claude-3-opus-latest" {
+		t.Errorf("unexpected model %s, %v", body.Model, err)
+	}
+
+	options.Temperature = 1.5
+	_, err = l.buildRequest(util.ChatRequest{ChatOptions: options}, false)
+	if err == nil || !strings.Contains(err.Error(), "temperature") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package anthropic
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+type messageRequest struct {
+	Model         string    `json:"model"`
+	MaxTokens     int       `json:"max_tokens"`
+	System        string    `json:"system,omitempty"`
+	Messages      []message `json:"messages"`
+	Temperature   *float32  `json:"temperature,omitempty"`
+	TopP          *float32  `json:"top_p,omitempty"`
+	StopSequences []string  `json:"stop_sequences,omitempty"`
+	Stream        bool      `json:"stream,omitempty"`
+	Tools         []tool    `json:"tools,omitempty"`
+	Metadata      *metadata `json:"metadata,omitempty"`
+}
+
+type metadata struct {
+	UserID string `json:"user_id,omitempty"`
+}
+
+type message struct {
+	Role    string         `json:"role"`
+	Content []contentBlock `json:"content"`
+}
+
+type contentBlock struct {
+	Type string `json:"type"`
+
+	// type: text
+	Text string `json:"text,omitempty"`
+
+	// type: tool_use
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+
+	// type: tool_result
+	ToolUseID string `json:"tool_use_id,omitempty"`
+	Content   string `json:"content,omitempty"`
+}
+
+type tool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+type messageResponse struct {
+	ID         string         `json:"id"`
+	Role       string         `json:"role"`
+	Content    []contentBlock `json:"content"`
+	StopReason string         `json:"stop_reason"`
+	Usage      usage          `json:"usage"`
+}
+
+type usage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// streamEvent is the data of one server-sent event, only the fields we need are decoded.
+// See https://docs.anthropic.com/en/api/messages-streaming
+type streamEvent struct {
+	Type         string           `json:"type"`
+	Index        int              `json:"index"`
+	Message      *messageResponse `json:"message,omitempty"`
+	ContentBlock *contentBlock    `json:"content_block,omitempty"`
+	Delta        streamDelta      `json:"delta"`
+	Usage        *usage           `json:"usage,omitempty"`
+	Error        *APIError        `json:"error,omitempty"`
+}
+
+type streamDelta struct {
+	Type        string `json:"type"`
+	Text        string `json:"text"`
+	PartialJSON string `json:"partial_json"`
+	StopReason  string `json:"stop_reason"`
+}
+
+type errorResponse struct {
+	Type  string    `json:"type"`
+	Error *APIError `json:"error"`
+}
+
+// APIError is returned when the API responds with an error, either as the HTTP body or as a stream event.
+type APIError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("anthropic: %s: %s", e.Type, e.Message)
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cast"
+	"github.com/zbysir/writeflow/pkg/export"
+	"github.com/zbysir/writeflow_plugin_llm/util"
+	"log"
+	"time"
+)
+
+// langchain_call 的 on_error 选项，决定调用失败时如何处理 ChatMemory
+const (
+	callOnErrorDiscard = "discard"
+	callOnErrorRecord  = "record"
+)
+
+// commitTimeout 是流结束后写入历史的超时时间
+const commitTimeout = 30 * time.Second
+
+// detachedContext 保留 ctx 中的值，但不会随着 ctx 被取消（即 go 1.21 的 context.WithoutCancel）
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+// langchain_call 的 mode 选项
+const (
+	callModeChat = "chat"
+	// callModeRegenerate 删除最后一轮的回复，使用最后一条用户消息重新提问
+	callModeRegenerate = "regenerate"
+)
+
+// newCallCmd 实现 langchain_call，只依赖 util.LLM，与具体的 SDK 无关
+func newCallCmd() export.CMDer {
+	return util.NewFun(func(ctx context.Context, params map[string]interface{}) (rsp map[string]interface{}, err error) {
+		llm, ok := params["llm"].(util.LLM)
+		if !ok {
+			return nil, fmt.Errorf("llm must be a langchain/llm, got %T", params["llm"])
+		}
+		options, err := util.ParseChatOptions(params)
+		if err != nil {
+			return nil, err
+		}
+		options = fitContextWindow(llm, options)
+		functions, err := util.ParseFunctions(params["functions"])
+		if err != nil {
+			return nil, err
+		}
+		tools, err := util.ParseTools(params["tools"])
+		if err != nil {
+			return nil, err
+		}
+		functions, impls, err := withTools(functions, tools)
+		if err != nil {
+			return nil, err
+		}
+		// 有 tools 时需要循环执行函数，不使用流式输出
+		enableSteam := cast.ToBool(params["stream"]) && llm.Capabilities().Stream && len(tools) == 0
+
+		var chatMemory util.ChatMemory
+		if params["chat_memory"] != nil {
+			chatMemory, ok = params["chat_memory"].(util.ChatMemory)
+			if !ok {
+				return nil, fmt.Errorf("chat_memory must be a langchain/chat_memory, got %T", params["chat_memory"])
+			}
+		}
+		// prefix 是放在历史之前的消息，如 system 与 few-shot，不写入 ChatMemory
+		prefix, err := util.ParseMessages(params["messages"])
+		if err != nil {
+			return nil, err
+		}
+
+		// 用户消息与回复只在调用成功后一起写入
+		tx := util.NewChatMemoryTx(chatMemory)
+		recordError := cast.ToString(params["on_error"]) == callOnErrorRecord
+
+		var userMsg util.Message
+		// regenerate 时读取到的历史包含需要重新生成的最后一轮
+		regenerate := false
+		switch mode := cast.ToString(params["mode"]); mode {
+		case "", callModeChat:
+			switch promptI, resultI := params["prompt"], params["function_result"]; {
+			case resultI != nil:
+				// 将函数的执行结果交给模型，函数名为空时使用上一条 function_call 的函数名
+				if promptI != nil {
+					return nil, fmt.Errorf("prompt and function_result can not be used together")
+				}
+				content, err := functionResult(resultI)
+				if err != nil {
+					return nil, err
+				}
+				userMsg = util.Message{Role: util.RoleFunction, Name: cast.ToString(params["function_name"]), Content: content}
+			case promptI != nil:
+				userMsg = util.Message{Content: cast.ToString(promptI), Role: util.RoleUser}
+			case len(prefix) != 0 && prefix[len(prefix)-1].Role == util.RoleUser:
+				// 没有 prompt 时 messages 的最后一条用户消息是本次的输入
+				userMsg = prefix[len(prefix)-1]
+				prefix = prefix[:len(prefix)-1]
+			default:
+				return nil, fmt.Errorf("prompt is nil")
+			}
+		case callModeRegenerate:
+			// summary_memory 等包装过的 ChatMemory 使用被包装的 ChatMemory 截断
+			m, ok := util.BaseChatMemory(chatMemory).(util.ForkableChatMemory)
+			if !ok {
+				return nil, fmt.Errorf("regenerate needs a chat_memory which supports truncate, got %T", chatMemory)
+			}
+			snapshot, err := m.Snapshot(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("get history error: %w", err)
+			}
+			last := util.LastTurnIndex(snapshot)
+			if last == -1 {
+				return nil, fmt.Errorf("there is no user message to regenerate")
+			}
+			userMsg = snapshot[last]
+			regenerate = true
+			tx.Replace(snapshot, last)
+		default:
+			return nil, fmt.Errorf("unsupported mode: %s", mode)
+		}
+
+		budget := historyBudget(llm, options, functions, append(util.Messages{userMsg}, prefix...))
+		history, err := loadHistory(ctx, chatMemory, util.HistoryQuery{TokenBudget: budget, Prompt: userMsg.Content})
+		if err != nil {
+			return nil, fmt.Errorf("get history error: %w", err)
+		}
+		if regenerate {
+			history = withoutLastTurn(history)
+		}
+
+		messages := make(util.Messages, 0, len(prefix)+len(history)+1)
+		messages = append(messages, prefix...)
+		messages = append(messages, history...)
+		if userMsg.Role == util.RoleFunction {
+			userMsg, err = resolveFunctionResult(messages, userMsg)
+			if err != nil {
+				return nil, err
+			}
+		}
+		messages = append(messages, userMsg)
+		tx.Stage(userMsg)
+
+		req := util.ChatRequest{
+			ChatOptions: options,
+			Messages:    messages,
+			Functions:   functions,
+		}
+
+		if enableSteam {
+			steam, err := llm.ChatCompletionStream(ctx, req)
+			if err != nil {
+				_ = tx.Fail(ctx, err, recordError)
+				return nil, err
+			}
+
+			// function_call 需要等流结束才完整，模型也可能先输出一段文字再调用函数，所以有 functions 时等待流结束。
+			// 下游可能马上使用 function_result 继续调用，所以在返回前写入历史
+			if len(functions) != 0 {
+				res, err := steam.Response()
+				if err != nil {
+					if e := tx.Fail(ctx, err, recordError); e != nil {
+						return nil, fmt.Errorf("%w, and append history error: %v", err, e)
+					}
+					return nil, err
+				}
+				tx.Stage(res.Message)
+				err = tx.Commit(ctx)
+				if err != nil {
+					return nil, fmt.Errorf("append history error: %w", err)
+				}
+				return map[string]interface{}{"default": steam, "function_call": res.Message.FunctionCall}, nil
+			}
+
+			// 流已经返回给下游，写入历史的错误只能记录到日志
+			go func() {
+				res, err := steam.Response()
+
+				// Exec 返回后 ctx 可能已经结束，写入历史使用不会被取消的 ctx
+				ctx, cancel := context.WithTimeout(detachedContext{ctx}, commitTimeout)
+				defer cancel()
+				if err != nil {
+					err = tx.Fail(ctx, err, recordError)
+				} else {
+					if res.Message.Content != "" || res.Message.FunctionCall != nil {
+						tx.Stage(res.Message)
+					}
+					err = tx.Commit(ctx)
+				}
+				if err != nil {
+					log.Printf("langchain_call: append history error: %v", err)
+				}
+			}()
+
+			return map[string]interface{}{"default": steam, "function_call": nil}, nil
+		}
+
+		// replies 是本次新产生的消息，执行 tools 时包括 function_call 与函数结果
+		var res util.ChatResponse
+		var replies util.Messages
+		if len(impls) != 0 {
+			var r util.AgentResult
+			r, err = util.NewAgent(llm, impls, 0).Run(ctx, req)
+			res, replies = r.Response, r.Messages
+		} else {
+			res, err = llm.ChatCompletion(ctx, req)
+			replies = util.Messages{res.Message}
+		}
+		if err != nil {
+			if e := tx.Fail(ctx, err, recordError); e != nil {
+				return nil, fmt.Errorf("%w, and append history error: %v", err, e)
+			}
+			return nil, err
+		}
+
+		tx.Stage(replies...)
+		err = tx.Commit(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("append history error: %w", err)
+		}
+
+		return map[string]interface{}{"default": res.Message.Content, "function_call": res.Message.FunctionCall}, nil
+	})
+}
+
+// fitContextWindow 将 max_tokens 限制为上下文的一半，上下文较小时（如 Ollama 默认的 num_ctx 2048）
+// 默认的 max_tokens 会占用几乎全部上下文，没有留给历史的空间
+func fitContextWindow(llm util.LLM, options util.ChatOptions) util.ChatOptions {
+	if half := util.LLMContextWindow(llm, options.Model) / 2; options.MaxTokens > half {
+		options.MaxTokens = half
+	}
+	return options
+}
+
+// historyBudget 返回留给历史的 token 数，llm 的上下文需要容纳历史、ms、functions 与回复
+func historyBudget(llm util.LLM, options util.ChatOptions, functions []util.FunctionDefine, ms util.Messages) int {
+	budget := util.LLMContextWindow(llm, options.Model) - options.MaxTokens - util.CountFunctionTokens(functions)
+	for _, m := range ms {
+		budget -= util.CountMessageTokens(m)
+	}
+	return budget
+}
+
+// loadHistory 读取 chatMemory 的历史，实现了 util.HistoryWindower 的 ChatMemory 按 q 截取
+func loadHistory(ctx context.Context, chatMemory util.ChatMemory, q util.HistoryQuery) (util.Messages, error) {
+	switch w, ok := chatMemory.(util.HistoryWindower); {
+	case ok:
+		// 预算为 0 表示不限制，不能交给 ChatMemory
+		if q.TokenBudget <= 0 {
+			return nil, fmt.Errorf("no tokens left for history, the prompt, messages and functions exceed the context window")
+		}
+		return w.GetHistoryWindow(ctx, q)
+	case chatMemory != nil:
+		return chatMemory.GetHistory(ctx)
+	}
+	return nil, nil
+}
+
+// withoutLastTurn 删除最后一轮对话。包装过的 ChatMemory 读取到的历史可能已经不包含这一轮的用户消息
+// （如被 token 窗口截断），这时这一轮剩下的回复之前只有 system 消息
+func withoutLastTurn(history util.Messages) util.Messages {
+	if last := util.LastTurnIndex(history); last != -1 {
+		return history[:last]
+	}
+	var ms util.Messages
+	for _, m := range history {
+		if m.Role == util.RoleSystem {
+			ms = append(ms, m)
+		}
+	}
+	return ms
+}
+
+// functionResult 将函数的结果转换为消息内容，字符串原样使用，其他值序列化为 JSON
+func functionResult(v interface{}) (string, error) {
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("invalid function_result: %w", err)
+	}
+	return string(bs), nil
+}
+
+// resolveFunctionResult 检查函数结果是否紧跟在 assistant 的 function_call 之后，并补全函数名
+func resolveFunctionResult(messages util.Messages, result util.Message) (util.Message, error) {
+	var last util.Message
+	if len(messages) != 0 {
+		last = messages[len(messages)-1]
+	}
+	if last.Role != util.RoleAssistant || last.FunctionCall == nil {
+		return result, fmt.Errorf("function_result must follow a function_call of the assistant")
+	}
+	switch result.Name {
+	case "":
+		result.Name = last.FunctionCall.Name
+	case last.FunctionCall.Name:
+	default:
+		return result, fmt.Errorf("function_result is for %s, but the assistant called %s", result.Name, last.FunctionCall.Name)
+	}
+	return result, nil
+}
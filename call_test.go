@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/zbysir/writeflow/pkg/export"
+	"github.com/zbysir/writeflow_plugin_llm/util"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordMemory records appended messages and notifies on every AppendHistory
+type recordMemory struct {
+	lock     sync.Mutex
+	messages util.Messages
+	appended chan struct{}
+}
+
+func newRecordMemory() *recordMemory {
+	return &recordMemory{appended: make(chan struct{}, 100)}
+}
+
+func (m *recordMemory) GetHistory(ctx context.Context) (util.Messages, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append(util.Messages(nil), m.messages...), nil
+}
+
+func (m *recordMemory) AppendHistory(ctx context.Context, messages ...util.Message) error {
+	// 与 redis、sqlite 一样，ctx 结束后不能写入
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.lock.Lock()
+	m.messages = append(m.messages, messages...)
+	m.lock.Unlock()
+	m.appended <- struct{}{}
+	return nil
+}
+
+func (m *recordMemory) waitAppended(t *testing.T, n int) {
+	for i := 0; i < n; i++ {
+		select {
+		case <-m.appended:
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %d appends", n)
+		}
+	}
+}
+
+func TestCallStreamMemory(t *testing.T) {
+	memory := newRecordMemory()
+	rsp, err := newCallCmd().Exec(context.Background(), map[string]interface{}{
+		"llm":         &fakeLLM{chunks: []string{"Hello", ", ", "John"}},
+		"chat_memory": memory,
+		"stream":      true,
+		"prompt":      "Hi",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := rsp["default"].(export.Stream).NewReader().ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 3 {
+		t.Errorf("unexpected stream data %q", data)
+	}
+
+	memory.waitAppended(t, 1)
+	history, _ := memory.GetHistory(context.Background())
+	if len(history) != 2 || history[0].Content != "Hi" || history[1].Role != util.RoleAssistant || history[1].Content != "Hello, John" {
+		t.Errorf("unexpected history %+v", history)
+	}
+}
+
+func TestCallStreamCommitAfterCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	memory := newRecordMemory()
+	llm := &fakeLLM{chunks: []string{"Hello"}, wait: make(chan struct{})}
+	_, err := newCallCmd().Exec(ctx, map[string]interface{}{
+		"llm":         llm,
+		"chat_memory": memory,
+		"stream":      true,
+		"prompt":      "Hi",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 流程结束后流才结束，历史仍然需要写入
+	cancel()
+	close(llm.wait)
+	memory.waitAppended(t, 1)
+	if history, _ := memory.GetHistory(context.Background()); len(history) != 2 || history[1].Content != "Hello" {
+		t.Errorf("unexpected history %+v", history)
+	}
+}
+
+func TestCallStreamFunctionCall(t *testing.T) {
+	events := []util.StreamEvent{
+		{Type: util.StreamEventFunctionCall, FunctionCall: &util.FunctionCall{Name: "get_weather"}},
+		{Type: util.StreamEventFunctionCall, FunctionCall: &util.FunctionCall{Arguments: `{"city":`}},
+		{Type: util.StreamEventFunctionCall, FunctionCall: &util.FunctionCall{Arguments: `"Paris"}`}},
+		{Type: util.StreamEventFinish, FinishReason: "function_call"},
+	}
+	// 模型（如 Claude）可能先输出一段文字再调用函数
+	for _, chunks := range [][]string{nil, {"Let me check."}} {
+		memory := newRecordMemory()
+		rsp, err := newCallCmd().Exec(context.Background(), map[string]interface{}{
+			"llm":         &fakeLLM{chunks: chunks, events: events},
+			"chat_memory": memory,
+			"stream":      true,
+			"prompt":      "Weather in Paris?",
+			"functions":   `[{"name":"get_weather","parameters":{"type":"object"}}]`,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fc, ok := rsp["function_call"].(*util.FunctionCall)
+		if !ok || fc == nil || fc.Name != "get_weather" || fc.Arguments != `{"city":"Paris"}` {
+			t.Fatalf("%q: unexpected function_call %#v", chunks, rsp["function_call"])
+		}
+
+		// 返回前 function_call 已经写入历史，下游可以马上使用 function_result
+		history, _ := memory.GetHistory(context.Background())
+		if len(history) != 2 || history[1].FunctionCall == nil || history[1].FunctionCall.Arguments != `{"city":"Paris"}` {
+			t.Errorf("%q: unexpected history %+v", chunks, history)
+		}
+	}
+}
+
+func TestCallTokenWindow(t *testing.T) {
+	ctx := context.Background()
+	memory := newRecordMemory()
+	memory.messages = util.Messages{{Role: util.RoleSystem, Content: "You are a bot."}}
+	for i := 0; i < 100; i++ {
+		memory.messages = append(memory.messages, util.Message{Role: util.RoleUser, Content: strings.Repeat("a", 400)})
+	}
+
+	// LLM 自己的上下文长度优先于按 model 查表
+	for _, c := range []struct {
+		llm    *fakeLLM
+		window int
+	}{
+		{llm: &fakeLLM{chunks: []string{"ok"}}, window: util.ContextWindow("gpt-3.5-turbo-0613")},
+		{llm: &fakeLLM{chunks: []string{"ok"}, window: 3000}, window: 3000},
+	} {
+		_, err := newCallCmd().Exec(ctx, map[string]interface{}{
+			"llm":         c.llm,
+			"chat_memory": util.NewTokenWindowChatMemory(memory),
+			"prompt":      "Hi",
+			"model":       "gpt-3.5-turbo-0613",
+			"max_tokens":  1000,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := c.llm.req
+		n := 0
+		for _, m := range req.Messages {
+			n += util.CountMessageTokens(m)
+		}
+		if n+1000 > c.window || n+1000 < c.window/2 {
+			t.Errorf("messages do not fit the context window %d: %d tokens", c.window, n)
+		}
+		if req.Messages[0].Role != util.RoleSystem || len(req.Messages) > 100 {
+			t.Errorf("unexpected messages count %d", len(req.Messages))
+		}
+		if last := req.Messages[len(req.Messages)-1]; last.Content != "Hi" {
+			t.Errorf("the prompt should be the last message, got %+v", last)
+		}
+	}
+}
+
+func TestCallSmallContextWindow(t *testing.T) {
+	ctx := context.Background()
+	memory := newRecordMemory()
+	for i := 0; i < 100; i++ {
+		memory.messages = append(memory.messages, util.Message{Role: util.RoleUser, Content: "hello"})
+	}
+
+	// 默认的 max_tokens 与 Ollama 默认的 num_ctx 一起使用时，仍然给历史留下空间
+	llm := &fakeLLM{chunks: []string{"ok"}, window: 2048}
+	_, err := newCallCmd().Exec(ctx, map[string]interface{}{
+		"llm":         llm,
+		"chat_memory": util.NewTokenWindowChatMemory(memory),
+		"prompt":      "Hi",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if llm.req.MaxTokens != 1024 || len(llm.req.Messages) != 101 {
+		t.Errorf("unexpected max_tokens %d with %d messages", llm.req.MaxTokens, len(llm.req.Messages))
+	}
+
+	// prompt 超出上下文时没有留给历史的空间
+	_, err = newCallCmd().Exec(ctx, map[string]interface{}{
+		"llm":         llm,
+		"chat_memory": util.NewTokenWindowChatMemory(memory),
+		"prompt":      strings.Repeat("hello ", 2000),
+	})
+	if err == nil || !strings.Contains(err.Error(), "context window") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestCallFailureNotCommitted(t *testing.T) {
+	ctx := context.Background()
+	upstream := errors.New("upstream error")
+
+	for _, stream := range []bool{false, true} {
+		memory := newRecordMemory()
+		params := map[string]interface{}{
+			"llm":         &fakeLLM{chunks: []string{"Hel"}, err: upstream},
+			"chat_memory": memory,
+			"stream":      stream,
+			"prompt":      "Hi",
+		}
+		rsp, err := newCallCmd().Exec(ctx, params)
+		if stream {
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = rsp["default"].(export.Stream).NewReader().ReadAll()
+		}
+		if err != upstream {
+			t.Fatalf("stream %v: unexpected error %v", stream, err)
+		}
+
+		// 没有任何写入
+		select {
+		case <-memory.appended:
+			t.Fatalf("stream %v: failed call should not be recorded, got %+v", stream, memory.messages)
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		params["on_error"] = callOnErrorRecord
+		rsp, err = newCallCmd().Exec(ctx, params)
+		if stream {
+			_, err = rsp["default"].(export.Stream).NewReader().ReadAll()
+		}
+		if err != upstream {
+			t.Fatalf("stream %v: unexpected error %v", stream, err)
+		}
+		memory.waitAppended(t, 1)
+		history, _ := memory.GetHistory(ctx)
+		if len(history) != 2 || history[0].Content != "Hi" || history[1].Role != util.RoleAssistant || !strings.Contains(history[1].Content, "upstream error") {
+			t.Errorf("stream %v: unexpected history %+v", stream, history)
+		}
+	}
+}
+
+func TestCallRegenerate(t *testing.T) {
+	ctx := context.Background()
+	memory := util.NewMemoryChatMemory("regenerate", 0)
+	defer func() { _ = memory.Store().(util.SessionStore).Delete(ctx, "regenerate") }()
+	_ = memory.AppendHistory(ctx,
+		util.Message{Role: util.RoleUser, Content: "q1"},
+		util.Message{Role: util.RoleAssistant, Content: "a1"},
+		util.Message{Role: util.RoleUser, Content: "q2"},
+		util.Message{Role: util.RoleAssistant, Content: "bad answer"},
+	)
+
+	// 包装过的 ChatMemory 也可以重新生成
+	for i, chatMemory := range []util.ChatMemory{memory, util.NewTokenWindowChatMemory(memory)} {
+		llm := &fakeLLM{chunks: []string{fmt.Sprintf("good answer %d", i)}}
+		rsp, err := newCallCmd().Exec(ctx, map[string]interface{}{
+			"llm":         llm,
+			"chat_memory": chatMemory,
+			"mode":        callModeRegenerate,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rsp["default"] != fmt.Sprintf("good answer %d", i) {
+			t.Errorf("unexpected answer %v", rsp["default"])
+		}
+
+		if len(llm.req.Messages) != 3 || llm.req.Messages[1].Content != "a1" || llm.req.Messages[2].Content != "q2" {
+			t.Errorf("unexpected request messages %+v", llm.req.Messages)
+		}
+		history, _ := memory.GetHistory(ctx)
+		if len(history) != 4 || history[2].Content != "q2" || history[3].Content != rsp["default"] {
+			t.Errorf("unexpected history %+v", history)
+		}
+	}
+
+	// 失败时不会删除原来的回复
+	_, err := newCallCmd().Exec(ctx, map[string]interface{}{
+		"llm":         &fakeLLM{err: errors.New("upstream error")},
+		"chat_memory": memory,
+		"mode":        callModeRegenerate,
+	})
+	if err == nil {
+		t.Fatal("expect error")
+	}
+	if history, _ := memory.GetHistory(ctx); len(history) != 4 || history[3].Content != "good answer 1" {
+		t.Errorf("failed regenerate should not change history %+v", history)
+	}
+
+	// 重新生成期间历史被修改时不覆盖新的消息
+	_, err = newCallCmd().Exec(ctx, map[string]interface{}{
+		"llm": &fakeLLM{chunks: []string{"late answer"}, before: func(ctx context.Context) {
+			_ = memory.AppendHistory(ctx, util.Message{Role: util.RoleUser, Content: "concurrent"})
+		}},
+		"chat_memory": memory,
+		"mode":        callModeRegenerate,
+	})
+	if !errors.Is(err, util.ErrHistoryChanged) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if history, _ := memory.GetHistory(ctx); len(history) != 5 || history[3].Content != "good answer 1" || history[4].Content != "concurrent" {
+		t.Errorf("concurrent message should be kept %+v", history)
+	}
+}
+
+func TestCallMessages(t *testing.T) {
+	ctx := context.Background()
+	memory := newRecordMemory()
+	memory.messages = util.Messages{
+		{Role: util.RoleUser, Content: "q1"},
+		{Role: util.RoleAssistant, Content: "a1"},
+	}
+	system := util.Message{Role: util.RoleSystem, Content: "You are a bot."}
+
+	// 没有 prompt 时最后一条用户消息是输入
+	llm := &fakeLLM{chunks: []string{"a2"}}
+	_, err := newCallCmd().Exec(ctx, map[string]interface{}{
+		"llm":         llm,
+		"chat_memory": memory,
+		"messages":    util.Messages{system, {Role: util.RoleUser, Content: "q2"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{"You are a bot.", "q1", "a1", "q2"}
+	if len(llm.req.Messages) != len(expect) {
+		t.Fatalf("unexpected request messages %+v", llm.req.Messages)
+	}
+	for i, content := range expect {
+		if llm.req.Messages[i].Content != content {
+			t.Errorf("message %d: expect %q, got %q", i, content, llm.req.Messages[i].Content)
+		}
+	}
+
+	// 有 prompt 时 messages 全部放在历史之前，且不会写入历史
+	_, err = newCallCmd().Exec(ctx, map[string]interface{}{
+		"llm":         llm,
+		"chat_memory": memory,
+		"messages":    util.Messages{system, {Role: util.RoleUser, Content: "few-shot"}, {Role: util.RoleAssistant, Content: "example"}},
+		"prompt":      "q3",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(llm.req.Messages) != 8 || llm.req.Messages[2].Content != "example" || llm.req.Messages[7].Content != "q3" {
+		t.Errorf("unexpected request messages %+v", llm.req.Messages)
+	}
+
+	history, _ := memory.GetHistory(ctx)
+	if len(history) != 6 || history[2].Content != "q2" || history[4].Content != "q3" {
+		t.Errorf("unexpected history %+v", history)
+	}
+
+	_, err = newCallCmd().Exec(ctx, map[string]interface{}{
+		"llm":      llm,
+		"messages": util.Messages{system},
+	})
+	if err == nil {
+		t.Errorf("messages without a user message should need a prompt")
+	}
+}
+
+func TestCallFunctionResult(t *testing.T) {
+	ctx := context.Background()
+	memory := newRecordMemory()
+	memory.messages = util.Messages{
+		{Role: util.RoleUser, Content: "Weather in Paris?"},
+		{Role: util.RoleAssistant, FunctionCall: &util.FunctionCall{Name: "get_weather", Arguments: `{"city":"Paris"}`}},
+	}
+
+	llm := &fakeLLM{chunks: []string{"It is 20 degrees."}}
+	params := map[string]interface{}{
+		"llm":             llm,
+		"chat_memory":     memory,
+		"function_result": map[string]interface{}{"temp": 20},
+	}
+	rsp, err := newCallCmd().Exec(ctx, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp["default"] != "It is 20 degrees." {
+		t.Errorf("unexpected answer %v", rsp["default"])
+	}
+	result := util.Message{Role: util.RoleFunction, Name: "get_weather", Content: `{"temp":20}`}
+	if len(llm.req.Messages) != 3 || llm.req.Messages[2] != result {
+		t.Errorf("unexpected request messages %+v", llm.req.Messages)
+	}
+	history, _ := memory.GetHistory(ctx)
+	if len(history) != 4 || history[2] != result || history[3].Content != "It is 20 degrees." {
+		t.Errorf("unexpected history %+v", history)
+	}
+
+	// 上一条消息已经不是 function_call
+	_, err = newCallCmd().Exec(ctx, params)
+	if err == nil || !strings.Contains(err.Error(), "must follow a function_call") {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	_, err = newCallCmd().Exec(ctx, map[string]interface{}{
+		"llm": llm,
+		"messages": util.Messages{
+			{Role: util.RoleUser, Content: "Weather in Paris?"},
+			{Role: util.RoleAssistant, FunctionCall: &util.FunctionCall{Name: "get_weather"}},
+		},
+		"function_name":   "get_time",
+		"function_result": `{"time":"12:00"}`,
+	})
+	if err == nil || !strings.Contains(err.Error(), "get_time") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
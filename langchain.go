@@ -1,17 +1,19 @@
 package main
 
 import (
-	"context"
-	"github.com/sashabaranov/go-openai"
 	"github.com/zbysir/writeflow/pkg/export"
+	"github.com/zbysir/writeflow_plugin_llm/anthropic"
+	"github.com/zbysir/writeflow_plugin_llm/ollama"
+	"github.com/zbysir/writeflow_plugin_llm/redis"
 	"github.com/zbysir/writeflow_plugin_llm/sashabaranov"
+	"github.com/zbysir/writeflow_plugin_llm/sqlite"
 	"github.com/zbysir/writeflow_plugin_llm/util"
 	"reflect"
 )
 
+// PluginLLM 由不同的 SDK 实现，new_openai 输出的 util.LLM 会被 langchain_call 使用
 type PluginLLM interface {
 	NewOpenAICmd() export.CMDer
-	CallOpenAICmd() export.CMDer
 	SupportStream() bool
 }
 
@@ -42,7 +44,18 @@ func (l *LangChain) Categories() []export.Category {
 }
 
 func (l *LangChain) Components() []export.Component {
-	var langchainCallInputParams []export.NodeInputParam
+	langchainCallInputParams := []export.NodeInputParam{
+		{
+			Name:        map[string]string{"zh-CN": "Mode（regenerate：删除最后一轮的回复并重新提问）"},
+			Key:         "mode",
+			Type:        "string",
+			DisplayType: "select",
+			Options:     []string{callModeChat, callModeRegenerate},
+			Value:       callModeChat,
+			Optional:    true,
+		},
+		onErrorInputParam(),
+	}
 	if l.pluginLLM.SupportStream() {
 		langchainCallInputParams = append(langchainCallInputParams, export.NodeInputParam{
 			Name: map[string]string{
@@ -78,6 +91,130 @@ func (l *LangChain) Components() []export.Component {
 						Key:  "base_url",
 						Type: "string",
 					},
+					{
+						Name:        map[string]string{"zh-CN": "ApiType"},
+						Key:         "api_type",
+						Type:        "string",
+						DisplayType: "select",
+						Options:     []string{sashabaranov.APITypeOpenAI, sashabaranov.APITypeAzure, sashabaranov.APITypeAzureAD},
+						Value:       sashabaranov.APITypeOpenAI,
+						Optional:    true,
+					},
+					{
+						Name:     map[string]string{"zh-CN": "ApiVersion（Azure）"},
+						Key:      "api_version",
+						Type:     "string",
+						Value:    sashabaranov.DefaultAzureAPIVersion,
+						Optional: true,
+					},
+					{
+						Name:        map[string]string{"zh-CN": "Deployments（Azure，一行一个 model=deployment）"},
+						Key:         "deployments",
+						Type:        "string",
+						DisplayType: "textarea",
+						Optional:    true,
+					},
+				},
+				OutputAnchors: []export.NodeOutputAnchor{
+					{
+						Name: map[string]string{"zh-CN": "Default"},
+						Key:  "default",
+						Type: "langchain/llm",
+					},
+				},
+			},
+		},
+		{
+			Id:       0,
+			Type:     "new_anthropic",
+			Category: "llm",
+			Data: export.ComponentData{
+				Name: map[string]string{
+					"zh-CN": "Anthropic",
+				},
+				Source: export.ComponentSource{
+					CmdType:    "builtin",
+					BuiltinCmd: "new_anthropic",
+				},
+				InputParams: []export.NodeInputParam{
+					{
+						Name: map[string]string{"zh-CN": "ApiKey"},
+						Key:  "api_key",
+						Type: "string",
+					},
+					{
+						Name:     map[string]string{"zh-CN": "BaseURL"},
+						Key:      "base_url",
+						Type:     "string",
+						Optional: true,
+					},
+					{
+						Name:     map[string]string{"zh-CN": "Model（覆盖 LangChain 中的 Model，为空时使用 LangChain 中选择的 Claude 模型或者默认模型）"},
+						Key:      "model",
+						Type:     "string",
+						Value:    anthropic.DefaultModel,
+						Optional: true,
+					},
+					{
+						Name:     map[string]string{"zh-CN": "AnthropicVersion"},
+						Key:      "version",
+						Type:     "string",
+						Value:    anthropic.DefaultVersion,
+						Optional: true,
+					},
+				},
+				OutputAnchors: []export.NodeOutputAnchor{
+					{
+						Name: map[string]string{"zh-CN": "Default"},
+						Key:  "default",
+						Type: "langchain/llm",
+					},
+				},
+			},
+		},
+		{
+			Id:       0,
+			Type:     "new_ollama",
+			Category: "llm",
+			Data: export.ComponentData{
+				Name: map[string]string{
+					"zh-CN": "Ollama",
+				},
+				Source: export.ComponentSource{
+					CmdType:    "builtin",
+					BuiltinCmd: "new_ollama",
+				},
+				InputParams: []export.NodeInputParam{
+					{
+						Name:  map[string]string{"zh-CN": "BaseURL"},
+						Key:   "base_url",
+						Type:  "string",
+						Value: ollama.DefaultBaseURL,
+					},
+					{
+						Name: map[string]string{"zh-CN": "Model"},
+						Key:  "model",
+						Type: "string",
+					},
+					{
+						Name:     map[string]string{"zh-CN": "KeepAlive"},
+						Key:      "keep_alive",
+						Type:     "string",
+						Value:    "5m",
+						Optional: true,
+					},
+					{
+						Name:     map[string]string{"zh-CN": "NumCtx"},
+						Key:      "num_ctx",
+						Type:     "number",
+						Optional: true,
+					},
+					{
+						Name:     map[string]string{"zh-CN": "Temperature（覆盖 LangChain 中的 Temperature）"},
+						Key:      "temperature",
+						Type:     "number",
+						Optional: true,
+					},
 				},
 				OutputAnchors: []export.NodeOutputAnchor{
 					{
@@ -93,7 +230,8 @@ func (l *LangChain) Components() []export.Component {
 			Type:     "chat_memory",
 			Category: "llm",
 			Data: export.ComponentData{
-				Name: map[string]string{"zh-CN": "ChatMemory"},
+				Name:        map[string]string{"zh-CN": "ChatMemory"},
+				Description: map[string]string{"zh-CN": "保存对话历史。插件本身不包含 SQLite 驱动，宿主程序注册了 database/sql 的 SQLite 驱动（如 modernc.org/sqlite）时才能选择 sqlite"},
 				Source: export.ComponentSource{
 					CmdType:    "builtin",
 					BuiltinCmd: "chat_memory",
@@ -105,6 +243,200 @@ func (l *LangChain) Components() []export.Component {
 						Type:     "string",
 						Optional: true,
 					},
+					{
+						Name:     map[string]string{"zh-CN": "MaxSize（读取的最大消息数，按整轮截取，0 表示不限制）"},
+						Key:      "max_size",
+						Type:     "number",
+						Value:    0,
+						Optional: true,
+					},
+					{
+						Name:        map[string]string{"zh-CN": "Window（token：按模型的上下文长度截取历史）"},
+						Key:         "window",
+						Type:        "string",
+						DisplayType: "select",
+						Options:     []string{memoryWindowAll, memoryWindowToken},
+						Value:       memoryWindowAll,
+						Optional:    true,
+					},
+					{
+						Name:        map[string]string{"zh-CN": "Store（file：保存为 Dir 下的 JSONL 文件；sqlite：保存到 DSN 指定的数据库；redis：多个实例共享）"},
+						Key:         "store",
+						Type:        "string",
+						DisplayType: "select",
+						Options:     memoryStoreOptions(),
+						Value:       memoryStoreMemory,
+						Optional:    true,
+					},
+					{
+						Name:     map[string]string{"zh-CN": "Dir（Store 为 file 时使用）"},
+						Key:      "dir",
+						Type:     "string",
+						Value:    "./data/chat_memory",
+						Optional: true,
+					},
+					{
+						Name:     map[string]string{"zh-CN": "DSN（Store 为 sqlite 时使用）"},
+						Key:      "dsn",
+						Type:     "string",
+						Value:    "./data/chat_memory.db",
+						Optional: true,
+					},
+					{
+						Name:     map[string]string{"zh-CN": "Driver（宿主程序注册的 database/sql 驱动名）"},
+						Key:      "driver",
+						Type:     "string",
+						Value:    sqlite.DefaultDriver,
+						Optional: true,
+					},
+					{
+						Name:     map[string]string{"zh-CN": "RedisAddr（Store 为 redis 时使用）"},
+						Key:      "redis_addr",
+						Type:     "string",
+						Value:    "localhost:6379",
+						Optional: true,
+					},
+					{
+						Name:     map[string]string{"zh-CN": "RedisUsername"},
+						Key:      "redis_username",
+						Type:     "string",
+						Optional: true,
+					},
+					{
+						Name:        map[string]string{"zh-CN": "RedisPassword"},
+						Key:         "redis_password",
+						Type:        "string",
+						DisplayType: "password",
+						Optional:    true,
+					},
+					{
+						Name:     map[string]string{"zh-CN": "RedisDB"},
+						Key:      "redis_db",
+						Type:     "number",
+						Value:    0,
+						Optional: true,
+					},
+					{
+						Name:     map[string]string{"zh-CN": "KeyPrefix"},
+						Key:      "key_prefix",
+						Type:     "string",
+						Value:    redis.DefaultKeyPrefix,
+						Optional: true,
+					},
+					{
+						Name:     map[string]string{"zh-CN": "TTL（如 24h，每次写入时刷新，空表示不过期）"},
+						Key:      "ttl",
+						Type:     "string",
+						Optional: true,
+					},
+				},
+				OutputAnchors: []export.NodeOutputAnchor{
+					{
+						Name: map[string]string{"zh-CN": "Default"},
+						Key:  "default",
+						Type: "langchain/chat_memory",
+					},
+				},
+			},
+		},
+		{
+			Type:     "summary_memory",
+			Category: "llm",
+			Data: export.ComponentData{
+				Name:        map[string]string{"zh-CN": "SummaryMemory"},
+				Description: map[string]string{"zh-CN": "历史超过 Threshold 条时，使用 LLM 将较早的消息合并为摘要"},
+				Source: export.ComponentSource{
+					CmdType:    "builtin",
+					BuiltinCmd: "summary_memory",
+				},
+				InputParams: []export.NodeInputParam{
+					{
+						InputType: "anchor",
+						Name:      map[string]string{"zh-CN": "ChatMemory"},
+						Key:       "chat_memory",
+						Type:      "langchain/chat_memory",
+					},
+					{
+						InputType: "anchor",
+						Name:      map[string]string{"zh-CN": "LLM"},
+						Key:       "llm",
+						Type:      "langchain/llm",
+					},
+					{
+						Name:        map[string]string{"zh-CN": "Model（为空时由 LLM 选择默认模型）"},
+						Key:         "model",
+						Type:        "string",
+						DisplayType: "select",
+						Options:     util.ChatModels,
+						Optional:    true,
+					},
+					{
+						Name:     map[string]string{"zh-CN": "Threshold（超过这个消息数时生成摘要）"},
+						Key:      "threshold",
+						Type:     "number",
+						Value:    util.DefaultSummaryThreshold,
+						Optional: true,
+					},
+					{
+						Name:     map[string]string{"zh-CN": "Keep（保留原文的最近消息数）"},
+						Key:      "keep",
+						Type:     "number",
+						Value:    util.DefaultSummaryKeep,
+						Optional: true,
+					},
+				},
+				OutputAnchors: []export.NodeOutputAnchor{
+					{
+						Name: map[string]string{"zh-CN": "Default"},
+						Key:  "default",
+						Type: "langchain/chat_memory",
+					},
+				},
+			},
+		},
+		{
+			Type:     "recall_memory",
+			Category: "llm",
+			Data: export.ComponentData{
+				Name:        map[string]string{"zh-CN": "RecallMemory"},
+				Description: map[string]string{"zh-CN": "只发送最近的对话，以及更早的对话中与 Prompt 最相似的几轮，需要 LLM 支持 Embedding"},
+				Source: export.ComponentSource{
+					CmdType:    "builtin",
+					BuiltinCmd: "recall_memory",
+				},
+				InputParams: []export.NodeInputParam{
+					{
+						InputType: "anchor",
+						Name:      map[string]string{"zh-CN": "ChatMemory"},
+						Key:       "chat_memory",
+						Type:      "langchain/chat_memory",
+					},
+					{
+						InputType: "anchor",
+						Name:      map[string]string{"zh-CN": "LLM"},
+						Key:       "llm",
+						Type:      "langchain/llm",
+					},
+					{
+						Name:     map[string]string{"zh-CN": "EmbeddingModel（为空时由 LLM 选择默认模型）"},
+						Key:      "embedding_model",
+						Type:     "string",
+						Optional: true,
+					},
+					{
+						Name:     map[string]string{"zh-CN": "Recent（总是发送的最近对话轮数）"},
+						Key:      "recent",
+						Type:     "number",
+						Value:    util.DefaultRecallRecent,
+						Optional: true,
+					},
+					{
+						Name:     map[string]string{"zh-CN": "TopK（回忆的对话轮数）"},
+						Key:      "top_k",
+						Type:     "number",
+						Value:    util.DefaultRecallTopK,
+						Optional: true,
+					},
 				},
 				OutputAnchors: []export.NodeOutputAnchor{
 					{
@@ -115,6 +447,376 @@ func (l *LangChain) Components() []export.Component {
 				},
 			},
 		},
+		{
+			Type:     "chat_memory_list",
+			Category: "llm",
+			Data: export.ComponentData{
+				Name:        map[string]string{"zh-CN": "ChatMemoryList"},
+				Description: map[string]string{"zh-CN": "分页列出 ChatMemory 存储中的 session"},
+				Source: export.ComponentSource{
+					CmdType:    "builtin",
+					BuiltinCmd: "chat_memory_list",
+				},
+				InputParams: []export.NodeInputParam{
+					{
+						InputType: "anchor",
+						Name:      map[string]string{"zh-CN": "ChatMemory"},
+						Key:       "chat_memory",
+						Type:      "langchain/chat_memory",
+					},
+					{
+						Name:     map[string]string{"zh-CN": "Offset"},
+						Key:      "offset",
+						Type:     "number",
+						Value:    0,
+						Optional: true,
+					},
+					{
+						Name:     map[string]string{"zh-CN": "Limit（0 表示不限制）"},
+						Key:      "limit",
+						Type:     "number",
+						Value:    0,
+						Optional: true,
+					},
+				},
+				OutputAnchors: []export.NodeOutputAnchor{
+					{
+						Name: map[string]string{"zh-CN": "Default"},
+						Key:  "default",
+						Type: "string",
+						List: true,
+					},
+				},
+			},
+		},
+		{
+			Type:     "chat_memory_get",
+			Category: "llm",
+			Data: export.ComponentData{
+				Name:        map[string]string{"zh-CN": "ChatMemoryGet"},
+				Description: map[string]string{"zh-CN": "分页读取 session 的历史"},
+				Source: export.ComponentSource{
+					CmdType:    "builtin",
+					BuiltinCmd: "chat_memory_get",
+				},
+				InputParams: []export.NodeInputParam{
+					{
+						InputType: "anchor",
+						Name:      map[string]string{"zh-CN": "ChatMemory"},
+						Key:       "chat_memory",
+						Type:      "langchain/chat_memory",
+					},
+					{
+						Name:     map[string]string{"zh-CN": "SessionID（为空时使用 ChatMemory 的 SessionID）"},
+						Key:      "session_id",
+						Type:     "string",
+						Optional: true,
+					},
+					{
+						Name:     map[string]string{"zh-CN": "Offset"},
+						Key:      "offset",
+						Type:     "number",
+						Value:    0,
+						Optional: true,
+					},
+					{
+						Name:     map[string]string{"zh-CN": "Limit（0 表示不限制）"},
+						Key:      "limit",
+						Type:     "number",
+						Value:    0,
+						Optional: true,
+					},
+				},
+				OutputAnchors: []export.NodeOutputAnchor{
+					{
+						Name: map[string]string{"zh-CN": "Default"},
+						Key:  "default",
+						Type: "any",
+					},
+					{
+						Name: map[string]string{"zh-CN": "JSON"},
+						Key:  "json",
+						Type: "string",
+					},
+				},
+			},
+		},
+		{
+			Type:     "chat_memory_set",
+			Category: "llm",
+			Data: export.ComponentData{
+				Name:        map[string]string{"zh-CN": "ChatMemorySet"},
+				Description: map[string]string{"zh-CN": "将 session 的历史替换为 Messages"},
+				Source: export.ComponentSource{
+					CmdType:    "builtin",
+					BuiltinCmd: "chat_memory_set",
+				},
+				InputParams: []export.NodeInputParam{
+					{
+						InputType: "anchor",
+						Name:      map[string]string{"zh-CN": "ChatMemory"},
+						Key:       "chat_memory",
+						Type:      "langchain/chat_memory",
+					},
+					{
+						Name:     map[string]string{"zh-CN": "SessionID（为空时使用 ChatMemory 的 SessionID）"},
+						Key:      "session_id",
+						Type:     "string",
+						Optional: true,
+					},
+					{
+						InputType: "anchor",
+						Name:      map[string]string{"zh-CN": "Messages（JSON 或者消息列表）"},
+						Key:       "messages",
+						Type:      "any",
+					},
+				},
+				OutputAnchors: []export.NodeOutputAnchor{
+					{
+						Name: map[string]string{"zh-CN": "Default"},
+						Key:  "default",
+						Type: "any",
+					},
+				},
+			},
+		},
+		{
+			Type:     "chat_memory_clear",
+			Category: "llm",
+			Data: export.ComponentData{
+				Name:        map[string]string{"zh-CN": "ChatMemoryClear"},
+				Description: map[string]string{"zh-CN": "删除 session 的全部历史"},
+				Source: export.ComponentSource{
+					CmdType:    "builtin",
+					BuiltinCmd: "chat_memory_clear",
+				},
+				InputParams: []export.NodeInputParam{
+					{
+						InputType: "anchor",
+						Name:      map[string]string{"zh-CN": "ChatMemory"},
+						Key:       "chat_memory",
+						Type:      "langchain/chat_memory",
+					},
+					{
+						Name:     map[string]string{"zh-CN": "SessionID（为空时使用 ChatMemory 的 SessionID）"},
+						Key:      "session_id",
+						Type:     "string",
+						Optional: true,
+					},
+				},
+				OutputAnchors: []export.NodeOutputAnchor{
+					{
+						Name: map[string]string{"zh-CN": "SessionID"},
+						Key:  "default",
+						Type: "string",
+					},
+				},
+			},
+		},
+		{
+			Type:     "chat_memory_fork",
+			Category: "llm",
+			Data: export.ComponentData{
+				Name:        map[string]string{"zh-CN": "ChatMemoryFork"},
+				Description: map[string]string{"zh-CN": "将前 Turn 轮对话复制到新的 session，新的 session 不能已经有历史"},
+				Source: export.ComponentSource{
+					CmdType:    "builtin",
+					BuiltinCmd: "chat_memory_fork",
+				},
+				InputParams: []export.NodeInputParam{
+					{
+						InputType: "anchor",
+						Name:      map[string]string{"zh-CN": "ChatMemory"},
+						Key:       "chat_memory",
+						Type:      "langchain/chat_memory",
+					},
+					{
+						Name: map[string]string{"zh-CN": "NewSessionID"},
+						Key:  "new_session_id",
+						Type: "string",
+					},
+					{
+						Name:     map[string]string{"zh-CN": "Turn（保留的对话轮数，-1 表示全部）"},
+						Key:      "turn",
+						Type:     "number",
+						Value:    -1,
+						Optional: true,
+					},
+				},
+				OutputAnchors: []export.NodeOutputAnchor{
+					{
+						Name: map[string]string{"zh-CN": "Default"},
+						Key:  "default",
+						Type: "langchain/chat_memory",
+					},
+				},
+			},
+		},
+		{
+			Type:     "prompt_template",
+			Category: "llm",
+			Data: export.ComponentData{
+				Name:        map[string]string{"zh-CN": "PromptTemplate"},
+				Description: map[string]string{"zh-CN": "使用动态输入作为变量渲染 Go 模板，如 {{.name}}、{{ .items | join \", \" }}"},
+				Source: export.ComponentSource{
+					CmdType:    "builtin",
+					BuiltinCmd: "prompt_template",
+				},
+				DynamicInput: true,
+				InputParams: []export.NodeInputParam{
+					{
+						Name:        map[string]string{"zh-CN": "Template（可以使用 join、json、truncate、trim、default）"},
+						Key:         "template",
+						Type:        "string",
+						DisplayType: "textarea",
+					},
+					{
+						Name:        map[string]string{"zh-CN": "Role（Messages 输出的角色）"},
+						Key:         "role",
+						Type:        "string",
+						DisplayType: "select",
+						Options:     []string{util.RoleUser, util.RoleSystem, util.RoleAssistant},
+						Value:       util.RoleUser,
+						Optional:    true,
+					},
+				},
+				OutputAnchors: []export.NodeOutputAnchor{
+					{
+						Name: map[string]string{"zh-CN": "Default"},
+						Key:  "default",
+						Type: "string",
+					},
+					{
+						Name: map[string]string{"zh-CN": "Messages"},
+						Key:  "messages",
+						Type: "any",
+					},
+				},
+			},
+		},
+		{
+			Type:     "chat_prompt_template",
+			Category: "llm",
+			Data: export.ComponentData{
+				Name:        map[string]string{"zh-CN": "ChatPromptTemplate"},
+				Description: map[string]string{"zh-CN": "按顺序渲染多个带角色的模板，输出消息列表"},
+				Source: export.ComponentSource{
+					CmdType:    "builtin",
+					BuiltinCmd: "chat_prompt_template",
+				},
+				DynamicInput: true,
+				InputParams: []export.NodeInputParam{
+					{
+						Name:        map[string]string{"zh-CN": "Templates（如 [{\"role\": \"system\", \"content\": \"...\"}]）"},
+						Key:         "templates",
+						Type:        "json",
+						DisplayType: "code/json",
+						Value:       `[{"role": "system", "content": ""}, {"role": "user", "content": ""}]`,
+					},
+				},
+				OutputAnchors: []export.NodeOutputAnchor{
+					{
+						Name: map[string]string{"zh-CN": "Messages"},
+						Key:  "default",
+						Type: "any",
+					},
+				},
+			},
+		},
+		{
+			Type:     "function_define",
+			Category: "llm",
+			Data: export.ComponentData{
+				Name:        map[string]string{"zh-CN": "FunctionDefine"},
+				Description: map[string]string{"zh-CN": "定义模型可以调用的函数，可以将多个连接到 LangChain 的 Functions"},
+				Source: export.ComponentSource{
+					CmdType:    "builtin",
+					BuiltinCmd: "function_define",
+				},
+				InputParams: []export.NodeInputParam{
+					{
+						Name: map[string]string{"zh-CN": "Name"},
+						Key:  "name",
+						Type: "string",
+					},
+					{
+						Name:        map[string]string{"zh-CN": "Description"},
+						Key:         "description",
+						Type:        "string",
+						DisplayType: "textarea",
+						Optional:    true,
+					},
+					{
+						Name:        map[string]string{"zh-CN": "Properties（一行一个参数：名称 类型 [required] 描述）"},
+						Key:         "properties",
+						Type:        "string",
+						DisplayType: "textarea",
+						Optional:    true,
+					},
+					{
+						Name:        map[string]string{"zh-CN": "Parameters（JSON Schema，不能与 Properties 同时使用）"},
+						Key:         "parameters",
+						Type:        "string",
+						DisplayType: "code/json",
+						Optional:    true,
+					},
+				},
+				OutputAnchors: []export.NodeOutputAnchor{
+					{
+						Name: map[string]string{"zh-CN": "Default"},
+						Key:  "default",
+						Type: "langchain/function",
+					},
+				},
+			},
+		},
+		{
+			Type:     "tool",
+			Category: "llm",
+			Data: export.ComponentData{
+				Name:        map[string]string{"zh-CN": "Tool"},
+				Description: map[string]string{"zh-CN": "将上游节点输出的 cmd 声明为模型可以调用的函数"},
+				Source: export.ComponentSource{
+					CmdType:    "builtin",
+					BuiltinCmd: "tool",
+				},
+				InputParams: []export.NodeInputParam{
+					{
+						InputType: "anchor",
+						Name:      map[string]string{"zh-CN": "Cmd（参数是模型传入的 arguments，Default 输出作为结果）"},
+						Key:       "cmd",
+						Type:      "any",
+					},
+					{
+						Name: map[string]string{"zh-CN": "Name"},
+						Key:  "name",
+						Type: "string",
+					},
+					{
+						Name:        map[string]string{"zh-CN": "Description"},
+						Key:         "description",
+						Type:        "string",
+						DisplayType: "textarea",
+						Optional:    true,
+					},
+					{
+						Name:        map[string]string{"zh-CN": "Parameters（JSON Schema）"},
+						Key:         "parameters",
+						Type:        "string",
+						DisplayType: "code/json",
+						Value:       `{"type": "object", "properties": {}}`,
+						Optional:    true,
+					},
+				},
+				OutputAnchors: []export.NodeOutputAnchor{
+					{
+						Name: map[string]string{"zh-CN": "Default"},
+						Key:  "default",
+						Type: "langchain/tool",
+					},
+				},
+			},
+		},
 		{
 			Type:     "langchain_call",
 			Category: "llm",
@@ -146,20 +848,54 @@ func (l *LangChain) Components() []export.Component {
 					},
 					{
 						InputType: "anchor",
-						Name:      map[string]string{"zh-CN": "Functions"},
+						Name:      map[string]string{"zh-CN": "Functions（JSON 或者 FunctionDefine）"},
 						Key:       "functions",
-						Type:      "string",
+						Type:      "any",
+						Optional:  true,
+						List:      true,
+					},
+					{
+						InputType: "anchor",
+						Name:      map[string]string{"zh-CN": "Tools（模型调用时自动执行，不使用流式输出）"},
+						Key:       "tools",
+						Type:      "langchain/tool",
 						Optional:  true,
+						List:      true,
 					},
 					{
 						InputType: "anchor",
 						Name: map[string]string{
-							"zh-CN": "Prompt",
+							"zh-CN": "Prompt（Mode 为 regenerate 时不使用）",
 						},
-						Key:  "prompt",
-						Type: "string",
+						Key:      "prompt",
+						Type:     "string",
+						Optional: true,
+					},
+					{
+						InputType: "anchor",
+						Name: map[string]string{
+							"zh-CN": "Messages（放在历史之前，没有 Prompt 时最后一条用户消息作为输入）",
+						},
+						Key:      "messages",
+						Type:     "any",
+						Optional: true,
 					},
-				}, langchainCallInputParams...),
+					{
+						InputType: "anchor",
+						Name: map[string]string{
+							"zh-CN": "FunctionResult（函数的执行结果，代替 Prompt 交给模型）",
+						},
+						Key:      "function_result",
+						Type:     "any",
+						Optional: true,
+					},
+					{
+						Name:     map[string]string{"zh-CN": "FunctionName（为空时使用上一次 FunctionCall 的函数名）"},
+						Key:      "function_name",
+						Type:     "string",
+						Optional: true,
+					},
+				}, append(chatOptionInputParams(), langchainCallInputParams...)...),
 				OutputAnchors: []export.NodeOutputAnchor{
 					{
 						Name: map[string]string{
@@ -178,64 +914,188 @@ func (l *LangChain) Components() []export.Component {
 				},
 			},
 		},
+		{
+			Type:     "agent_call",
+			Category: "llm",
+			Data: export.ComponentData{
+				Name:        map[string]string{"zh-CN": "Agent"},
+				Description: map[string]string{"zh-CN": "循环调用模型并执行函数，直到模型直接回复"},
+				Source: export.ComponentSource{
+					CmdType:    "builtin",
+					BuiltinCmd: "agent_call",
+				},
+				DynamicInput: true,
+				InputParams: append([]export.NodeInputParam{
+					{
+						InputType: "anchor",
+						Name:      map[string]string{"zh-CN": "LLM"},
+						Key:       "llm",
+						Type:      "langchain/llm",
+					},
+					{
+						InputType: "anchor",
+						Name:      map[string]string{"zh-CN": "ChatMemory"},
+						Key:       "chat_memory",
+						Type:      "langchain/chat_memory",
+						Optional:  true,
+					},
+					{
+						InputType: "anchor",
+						Name:      map[string]string{"zh-CN": "Functions（函数的实现是同名的动态输入）"},
+						Key:       "functions",
+						Type:      "any",
+						Optional:  true,
+						List:      true,
+					},
+					{
+						InputType: "anchor",
+						Name:      map[string]string{"zh-CN": "Tools"},
+						Key:       "tools",
+						Type:      "langchain/tool",
+						Optional:  true,
+						List:      true,
+					},
+					{
+						InputType: "anchor",
+						Name:      map[string]string{"zh-CN": "Prompt"},
+						Key:       "prompt",
+						Type:      "string",
+					},
+					{
+						Name:     map[string]string{"zh-CN": "MaxIterations（最多执行函数的轮数）"},
+						Key:      "max_iterations",
+						Type:     "number",
+						Value:    util.DefaultAgentMaxIterations,
+						Optional: true,
+					},
+					onErrorInputParam(),
+				}, chatOptionInputParams()...),
+				OutputAnchors: []export.NodeOutputAnchor{
+					{
+						Name: map[string]string{"zh-CN": "Default"},
+						Key:  "default",
+						Type: "string",
+					},
+					{
+						Name: map[string]string{"zh-CN": "Trace"},
+						Key:  "trace",
+						Type: "any",
+					},
+					{
+						Name: map[string]string{"zh-CN": "Error（超过 MaxIterations 时的错误，Trace 是已经执行的函数）"},
+						Key:  "error",
+						Type: "string",
+					},
+				},
+			},
+		},
 	}
 }
 
-func coverMessageToBase(a openai.ChatCompletionMessage) util.Message {
-	var fc *util.FunctionCall
-	if a.FunctionCall != nil {
-		fc = &util.FunctionCall{
-			Name:      a.FunctionCall.Name,
-			Arguments: a.FunctionCall.Arguments,
-		}
-	}
-	return util.Message{
-		Role:         a.Role,
-		Content:      a.Content,
-		FunctionCall: fc,
-		Name:         a.Name,
-	}
-}
-
-func coverMessageToSDK(a util.Message) openai.ChatCompletionMessage {
-	var fc *openai.FunctionCall
-	if a.FunctionCall != nil {
-		fc = &openai.FunctionCall{
-			Name:      a.FunctionCall.Name,
-			Arguments: a.FunctionCall.Arguments,
-		}
-	}
-	return openai.ChatCompletionMessage{
-		Role:         a.Role,
-		Content:      a.Content,
-		FunctionCall: fc,
-		Name:         a.Name,
+// onErrorInputParam 是 langchain_call 与 agent_call 的 on_error 选项
+func onErrorInputParam() export.NodeInputParam {
+	return export.NodeInputParam{
+		Name:        map[string]string{"zh-CN": "OnError（record：将失败记录到 ChatMemory 中）"},
+		Key:         "on_error",
+		Type:        "string",
+		DisplayType: "select",
+		Options:     []string{callOnErrorDiscard, callOnErrorRecord},
+		Value:       callOnErrorDiscard,
+		Optional:    true,
 	}
 }
 
-func coverMessageListToSDK(as []util.Message) []openai.ChatCompletionMessage {
-	var bs []openai.ChatCompletionMessage
-	for _, a := range as {
-		bs = append(bs, coverMessageToSDK(a))
+// chatOptionInputParams 是 langchain_call 的模型与采样参数，由 util.ParseChatOptions 解析
+func chatOptionInputParams() []export.NodeInputParam {
+	return []export.NodeInputParam{
+		{
+			Name:        map[string]string{"zh-CN": "Model"},
+			Key:         "model",
+			Type:        "string",
+			DisplayType: "select",
+			Options:     util.ChatModels,
+			Value:       util.DefaultChatModel,
+		},
+		{
+			Name:     map[string]string{"zh-CN": "MaxTokens"},
+			Key:      "max_tokens",
+			Type:     "number",
+			Value:    util.DefaultMaxTokens,
+			Optional: true,
+		},
+		{
+			Name:     map[string]string{"zh-CN": "Temperature"},
+			Key:      "temperature",
+			Type:     "number",
+			Value:    util.DefaultTemperature,
+			Optional: true,
+		},
+		{
+			Name:     map[string]string{"zh-CN": "TopP"},
+			Key:      "top_p",
+			Type:     "number",
+			Value:    util.DefaultTopP,
+			Optional: true,
+		},
+		{
+			Name:     map[string]string{"zh-CN": "PresencePenalty"},
+			Key:      "presence_penalty",
+			Type:     "number",
+			Value:    0,
+			Optional: true,
+		},
+		{
+			Name:     map[string]string{"zh-CN": "FrequencyPenalty"},
+			Key:      "frequency_penalty",
+			Type:     "number",
+			Value:    0,
+			Optional: true,
+		},
+		{
+			Name:        map[string]string{"zh-CN": "Stop（一行一个）"},
+			Key:         "stop",
+			Type:        "string",
+			DisplayType: "textarea",
+			Optional:    true,
+		},
+		{
+			Name:        map[string]string{"zh-CN": "LogitBias"},
+			Key:         "logit_bias",
+			Type:        "json",
+			DisplayType: "code/json",
+			Optional:    true,
+		},
+		{
+			Name:     map[string]string{"zh-CN": "User"},
+			Key:      "user",
+			Type:     "string",
+			Optional: true,
+		},
 	}
-	return bs
 }
 
 func (l *LangChain) Cmd() map[string]export.CMDer {
 	return map[string]export.CMDer{
 		"new_openai":     l.pluginLLM.NewOpenAICmd(),
-		"langchain_call": l.pluginLLM.CallOpenAICmd(),
+		"new_anthropic":  anthropic.NewAnthropicCmd(),
+		"new_ollama":     ollama.NewOllamaCmd(),
+		"langchain_call": newCallCmd(),
+		"agent_call":     newAgentCallCmd(),
+		"tool":           newToolCmd(),
+		// function_define 输出的定义连接到 langchain_call 的 functions
+		"function_define": newFunctionDefineCmd(),
 		// chat_memory 存储对话记录
-		"chat_memory": util.NewFun(func(ctx context.Context, params map[string]interface{}) (rsp map[string]interface{}, err error) {
-			idi := params["session_id"]
-			if idi == nil {
-				return map[string]interface{}{"default": util.NewMemoryChatMemory("")}, nil
-			}
-			id := idi.(string)
-
-			memory := util.NewMemoryChatMemory(id)
-			return map[string]interface{}{"default": memory}, nil
-		}),
+		"chat_memory":       newChatMemoryCmd(),
+		"summary_memory":    newSummaryMemoryCmd(),
+		"recall_memory":     newRecallMemoryCmd(),
+		"chat_memory_list":  newChatMemoryListCmd(),
+		"chat_memory_get":   newChatMemoryGetCmd(),
+		"chat_memory_set":   newChatMemorySetCmd(),
+		"chat_memory_clear": newChatMemoryClearCmd(),
+		"chat_memory_fork":  newChatMemoryForkCmd(),
+		"prompt_template":   newPromptTemplateCmd(),
+		// chat_prompt_template 输出的消息列表连接到 langchain_call 的 messages
+		"chat_prompt_template": newChatPromptTemplateCmd(),
 	}
 }
 
@@ -4,8 +4,10 @@ import (
 	"context"
 	"github.com/zbysir/writeflow/pkg/export"
 	"github.com/zbysir/writeflow_plugin_llm/sashabaranov"
+	"github.com/zbysir/writeflow_plugin_llm/util"
 	"io"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -52,3 +54,132 @@ func TestName(t *testing.T) {
 		t.Fatalf("unknown type %s", r)
 	}
 }
+
+// fakeLLM is the LLM shared by the tests, it records the last request.
+// ChatCompletion returns replies in order before falling back to chunks, the stream sends chunks and then events.
+// Without chunks and events it echoes the last message, the stream sends it word by word.
+type fakeLLM struct {
+	chunks  []string
+	events  []util.StreamEvent
+	replies util.Messages
+	err     error
+	// window is the context window of the LLM if it is not 0, like ollama with num_ctx
+	window int
+	// wait blocks the end of ChatCompletionStream until it is closed
+	wait chan struct{}
+	// before is called before ChatCompletion answers, e.g. to change the memory like another call of the same session
+	before func(ctx context.Context)
+	req    util.ChatRequest
+}
+
+func (f *fakeLLM) echo() bool {
+	return len(f.chunks) == 0 && len(f.events) == 0
+}
+
+func (f *fakeLLM) ChatCompletion(ctx context.Context, req util.ChatRequest) (util.ChatResponse, error) {
+	f.req = req
+	if f.before != nil {
+		f.before(ctx)
+	}
+	if f.err != nil {
+		return util.ChatResponse{}, f.err
+	}
+	if len(f.replies) != 0 {
+		m := f.replies[0]
+		f.replies = f.replies[1:]
+		return util.ChatResponse{Message: m}, nil
+	}
+	content := strings.Join(f.chunks, "")
+	if f.echo() {
+		content = req.Messages[len(req.Messages)-1].Content
+	}
+	return util.ChatResponse{Message: util.Message{Role: util.RoleAssistant, Content: content}}, nil
+}
+
+func (f *fakeLLM) ChatCompletionStream(ctx context.Context, req util.ChatRequest) (*util.StreamResponse, error) {
+	f.req = req
+	chunks := f.chunks
+	if f.echo() {
+		chunks = strings.Fields(req.Messages[len(req.Messages)-1].Content)
+	}
+	s := util.NewSteamResponse()
+	go func() {
+		for _, c := range chunks {
+			s.Append(c)
+		}
+		for _, e := range f.events {
+			s.AppendEvent(e)
+		}
+		if f.wait != nil {
+			<-f.wait
+		}
+		s.Close(f.err)
+	}()
+	return s, nil
+}
+
+func (f *fakeLLM) Embedding(ctx context.Context, req util.EmbeddingRequest) ([][]float32, error) {
+	return nil, nil
+}
+
+func (f *fakeLLM) Capabilities() util.Capabilities {
+	return util.Capabilities{Stream: true, Functions: true}
+}
+
+func (f *fakeLLM) ContextWindow() int {
+	return f.window
+}
+
+func TestCallLLM(t *testing.T) {
+	ctx := context.Background()
+	llm := &fakeLLM{}
+	rsp, err := newCallCmd().Exec(ctx, map[string]interface{}{
+		"llm":    llm,
+		"prompt": "Hello",
+		"model":  "gpt-4",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp["default"] != "Hello" {
+		t.Errorf("unexpected answer %v", rsp["default"])
+	}
+	if llm.req.Model != "gpt-4" || len(llm.req.Messages) != 1 || llm.req.Messages[0].Role != util.RoleUser {
+		t.Errorf("unexpected request %+v", llm.req)
+	}
+
+	rsp, err = newCallCmd().Exec(ctx, map[string]interface{}{
+		"llm":    llm,
+		"prompt": "a b c",
+		"stream": true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := rsp["default"].(export.Stream).NewReader().ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(data, "") != "abc" {
+		t.Errorf("unexpected stream data %q", data)
+	}
+
+	// 不是 util.LLM 的值，如 SDK 的 client，不能连接到 langchain_call
+	_, err = newCallCmd().Exec(ctx, map[string]interface{}{"llm": "client", "prompt": "Hello"})
+	if err == nil || !strings.Contains(err.Error(), "langchain/llm") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestComponentsRegistered(t *testing.T) {
+	l := NewLangChain(sashabaranov.NewPlugin())
+	cmd := l.Cmd()
+	for _, c := range l.Components() {
+		if c.Data.Source.CmdType != "builtin" {
+			continue
+		}
+		if _, ok := cmd[c.Data.Source.BuiltinCmd]; !ok {
+			t.Errorf("component %s: cmd %s is not registered", c.Type, c.Data.Source.BuiltinCmd)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cast"
+	"github.com/zbysir/writeflow/pkg/export"
+	"github.com/zbysir/writeflow_plugin_llm/redis"
+	"github.com/zbysir/writeflow_plugin_llm/sqlite"
+	"github.com/zbysir/writeflow_plugin_llm/util"
+	"time"
+)
+
+// chat_memory 的 window 选项
+const (
+	memoryWindowAll   = "all"
+	memoryWindowToken = "token"
+)
+
+// chat_memory 的 store 选项
+const (
+	memoryStoreMemory = "memory"
+	memoryStoreFile   = "file"
+	memoryStoreSQLite = "sqlite"
+	memoryStoreRedis  = "redis"
+)
+
+// memoryStoreOptions 返回 chat_memory 可以选择的 store，宿主程序注册了 SQLite 驱动时才能选择 sqlite
+func memoryStoreOptions() []string {
+	if sqlite.DriverRegistered(sqlite.DefaultDriver) {
+		return []string{memoryStoreMemory, memoryStoreFile, memoryStoreSQLite, memoryStoreRedis}
+	}
+	return []string{memoryStoreMemory, memoryStoreFile, memoryStoreRedis}
+}
+
+// newChatMemoryCmd 实现 chat_memory，输出 util.ChatMemory
+func newChatMemoryCmd() export.CMDer {
+	return util.NewFun(func(ctx context.Context, params map[string]interface{}) (rsp map[string]interface{}, err error) {
+		id := cast.ToString(params["session_id"])
+		maxSize, err := intParam(params, "max_size")
+		if err != nil {
+			return nil, err
+		}
+		if maxSize < 0 {
+			return nil, fmt.Errorf("max_size must not be negative, got %d", maxSize)
+		}
+
+		var memory util.ChatMemory
+		switch store := cast.ToString(params["store"]); store {
+		case "", memoryStoreMemory:
+			memory = util.NewMemoryChatMemory(id, maxSize)
+		case memoryStoreFile:
+			s, err := util.NewFileChatStore(cast.ToString(params["dir"]))
+			if err != nil {
+				return nil, fmt.Errorf("open file store error: %w", err)
+			}
+			memory = util.NewStoreChatMemory(s, id, maxSize)
+		case memoryStoreSQLite:
+			s, err := sqlite.Open(cast.ToString(params["driver"]), cast.ToString(params["dsn"]))
+			if err != nil {
+				return nil, fmt.Errorf("open sqlite store error: %w", err)
+			}
+			memory = util.NewStoreChatMemory(s, id, maxSize)
+		case memoryStoreRedis:
+			config := redis.Config{
+				Addr:      cast.ToString(params["redis_addr"]),
+				Username:  cast.ToString(params["redis_username"]),
+				Password:  cast.ToString(params["redis_password"]),
+				KeyPrefix: cast.ToString(params["key_prefix"]),
+			}
+			config.DB, err = intParam(params, "redis_db")
+			if err != nil {
+				return nil, err
+			}
+			if v := cast.ToString(params["ttl"]); v != "" {
+				config.TTL, err = time.ParseDuration(v)
+				if err != nil {
+					return nil, fmt.Errorf("invalid ttl: %w", err)
+				}
+			}
+			s, err := redis.Open(config)
+			if err != nil {
+				return nil, fmt.Errorf("open redis store error: %w", err)
+			}
+			memory = util.NewStoreChatMemory(s, id, maxSize)
+		default:
+			return nil, fmt.Errorf("unsupported store: %s", store)
+		}
+
+		switch window := cast.ToString(params["window"]); window {
+		case "", memoryWindowAll:
+		case memoryWindowToken:
+			memory = util.NewTokenWindowChatMemory(memory)
+		default:
+			return nil, fmt.Errorf("unsupported window: %s", window)
+		}
+		return map[string]interface{}{"default": memory}, nil
+	})
+}
+
+// newSummaryMemoryCmd 实现 summary_memory，包装输入的 util.ChatMemory
+func newSummaryMemoryCmd() export.CMDer {
+	return util.NewFun(func(ctx context.Context, params map[string]interface{}) (rsp map[string]interface{}, err error) {
+		memory, ok := params["chat_memory"].(util.ChatMemory)
+		if !ok {
+			return nil, fmt.Errorf("chat_memory must be a langchain/chat_memory, got %T", params["chat_memory"])
+		}
+		llm, ok := params["llm"].(util.LLM)
+		if !ok {
+			return nil, fmt.Errorf("llm must be a langchain/llm, got %T", params["llm"])
+		}
+
+		threshold, err := intParam(params, "threshold")
+		if err != nil {
+			return nil, err
+		}
+		keep, err := intParam(params, "keep")
+		if err != nil {
+			return nil, err
+		}
+		if threshold > 0 && keep >= threshold {
+			return nil, fmt.Errorf("keep must be less than threshold")
+		}
+
+		return map[string]interface{}{
+			"default": util.NewSummaryChatMemory(memory, llm, cast.ToString(params["model"]), threshold, keep),
+		}, nil
+	})
+}
+
+// intParam 读取可选的数字参数，没有填写时返回 0
+func intParam(params map[string]interface{}, key string) (int, error) {
+	v := cast.ToString(params[key])
+	if v == "" {
+		return 0, nil
+	}
+	i, err := cast.ToIntE(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return i, nil
+}
+
+// newRecallMemoryCmd 实现 recall_memory，包装输入的 util.ChatMemory
+func newRecallMemoryCmd() export.CMDer {
+	return util.NewFun(func(ctx context.Context, params map[string]interface{}) (rsp map[string]interface{}, err error) {
+		memory, ok := params["chat_memory"].(util.ChatMemory)
+		if !ok {
+			return nil, fmt.Errorf("chat_memory must be a langchain/chat_memory, got %T", params["chat_memory"])
+		}
+		llm, ok := params["llm"].(util.LLM)
+		if !ok {
+			return nil, fmt.Errorf("llm must be a langchain/llm, got %T", params["llm"])
+		}
+		if !llm.Capabilities().Embedding {
+			return nil, fmt.Errorf("llm %T does not support embedding", llm)
+		}
+
+		recent, err := intParam(params, "recent")
+		if err != nil {
+			return nil, err
+		}
+		topK := -1
+		if cast.ToString(params["top_k"]) != "" {
+			topK, err = intParam(params, "top_k")
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return map[string]interface{}{
+			"default": util.NewRecallChatMemory(memory, llm, cast.ToString(params["embedding_model"]), recent, topK),
+		}, nil
+	})
+}
+
+// sessionStore 从 chat_memory 输入中得到可以管理的存储与 session，session_id 参数不为空时覆盖 chat_memory 中的 session。
+// summary_memory 等包装过的 ChatMemory 使用被包装的 ChatMemory 的存储
+func sessionStore(params map[string]interface{}) (util.SessionStore, string, error) {
+	m, ok := params["chat_memory"].(util.ChatMemory)
+	if !ok {
+		return nil, "", fmt.Errorf("chat_memory must be a langchain/chat_memory, got %T", params["chat_memory"])
+	}
+	memory, ok := util.BaseChatMemory(m).(util.SessionChatMemory)
+	if !ok {
+		return nil, "", fmt.Errorf("chat_memory %T is not bound to a session", util.BaseChatMemory(m))
+	}
+	store, ok := memory.Store().(util.SessionStore)
+	if !ok {
+		return nil, "", fmt.Errorf("store %T does not support session management", memory.Store())
+	}
+
+	sessionId := memory.SessionId()
+	if v := cast.ToString(params["session_id"]); v != "" {
+		sessionId = v
+	}
+	return store, sessionId, nil
+}
+
+// pageParams 读取 offset 与 limit，limit 为 0 表示不限制
+func pageParams(params map[string]interface{}) (int, int, error) {
+	offset, err := intParam(params, "offset")
+	if err != nil {
+		return 0, 0, err
+	}
+	limit, err := intParam(params, "limit")
+	if err != nil {
+		return 0, 0, err
+	}
+	if offset < 0 || limit < 0 {
+		return 0, 0, fmt.Errorf("offset and limit must not be negative")
+	}
+	return offset, limit, nil
+}
+
+// newChatMemoryListCmd 实现 chat_memory_list，输出一页 session id
+func newChatMemoryListCmd() export.CMDer {
+	return util.NewFun(func(ctx context.Context, params map[string]interface{}) (rsp map[string]interface{}, err error) {
+		store, _, err := sessionStore(params)
+		if err != nil {
+			return nil, err
+		}
+		offset, limit, err := pageParams(params)
+		if err != nil {
+			return nil, err
+		}
+		ids, err := util.SessionPage(ctx, store, offset, limit)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"default": ids}, nil
+	})
+}
+
+// newChatMemoryGetCmd 实现 chat_memory_get，输出 session 的一页历史
+func newChatMemoryGetCmd() export.CMDer {
+	return util.NewFun(func(ctx context.Context, params map[string]interface{}) (rsp map[string]interface{}, err error) {
+		store, sessionId, err := sessionStore(params)
+		if err != nil {
+			return nil, err
+		}
+		if sessionId == "" {
+			return nil, fmt.Errorf("session_id is required")
+		}
+		offset, limit, err := pageParams(params)
+		if err != nil {
+			return nil, err
+		}
+		ms, err := util.HistoryPage(ctx, store, sessionId, offset, limit)
+		if err != nil {
+			return nil, err
+		}
+		bs, err := json.Marshal(ms)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"default": ms, "json": string(bs)}, nil
+	})
+}
+
+// newChatMemorySetCmd 实现 chat_memory_set，将 session 的历史替换为输入的 messages
+func newChatMemorySetCmd() export.CMDer {
+	return util.NewFun(func(ctx context.Context, params map[string]interface{}) (rsp map[string]interface{}, err error) {
+		store, sessionId, err := sessionStore(params)
+		if err != nil {
+			return nil, err
+		}
+		if sessionId == "" {
+			return nil, fmt.Errorf("session_id is required")
+		}
+		ms, err := util.ParseMessages(params["messages"])
+		if err != nil {
+			return nil, err
+		}
+		err = store.Replace(ctx, sessionId, ms)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"default": ms}, nil
+	})
+}
+
+// newChatMemoryClearCmd 实现 chat_memory_clear，删除 session 的全部历史
+func newChatMemoryClearCmd() export.CMDer {
+	return util.NewFun(func(ctx context.Context, params map[string]interface{}) (rsp map[string]interface{}, err error) {
+		store, sessionId, err := sessionStore(params)
+		if err != nil {
+			return nil, err
+		}
+		if sessionId == "" {
+			return nil, fmt.Errorf("session_id is required")
+		}
+		err = store.Delete(ctx, sessionId)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"default": sessionId}, nil
+	})
+}
+
+// newChatMemoryForkCmd 实现 chat_memory_fork，输出绑定在新 session 上的 util.ChatMemory
+func newChatMemoryForkCmd() export.CMDer {
+	return util.NewFun(func(ctx context.Context, params map[string]interface{}) (rsp map[string]interface{}, err error) {
+		m, ok := params["chat_memory"].(util.ChatMemory)
+		if !ok {
+			return nil, fmt.Errorf("chat_memory must be a langchain/chat_memory, got %T", params["chat_memory"])
+		}
+		// 包装过的 ChatMemory 分叉被包装的 ChatMemory，输出的 ChatMemory 不再带有包装
+		memory, ok := util.BaseChatMemory(m).(util.ForkableChatMemory)
+		if !ok {
+			return nil, fmt.Errorf("chat_memory %T does not support fork", util.BaseChatMemory(m))
+		}
+		turn := -1
+		if cast.ToString(params["turn"]) != "" {
+			turn, err = intParam(params, "turn")
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		n := -1
+		if turn >= 0 {
+			ms, err := memory.Snapshot(ctx)
+			if err != nil {
+				return nil, err
+			}
+			n = util.TurnIndex(ms, turn)
+		}
+		forked, err := memory.Fork(ctx, cast.ToString(params["new_session_id"]), n)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"default": forked}, nil
+	})
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"github.com/zbysir/writeflow_plugin_llm/util"
+	"strings"
+	"testing"
+)
+
+func TestSessionManagement(t *testing.T) {
+	ctx := context.Background()
+	for _, store := range []string{memoryStoreMemory, memoryStoreFile} {
+		rsp, err := newChatMemoryCmd().Exec(ctx, map[string]interface{}{
+			"session_id": "admin-a",
+			"store":      store,
+			"dir":        t.TempDir(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		memory := rsp["default"].(util.ChatMemory)
+		err = memory.AppendHistory(ctx, util.Message{Role: util.RoleUser, Content: "Hi"}, util.Message{Role: util.RoleAssistant, Content: "Hello"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// 设置另一个 session 的历史
+		_, err = newChatMemorySetCmd().Exec(ctx, map[string]interface{}{
+			"chat_memory": memory,
+			"session_id":  "admin-b",
+			"messages":    []interface{}{map[string]interface{}{"role": "system", "content": "You are a bot."}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rsp, err = newChatMemoryListCmd().Exec(ctx, map[string]interface{}{"chat_memory": memory})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := map[string]bool{}
+		for _, id := range rsp["default"].([]string) {
+			ids[id] = true
+		}
+		if !ids["admin-a"] || !ids["admin-b"] {
+			t.Fatalf("%s: unexpected sessions %v", store, rsp["default"])
+		}
+
+		rsp, err = newChatMemoryGetCmd().Exec(ctx, map[string]interface{}{"chat_memory": memory, "session_id": "admin-b"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ms := rsp["default"].(util.Messages); len(ms) != 1 || ms[0].Role != util.RoleSystem {
+			t.Fatalf("%s: unexpected messages %+v", store, ms)
+		}
+		if rsp["json"] != `[{"role":"system","content":"You are a bot."}]` {
+			t.Errorf("%s: unexpected json %v", store, rsp["json"])
+		}
+
+		// 分页读取
+		rsp, err = newChatMemoryGetCmd().Exec(ctx, map[string]interface{}{"chat_memory": memory, "offset": 1, "limit": 5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ms := rsp["default"].(util.Messages); len(ms) != 1 || ms[0].Content != "Hello" {
+			t.Fatalf("%s: unexpected page %+v", store, ms)
+		}
+		rsp, err = newChatMemoryListCmd().Exec(ctx, map[string]interface{}{"chat_memory": memory, "limit": "1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids := rsp["default"].([]string); len(ids) != 1 {
+			t.Fatalf("%s: unexpected page %v", store, ids)
+		}
+		_, err = newChatMemoryListCmd().Exec(ctx, map[string]interface{}{"chat_memory": memory, "offset": -1})
+		if err == nil {
+			t.Errorf("%s: negative offset should be rejected", store)
+		}
+
+		_, err = newChatMemoryClearCmd().Exec(ctx, map[string]interface{}{"chat_memory": memory})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h, _ := memory.GetHistory(ctx); len(h) != 0 {
+			t.Errorf("%s: history should be cleared, got %+v", store, h)
+		}
+		_ = memory.(util.SessionChatMemory).Store().(util.SessionStore).Delete(ctx, "admin-b")
+	}
+}
+
+func TestMemoryStoreOptions(t *testing.T) {
+	// 测试中没有注册 SQLite 驱动，不能选择 sqlite
+	for _, o := range memoryStoreOptions() {
+		if o == memoryStoreSQLite {
+			t.Errorf("sqlite should not be selectable without a driver")
+		}
+	}
+}
+
+func TestSessionManagementWrapped(t *testing.T) {
+	ctx := context.Background()
+	base := util.NewMemoryChatMemory("admin-wrapped", 0)
+	_ = base.AppendHistory(ctx, util.Message{Role: util.RoleUser, Content: "Hi"})
+
+	// window 为 token、summary_memory 与 recall_memory 的输出都可以用于管理组件
+	for _, memory := range []util.ChatMemory{
+		util.NewTokenWindowChatMemory(base),
+		util.NewSummaryChatMemory(util.NewTokenWindowChatMemory(base), &fakeLLM{}, "", 0, 0),
+		util.NewRecallChatMemory(base, &fakeLLM{}, "", 0, 0),
+	} {
+		rsp, err := newChatMemoryListCmd().Exec(ctx, map[string]interface{}{"chat_memory": memory})
+		if err != nil {
+			t.Fatalf("%T: %v", memory, err)
+		}
+		found := false
+		for _, id := range rsp["default"].([]string) {
+			found = found || id == "admin-wrapped"
+		}
+		if !found {
+			t.Fatalf("%T: unexpected sessions %v", memory, rsp["default"])
+		}
+
+		rsp, err = newChatMemoryGetCmd().Exec(ctx, map[string]interface{}{"chat_memory": memory})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ms := rsp["default"].(util.Messages); len(ms) != 1 || ms[0].Content != "Hi" {
+			t.Fatalf("%T: unexpected messages %+v", memory, ms)
+		}
+	}
+
+	memory := util.NewTokenWindowChatMemory(base)
+	_, err := newChatMemorySetCmd().Exec(ctx, map[string]interface{}{
+		"chat_memory": memory,
+		"messages":    []interface{}{map[string]interface{}{"role": "user", "content": "Hello"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h, _ := base.GetHistory(ctx); len(h) != 1 || h[0].Content != "Hello" {
+		t.Fatalf("unexpected history %+v", h)
+	}
+	_, err = newChatMemoryClearCmd().Exec(ctx, map[string]interface{}{"chat_memory": memory})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h, _ := base.GetHistory(ctx); len(h) != 0 {
+		t.Errorf("history should be cleared, got %+v", h)
+	}
+
+	_, err = newChatMemoryListCmd().Exec(ctx, map[string]interface{}{"chat_memory": "x"})
+	if err == nil {
+		t.Errorf("chat_memory which is not a ChatMemory should be rejected")
+	}
+}
+
+func TestSummaryMemory(t *testing.T) {
+	ctx := context.Background()
+	llm := &fakeLLM{chunks: []string{"they said hi"}}
+	rsp, err := newSummaryMemoryCmd().Exec(ctx, map[string]interface{}{
+		"chat_memory": util.NewMemoryChatMemory("summary-memory", 0),
+		"llm":         llm,
+		"threshold":   "2",
+		"keep":        "1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	memory := rsp["default"].(util.ChatMemory)
+	for _, content := range []string{"Hi", "Hello", "How are you?"} {
+		if err := memory.AppendHistory(ctx, util.Message{Role: util.RoleUser, Content: content}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h, err := memory.GetHistory(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h) == 0 || h[0].Role != util.RoleSystem || !strings.Contains(h[0].Content, "they said hi") || h[len(h)-1].Content != "How are you?" {
+		t.Fatalf("unexpected history %+v", h)
+	}
+	if llm.req.Model != "" {
+		t.Errorf("model should be chosen by the llm, got %q", llm.req.Model)
+	}
+
+	_, err = newSummaryMemoryCmd().Exec(ctx, map[string]interface{}{
+		"chat_memory": util.NewMemoryChatMemory("summary-memory", 0),
+		"llm":         llm,
+		"threshold":   2,
+		"keep":        2,
+	})
+	if err == nil {
+		t.Errorf("keep must be less than threshold")
+	}
+}
+
+func TestChatMemoryFork(t *testing.T) {
+	ctx := context.Background()
+	s, err := util.NewFileChatStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := util.NewStoreChatMemory(s, "fork-src", 0)
+	_ = base.AppendHistory(ctx,
+		util.Message{Role: util.RoleUser, Content: "q1"},
+		util.Message{Role: util.RoleAssistant, Content: "a1"},
+		util.Message{Role: util.RoleUser, Content: "q2"},
+		util.Message{Role: util.RoleAssistant, Content: "a2"},
+	)
+
+	// 包装过的 ChatMemory 分叉被包装的历史
+	rsp, err := newChatMemoryForkCmd().Exec(ctx, map[string]interface{}{
+		"chat_memory":    util.NewTokenWindowChatMemory(base),
+		"new_session_id": "fork-dst",
+		"turn":           1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h, _ := rsp["default"].(util.ChatMemory).GetHistory(ctx); len(h) != 2 || h[1].Content != "a1" {
+		t.Fatalf("unexpected forked history %+v", h)
+	}
+
+	// 不能覆盖已有的 session
+	_, err = newChatMemoryForkCmd().Exec(ctx, map[string]interface{}{
+		"chat_memory":    base,
+		"new_session_id": "fork-dst",
+	})
+	if err == nil {
+		t.Fatal("fork to a session with history should fail")
+	}
+	if h, _ := s.Load(ctx, "fork-dst"); len(h) != 2 {
+		t.Fatalf("existing session should not be changed, got %+v", h)
+	}
+}
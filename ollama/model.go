@@ -0,0 +1,83 @@
+package ollama
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+type chatRequest struct {
+	Model     string                 `json:"model"`
+	Messages  []message              `json:"messages"`
+	Stream    bool                   `json:"stream"`
+	KeepAlive string                 `json:"keep_alive,omitempty"`
+	Options   map[string]interface{} `json:"options,omitempty"`
+	Tools     []tool                 `json:"tools,omitempty"`
+}
+
+type message struct {
+	Role      string     `json:"role"`
+	Content   string     `json:"content"`
+	ToolCalls []toolCall `json:"tool_calls,omitempty"`
+	// ToolName is the name of the function for role: tool
+	ToolName string `json:"tool_name,omitempty"`
+}
+
+type toolCall struct {
+	Function toolCallFunction `json:"function"`
+}
+
+type toolCallFunction struct {
+	Name string `json:"name"`
+	// Arguments is a JSON object, not a string as OpenAI does
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+type tool struct {
+	Type     string       `json:"type"`
+	Function toolFunction `json:"function"`
+}
+
+type toolFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters"`
+}
+
+// chatResponse is the response of /api/chat, when streaming each line is a chatResponse and the last one has Done = true.
+type chatResponse struct {
+	Model           string  `json:"model"`
+	Message         message `json:"message"`
+	Done            bool    `json:"done"`
+	DoneReason      string  `json:"done_reason"`
+	PromptEvalCount int     `json:"prompt_eval_count"`
+	EvalCount       int     `json:"eval_count"`
+	Error           string  `json:"error"`
+}
+
+type embedRequest struct {
+	Model     string   `json:"model"`
+	Input     []string `json:"input"`
+	KeepAlive string   `json:"keep_alive,omitempty"`
+}
+
+type embedResponse struct {
+	Embeddings [][]float32 `json:"embeddings"`
+	Error      string      `json:"error"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// APIError is returned when the server responds with an error.
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("ollama: %s", e.Message)
+	}
+	return fmt.Sprintf("ollama: status %d: %s", e.StatusCode, e.Message)
+}
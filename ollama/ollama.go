@@ -0,0 +1,337 @@
+package ollama
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cast"
+	"github.com/zbysir/writeflow/pkg/export"
+	"github.com/zbysir/writeflow_plugin_llm/util"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const DefaultBaseURL = "http://localhost:11434"
+
+// DefaultNumCtx 是没有设置 num_ctx 时 Ollama 服务端使用的上下文长度
+const DefaultNumCtx = 2048
+
+// NewOllamaCmd 实现 new_ollama，输出 util.LLM
+func NewOllamaCmd() export.CMDer {
+	return util.NewFun(func(ctx context.Context, params map[string]interface{}) (rsp map[string]interface{}, err error) {
+		config := Config{
+			BaseURL:   cast.ToString(params["base_url"]),
+			Model:     cast.ToString(params["model"]),
+			KeepAlive: cast.ToString(params["keep_alive"]),
+		}
+		if config.Model == "" {
+			return nil, fmt.Errorf("model is required")
+		}
+		if v := cast.ToString(params["num_ctx"]); v != "" {
+			config.NumCtx, err = cast.ToIntE(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid num_ctx: %w", err)
+			}
+		}
+		if v := cast.ToString(params["temperature"]); v != "" {
+			t, err := cast.ToFloat32E(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid temperature: %w", err)
+			}
+			config.Temperature = &t
+		}
+
+		return map[string]interface{}{"default": NewLLM(config)}, nil
+	})
+}
+
+type Config struct {
+	BaseURL string
+	// Model is the name of local model, e.g. llama3
+	Model string
+	// KeepAlive controls how long the model will stay loaded into memory, e.g. 5m
+	KeepAlive string
+	// NumCtx is the size of the context window, 0 means the default of the server
+	NumCtx int
+	// Temperature overrides the temperature of langchain_call if not nil
+	Temperature *float32
+	HTTPClient  *http.Client
+}
+
+// LLM implement util.LLM by Ollama API
+// See https://github.com/ollama/ollama/blob/main/docs/api.md
+type LLM struct {
+	config Config
+}
+
+func NewLLM(config Config) *LLM {
+	if config.BaseURL == "" {
+		config.BaseURL = DefaultBaseURL
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+	return &LLM{config: config}
+}
+
+var _ util.LLM = (*LLM)(nil)
+
+func (l *LLM) ChatCompletion(ctx context.Context, req util.ChatRequest) (util.ChatResponse, error) {
+	httpRsp, err := l.do(ctx, "/api/chat", l.buildRequest(req, false))
+	if err != nil {
+		return util.ChatResponse{}, err
+	}
+	defer httpRsp.Body.Close()
+
+	var rsp chatResponse
+	err = json.NewDecoder(httpRsp.Body).Decode(&rsp)
+	if err != nil {
+		return util.ChatResponse{}, fmt.Errorf("decode response error: %w", err)
+	}
+	if rsp.Error != "" {
+		return util.ChatResponse{}, &APIError{Message: rsp.Error}
+	}
+
+	return util.ChatResponse{
+		Message:      coverMessageToBase(rsp.Message),
+		FinishReason: coverDoneReason(rsp),
+		Usage:        coverUsage(rsp),
+	}, nil
+}
+
+func (l *LLM) ChatCompletionStream(ctx context.Context, req util.ChatRequest) (*util.StreamResponse, error) {
+	httpRsp, err := l.do(ctx, "/api/chat", l.buildRequest(req, true))
+	if err != nil {
+		return nil, err
+	}
+
+	steam := util.NewSteamResponse()
+	go func() {
+		defer httpRsp.Body.Close()
+		steam.Close(readStream(httpRsp.Body, steam))
+	}()
+
+	return steam, nil
+}
+
+// readStream 读取换行分隔的 JSON 并写入 steam，返回 nil 表示正常结束
+func readStream(body io.Reader, steam *util.StreamResponse) error {
+	dec := json.NewDecoder(body)
+	for {
+		var chunk chatResponse
+		err := dec.Decode(&chunk)
+		if err != nil {
+			if err == io.EOF {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if chunk.Error != "" {
+			return &APIError{Message: chunk.Error}
+		}
+
+		if chunk.Message.Content != "" {
+			steam.Append(chunk.Message.Content)
+		}
+		// Ollama 不会把 tool_calls 拆分为增量，而是在一个 chunk 中完整返回
+		if len(chunk.Message.ToolCalls) != 0 {
+			m := coverMessageToBase(chunk.Message)
+			steam.AppendEvent(util.StreamEvent{Type: util.StreamEventFunctionCall, FunctionCall: m.FunctionCall})
+		}
+		if chunk.Done {
+			usage := coverUsage(chunk)
+			steam.AppendEvent(util.StreamEvent{Type: util.StreamEventUsage, Usage: &usage})
+			steam.AppendEvent(util.StreamEvent{Type: util.StreamEventFinish, FinishReason: coverDoneReason(chunk)})
+			return nil
+		}
+	}
+}
+
+func (l *LLM) Embedding(ctx context.Context, req util.EmbeddingRequest) ([][]float32, error) {
+	model := req.Model
+	if model == "" {
+		model = l.config.Model
+	}
+
+	httpRsp, err := l.do(ctx, "/api/embed", embedRequest{
+		Model:     model,
+		Input:     req.Input,
+		KeepAlive: l.config.KeepAlive,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer httpRsp.Body.Close()
+
+	var rsp embedResponse
+	err = json.NewDecoder(httpRsp.Body).Decode(&rsp)
+	if err != nil {
+		return nil, fmt.Errorf("decode response error: %w", err)
+	}
+	if rsp.Error != "" {
+		return nil, &APIError{Message: rsp.Error}
+	}
+
+	return rsp.Embeddings, nil
+}
+
+func (l *LLM) Capabilities() util.Capabilities {
+	return util.Capabilities{
+		Stream:    true,
+		Functions: true,
+		Embedding: true,
+	}
+}
+
+// ContextWindow 返回 num_ctx，超出的部分会被 Ollama 截断，所以历史需要按它截取
+func (l *LLM) ContextWindow() int {
+	if l.config.NumCtx != 0 {
+		return l.config.NumCtx
+	}
+	return DefaultNumCtx
+}
+
+func (l *LLM) do(ctx context.Context, path string, body interface{}) (*http.Response, error) {
+	bs, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(l.config.BaseURL, "/")+path, bytes.NewReader(bs))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	httpRsp, err := l.config.HTTPClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	if httpRsp.StatusCode >= 400 {
+		defer httpRsp.Body.Close()
+		bs, _ := io.ReadAll(httpRsp.Body)
+		var e errorResponse
+		if json.Unmarshal(bs, &e) != nil || e.Error == "" {
+			e.Error = string(bs)
+		}
+		return nil, &APIError{StatusCode: httpRsp.StatusCode, Message: e.Error}
+	}
+
+	return httpRsp, nil
+}
+
+func (l *LLM) buildRequest(req util.ChatRequest, stream bool) *chatRequest {
+	model := req.Model
+	if l.config.Model != "" {
+		model = l.config.Model
+	}
+
+	options := map[string]interface{}{}
+	if l.config.NumCtx != 0 {
+		options["num_ctx"] = l.config.NumCtx
+	}
+	if l.config.Temperature != nil {
+		options["temperature"] = *l.config.Temperature
+	} else {
+		options["temperature"] = req.Temperature
+	}
+	if req.MaxTokens != 0 {
+		options["num_predict"] = req.MaxTokens
+	}
+	// 模型自带的 top_p 默认值不是 1，只有在修改过默认值时才发送
+	if req.TopP != 0 && req.TopP != util.DefaultTopP {
+		options["top_p"] = req.TopP
+	}
+	if len(req.Stop) != 0 {
+		options["stop"] = req.Stop
+	}
+	if req.PresencePenalty != 0 {
+		options["presence_penalty"] = req.PresencePenalty
+	}
+	if req.FrequencyPenalty != 0 {
+		options["frequency_penalty"] = req.FrequencyPenalty
+	}
+
+	body := &chatRequest{
+		Model:     model,
+		Messages:  coverMessageListToSDK(req.Messages),
+		Stream:    stream,
+		KeepAlive: l.config.KeepAlive,
+		Options:   options,
+	}
+	for _, f := range req.Functions {
+		body.Tools = append(body.Tools, tool{
+			Type: "function",
+			Function: toolFunction{
+				Name:        f.Name,
+				Description: f.Description,
+				Parameters:  f.Parameters,
+			},
+		})
+	}
+
+	return body
+}
+
+func coverMessageToSDK(a util.Message) message {
+	b := message{
+		Role:    a.Role,
+		Content: a.Content,
+	}
+	if a.Role == util.RoleFunction {
+		b.Role = "tool"
+		b.ToolName = a.Name
+	}
+	if a.FunctionCall != nil {
+		args := json.RawMessage(a.FunctionCall.Arguments)
+		if !json.Valid(args) {
+			args = json.RawMessage("{}")
+		}
+		b.ToolCalls = []toolCall{{Function: toolCallFunction{Name: a.FunctionCall.Name, Arguments: args}}}
+	}
+	return b
+}
+
+func coverMessageListToSDK(as []util.Message) []message {
+	var bs []message
+	for _, a := range as {
+		bs = append(bs, coverMessageToSDK(a))
+	}
+	return bs
+}
+
+func coverMessageToBase(a message) util.Message {
+	m := util.Message{
+		Role:    a.Role,
+		Content: a.Content,
+	}
+	// util.Message 只能表示一个 function_call，只保留第一个
+	if len(a.ToolCalls) != 0 {
+		m.FunctionCall = &util.FunctionCall{
+			Name:      a.ToolCalls[0].Function.Name,
+			Arguments: string(a.ToolCalls[0].Function.Arguments),
+		}
+	}
+	return m
+}
+
+// coverDoneReason 将 done_reason 转换为 OpenAI 的 finish_reason
+func coverDoneReason(rsp chatResponse) string {
+	if len(rsp.Message.ToolCalls) != 0 {
+		return "function_call"
+	}
+	if rsp.DoneReason == "" {
+		return "stop"
+	}
+	return rsp.DoneReason
+}
+
+func coverUsage(rsp chatResponse) util.Usage {
+	return util.Usage{
+		PromptTokens:     rsp.PromptEvalCount,
+		CompletionTokens: rsp.EvalCount,
+		TotalTokens:      rsp.PromptEvalCount + rsp.EvalCount,
+	}
+}
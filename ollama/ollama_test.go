@@ -0,0 +1,154 @@
+package ollama
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/zbysir/writeflow_plugin_llm/util"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestChatCompletion(t *testing.T) {
+	var got chatRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/chat" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.WriteString(w, `{
+			"model": "llama3",
+			"message": {"role": "assistant", "content": "", "tool_calls": [{"function": {"name": "get_weather", "arguments": {"city": "Paris"}}}]},
+			"done": true,
+			"done_reason": "stop",
+			"prompt_eval_count": 10,
+			"eval_count": 5
+		}`)
+	}))
+	defer srv.Close()
+
+	temperature := float32(0.2)
+	l := NewLLM(Config{BaseURL: srv.URL, Model: "llama3", KeepAlive: "10m", NumCtx: 8192, Temperature: &temperature})
+	rsp, err := l.ChatCompletion(context.Background(), util.ChatRequest{
+		ChatOptions: util.DefaultChatOptions(),
+		Messages: util.Messages{
+			{Role: util.RoleUser, Content: "Weather in London?"},
+			{Role: util.RoleAssistant, FunctionCall: &util.FunctionCall{Name: "get_weather", Arguments: `{"city":"London"}`}},
+			{Role: util.RoleFunction, Name: "get_weather", Content: `{"temp":20}`},
+		},
+		Functions: []util.FunctionDefine{
+			{Name: "get_weather", Parameters: json.RawMessage(`{"type":"object"}`)},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Model != "llama3" || got.KeepAlive != "10m" || got.Stream {
+		t.Errorf("unexpected request %+v", got)
+	}
+	if got.Options["num_ctx"] != float64(8192) || got.Options["temperature"] != 0.2 || got.Options["num_predict"] != float64(util.DefaultMaxTokens) {
+		t.Errorf("unexpected options %+v", got.Options)
+	}
+	if util.LLMContextWindow(l, "gpt-4o") != 8192 || util.LLMContextWindow(NewLLM(Config{}), "gpt-4o") != DefaultNumCtx {
+		t.Errorf("context window should follow num_ctx")
+	}
+	if _, ok := got.Options["top_p"]; ok {
+		t.Errorf("default top_p should not be sent")
+	}
+	if len(got.Tools) != 1 || got.Tools[0].Type != "function" || got.Tools[0].Function.Name != "get_weather" {
+		t.Errorf("unexpected tools %+v", got.Tools)
+	}
+	if len(got.Messages) != 3 ||
+		len(got.Messages[1].ToolCalls) != 1 || string(got.Messages[1].ToolCalls[0].Function.Arguments) != `{"city":"London"}` ||
+		got.Messages[2].Role != "tool" || got.Messages[2].ToolName != "get_weather" {
+		t.Errorf("unexpected messages %+v", got.Messages)
+	}
+
+	if rsp.Message.FunctionCall == nil || rsp.Message.FunctionCall.Name != "get_weather" || rsp.Message.FunctionCall.Arguments != `{"city": "Paris"}` {
+		t.Errorf("unexpected function_call %+v", rsp.Message.FunctionCall)
+	}
+	if rsp.FinishReason != "function_call" || rsp.Usage.TotalTokens != 15 {
+		t.Errorf("unexpected response %+v", rsp)
+	}
+}
+
+func TestChatCompletionStream(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body chatRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if !body.Stream {
+			t.Errorf("stream should be true")
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		for _, c := range []string{"Hello", ", ", "John"} {
+			_, _ = io.WriteString(w, `{"model":"llama3","message":{"role":"assistant","content":"`+c+`"},"done":false}`+"\n")
+			w.(http.Flusher).Flush()
+		}
+		_, _ = io.WriteString(w, `{"model":"llama3","message":{"role":"assistant","content":""},"done":true,"done_reason":"stop"}`+"\n")
+	}))
+	defer srv.Close()
+
+	l := NewLLM(Config{BaseURL: srv.URL, Model: "llama3"})
+	s, err := l.ChatCompletionStream(context.Background(), util.ChatRequest{
+		ChatOptions: util.DefaultChatOptions(),
+		Messages:    util.Messages{{Role: util.RoleUser, Content: "Hi"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := s.NewReader().ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(data, "") != "Hello, John" {
+		t.Errorf("unexpected content %q", data)
+	}
+}
+
+func TestChatCompletionError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = io.WriteString(w, `{"error":"model \"llama9\" not found, try pulling it first"}`)
+	}))
+	defer srv.Close()
+
+	l := NewLLM(Config{BaseURL: srv.URL, Model: "llama9"})
+	_, err := l.ChatCompletionStream(context.Background(), util.ChatRequest{ChatOptions: util.DefaultChatOptions()})
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestEmbedding(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/embed" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		var body embedRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Model != "llama3" || len(body.Input) != 2 {
+			t.Errorf("unexpected request %+v", body)
+		}
+		_, _ = io.WriteString(w, `{"embeddings":[[0.1,0.2],[0.3,0.4]]}`)
+	}))
+	defer srv.Close()
+
+	l := NewLLM(Config{BaseURL: srv.URL, Model: "llama3"})
+	vectors, err := l.Embedding(context.Background(), util.EmbeddingRequest{Input: []string{"a", "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vectors) != 2 || vectors[1][1] != 0.4 {
+		t.Errorf("unexpected embeddings %v", vectors)
+	}
+}
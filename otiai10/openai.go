@@ -8,6 +8,8 @@ import (
 	"github.com/spf13/cast"
 	"github.com/zbysir/writeflow/pkg/export"
 	"github.com/zbysir/writeflow_plugin_llm/util"
+	"io"
+	"net/http"
 )
 
 // Plugin implement PluginLLM
@@ -19,123 +21,220 @@ func (p *Plugin) NewOpenAICmd() export.CMDer {
 	return util.NewFun(func(ctx context.Context, params map[string]interface{}) (rsp map[string]interface{}, err error) {
 		key := params["api_key"].(string)
 		baseUrl := cast.ToString(params["base_url"])
+		if apiType := cast.ToString(params["api_type"]); apiType != "" && apiType != "openai" {
+			return nil, fmt.Errorf("api_type %s is not supported by otiai10/openaigo", apiType)
+		}
 		client := openaigo.NewClient(key)
 		if baseUrl != "" {
 			client.BaseURL = baseUrl
 		}
-		return map[string]interface{}{"default": client}, nil
+		return map[string]interface{}{"default": NewLLM(client)}, nil
 	})
 }
 
-func (p *Plugin) CallOpenAICmd() export.CMDer {
-	return util.NewFun(func(ctx context.Context, params map[string]interface{}) (rsp map[string]interface{}, err error) {
-		//log.Infof("langchain_call")
-		openaiClient := params["llm"].(*openaigo.Client)
-		promptI := params["prompt"]
-		functionI := params["functions"]
-		if promptI == nil {
-			return nil, fmt.Errorf("prompt is nil")
-		}
-		enableSteam := cast.ToBool(params["stream"])
-		prompt := promptI.(string)
-		var functions json.Marshaler = nil
-		if functionI != nil {
-			function := functionI.(string)
-			functions = json.RawMessage(function)
-		}
+func (p *Plugin) SupportStream() bool {
+	return true
+}
 
-		var messages []openaigo.Message
-		var chatMemory util.ChatMemory
-		if params["chat_memory"] != nil {
-			chatMemory = params["chat_memory"].(util.ChatMemory)
-		}
+// LLM implement util.LLM
+type LLM struct {
+	client *openaigo.Client
+}
 
-		if chatMemory != nil {
-			messages = append(messages, coverMessageListToSDK(chatMemory.GetHistory(ctx))...)
-		}
+func NewLLM(client *openaigo.Client) *LLM {
+	return &LLM{client: client}
+}
 
-		userMsg := openaigo.Message{Content: prompt, Role: "user"}
-		if chatMemory != nil {
-			chatMemory.AppendHistory(ctx, coverMessageToBase(userMsg))
-		}
-		messages = append(messages, userMsg)
-
-		if enableSteam {
-			steam := util.NewSteamResponse()
-			go func() {
-				content := ""
-				_, _ = openaiClient.ChatCompletion(ctx, openaigo.ChatCompletionRequestBody{
-					Model:            "gpt-3.5-turbo-0613",
-					Messages:         messages,
-					MaxTokens:        2000,
-					Temperature:      0,
-					TopP:             0,
-					N:                0,
-					Stop:             nil,
-					PresencePenalty:  0,
-					FrequencyPenalty: 0,
-					LogitBias:        nil,
-					User:             "",
-					Functions:        functions,
-					FunctionCall:     "",
-					StreamCallback: func(res openaigo.ChatCompletionResponse, done bool, err error) {
-						if err != nil {
-							steam.Close(err)
-							return
-						}
-						if done {
-							steam.Close(nil)
-
-							if chatMemory != nil {
-								if content != "" {
-									chatMemory.AppendHistory(ctx, util.Message{
-										Role:    "assistant",
-										Content: content,
-									})
-								}
-							}
-							return
-						}
-						if len(res.Choices) > 0 && res.Choices[0].Delta.Content != "" {
-							steam.Append(res.Choices[0].Delta.Content)
-							content += res.Choices[0].Delta.Content
-						}
-					},
-				})
-			}()
-
-			return map[string]interface{}{"default": steam, "function_call": ""}, nil
-		} else {
-			res, err := openaiClient.ChatCompletion(ctx, openaigo.ChatCompletionRequestBody{
-				Model:            "gpt-3.5-turbo-0613",
-				Messages:         messages,
-				MaxTokens:        2000,
-				Temperature:      0,
-				TopP:             0,
-				N:                0,
-				Stop:             nil,
-				PresencePenalty:  0,
-				FrequencyPenalty: 0,
-				LogitBias:        nil,
-				User:             "",
-				Functions:        functions,
-				FunctionCall:     "",
-			})
+var _ util.LLM = (*LLM)(nil)
+
+func (l *LLM) ChatCompletion(ctx context.Context, req util.ChatRequest) (util.ChatResponse, error) {
+	functions, err := coverFunctionListToSDK(req.Functions)
+	if err != nil {
+		return util.ChatResponse{}, err
+	}
+
+	res, err := l.client.ChatCompletion(ctx, openaigo.ChatCompletionRequestBody{
+		Model:            util.ChatModel(req.Model),
+		Messages:         coverMessageListToSDK(req.Messages),
+		MaxTokens:        req.MaxTokens,
+		Temperature:      util.KeepZero(req.Temperature),
+		TopP:             util.KeepZero(req.TopP),
+		N:                0,
+		Stop:             req.Stop,
+		PresencePenalty:  req.PresencePenalty,
+		FrequencyPenalty: req.FrequencyPenalty,
+		LogitBias:        req.LogitBias,
+		User:             req.User,
+		Functions:        functions,
+		FunctionCall:     "",
+	})
+	if err != nil {
+		return util.ChatResponse{}, err
+	}
+	if len(res.Choices) == 0 {
+		return util.ChatResponse{}, fmt.Errorf("res.Choices is empty")
+	}
+
+	return util.ChatResponse{
+		Message:      coverMessageToBase(res.Choices[0].Message),
+		FinishReason: res.Choices[0].FinishReason,
+		Usage: util.Usage{
+			PromptTokens:     res.Usage.PromptTokens,
+			CompletionTokens: res.Usage.CompletionTokens,
+			TotalTokens:      res.Usage.TotalTokens,
+		},
+	}, nil
+}
+
+func (l *LLM) ChatCompletionStream(ctx context.Context, req util.ChatRequest) (*util.StreamResponse, error) {
+	functions, err := coverFunctionListToSDK(req.Functions)
+	if err != nil {
+		return nil, err
+	}
+
+	steam := util.NewSteamResponse()
+	// openaigo 只在收到 [DONE] 时回调 done，body 提前结束或者读取出错时不会回调，所以在 body 被关闭时关闭 steam
+	client := *l.client
+	httpClient := http.Client{}
+	if client.HTTPClient != nil {
+		httpClient = *client.HTTPClient
+	}
+	transport := httpClient.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	httpClient.Transport = streamTransport{base: transport, steam: steam}
+	client.HTTPClient = &httpClient
+
+	// ChatCompletion returns as soon as the response header is received, the body is read by StreamCallback in another goroutine.
+	_, err = client.ChatCompletion(ctx, openaigo.ChatCompletionRequestBody{
+		Model:            util.ChatModel(req.Model),
+		Messages:         coverMessageListToSDK(req.Messages),
+		MaxTokens:        req.MaxTokens,
+		Temperature:      util.KeepZero(req.Temperature),
+		TopP:             util.KeepZero(req.TopP),
+		N:                0,
+		Stop:             req.Stop,
+		PresencePenalty:  req.PresencePenalty,
+		FrequencyPenalty: req.FrequencyPenalty,
+		LogitBias:        req.LogitBias,
+		User:             req.User,
+		Functions:        functions,
+		FunctionCall:     "",
+		StreamCallback: func(res openaigo.ChatCompletionResponse, done bool, err error) {
 			if err != nil {
-				return map[string]interface{}{}, err
+				steam.Close(err)
+				return
 			}
-
-			if chatMemory != nil {
-				chatMemory.AppendHistory(ctx, coverMessageToBase(res.Choices[0].Message))
+			if done {
+				steam.Close(nil)
+				return
+			}
+			if len(res.Choices) == 0 {
+				return
+			}
+			c := res.Choices[0]
+			if c.Delta.Content != "" {
+				steam.Append(c.Delta.Content)
+			}
+			if c.Delta.FunctionCall != nil {
+				steam.AppendEvent(util.StreamEvent{
+					Type:         util.StreamEventFunctionCall,
+					FunctionCall: &util.FunctionCall{Name: c.Delta.FunctionCall.Name, Arguments: c.Delta.FunctionCall.ArgumentsRaw},
+				})
 			}
+			if c.FinishReason != "" {
+				steam.AppendEvent(util.StreamEvent{Type: util.StreamEventFinish, FinishReason: c.FinishReason})
+			}
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
 
-			return map[string]interface{}{"default": res.Choices[0].Message.Content, "function_call": res.Choices[0].Message.FunctionCall}, nil
-		}
+	return steam, nil
+}
+
+// streamTransport 让 steam 在响应的 body 被关闭时关闭
+type streamTransport struct {
+	base  http.RoundTripper
+	steam *util.StreamResponse
+}
+
+func (t streamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	res.Body = &streamBody{ReadCloser: res.Body, steam: t.steam}
+	return res, nil
+}
+
+type streamBody struct {
+	io.ReadCloser
+	steam *util.StreamResponse
+	err   error
+}
+
+func (b *streamBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// Close 在 openaigo 读取结束后调用，收到 [DONE] 时 steam 已经被关闭，这里不会有影响
+func (b *streamBody) Close() error {
+	err := b.ReadCloser.Close()
+	if b.err == nil {
+		b.err = io.ErrUnexpectedEOF
+	}
+	b.steam.Close(fmt.Errorf("stream ended without [DONE]: %w", b.err))
+	return err
+}
+
+func (l *LLM) Embedding(ctx context.Context, req util.EmbeddingRequest) ([][]float32, error) {
+	model := req.Model
+	if model == "" {
+		model = util.DefaultEmbeddingModel
+	}
+
+	res, err := l.client.CreateEmbedding(ctx, openaigo.EmbeddingCreateRequestBody{
+		Model: model,
+		Input: req.Input,
+		User:  req.User,
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	vectors := make([][]float32, len(req.Input))
+	for _, d := range res.Data {
+		if d.Index < len(vectors) {
+			vectors[d.Index] = d.Embedding
+		}
+	}
+	return vectors, nil
 }
 
-func (p *Plugin) SupportStream() bool {
-	return true
+func (l *LLM) Capabilities() util.Capabilities {
+	return util.Capabilities{
+		Stream:    true,
+		Functions: true,
+		Embedding: true,
+	}
+}
+
+func coverFunctionListToSDK(as []util.FunctionDefine) (json.Marshaler, error) {
+	if len(as) == 0 {
+		return nil, nil
+	}
+	bs, err := json.Marshal(as)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(bs), nil
 }
 
 func coverMessageToBase(a openaigo.Message) util.Message {
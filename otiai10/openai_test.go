@@ -0,0 +1,99 @@
+package otiai10
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/otiai10/openaigo"
+	"github.com/zbysir/writeflow_plugin_llm/util"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChatCompletion(t *testing.T) {
+	var got map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/chat/completions" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.WriteString(w, `{
+			"choices": [{
+				"index": 0,
+				"message": {"role": "assistant", "content": "", "function_call": {"name": "get_weather", "arguments": "{\"city\":\"Paris\"}"}},
+				"finish_reason": "function_call"
+			}],
+			"usage": {"prompt_tokens": 10, "completion_tokens": 5, "total_tokens": 15}
+		}`)
+	}))
+	defer srv.Close()
+
+	client := openaigo.NewClient("key")
+	client.BaseURL = srv.URL
+	var l util.LLM = NewLLM(client)
+	rsp, err := l.ChatCompletion(context.Background(), util.ChatRequest{
+		ChatOptions: util.DefaultChatOptions(),
+		Messages:    util.Messages{{Role: util.RoleUser, Content: "Weather in Paris?"}},
+		Functions: []util.FunctionDefine{
+			{Name: "get_weather", Parameters: json.RawMessage(`{"type":"object","properties":{"city":{"type":"string"}}}`)},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got["model"] != util.DefaultChatModel {
+		t.Errorf("unexpected model %v", got["model"])
+	}
+	if ms, _ := got["messages"].([]interface{}); len(ms) != 1 {
+		t.Errorf("unexpected messages %v", got["messages"])
+	}
+	if fs, _ := got["functions"].([]interface{}); len(fs) != 1 {
+		t.Errorf("unexpected functions %v", got["functions"])
+	}
+
+	fc := rsp.Message.FunctionCall
+	if fc == nil || fc.Name != "get_weather" || fc.Arguments != `{"city":"Paris"}` {
+		t.Errorf("unexpected function_call %+v", fc)
+	}
+	if rsp.FinishReason != "function_call" || rsp.Usage.TotalTokens != 15 {
+		t.Errorf("unexpected response %+v", rsp)
+	}
+}
+
+func TestChatCompletionStreamWithoutDone(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// body 在 [DONE] 之前结束
+		_, _ = io.WriteString(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"Hi\"}}]}\n\n")
+	}))
+	defer srv.Close()
+
+	client := openaigo.NewClient("key")
+	client.BaseURL = srv.URL
+	steam, err := NewLLM(client).ChatCompletionStream(context.Background(), util.ChatRequest{
+		ChatOptions: util.DefaultChatOptions(),
+		Messages:    util.Messages{{Role: util.RoleUser, Content: "Hi"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		steam.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream should be closed when the body ends")
+	}
+	if _, err = steam.Response(); err == nil || !strings.Contains(err.Error(), "[DONE]") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/spf13/cast"
+	"github.com/zbysir/writeflow/pkg/export"
+	"github.com/zbysir/writeflow_plugin_llm/util"
+)
+
+// promptTemplateParams 是 prompt_template 与 chat_prompt_template 自身的参数，其余的参数都是动态输入的模板变量
+var promptTemplateParams = map[string]bool{
+	"template":  true,
+	"templates": true,
+	"role":      true,
+}
+
+func templateVars(params map[string]interface{}) map[string]interface{} {
+	vars := map[string]interface{}{}
+	for k, v := range params {
+		if !promptTemplateParams[k] {
+			vars[k] = v
+		}
+	}
+	return vars
+}
+
+// promptRole 检查模板的角色，为空时是 user
+func promptRole(role string) (string, error) {
+	switch role {
+	case "":
+		return util.RoleUser, nil
+	case util.RoleSystem, util.RoleUser, util.RoleAssistant:
+		return role, nil
+	}
+	return "", fmt.Errorf("unsupported role: %s", role)
+}
+
+// newPromptTemplateCmd 实现 prompt_template，使用动态输入作为变量渲染 Go text/template
+func newPromptTemplateCmd() export.CMDer {
+	return util.NewFun(func(ctx context.Context, params map[string]interface{}) (rsp map[string]interface{}, err error) {
+		role, err := promptRole(cast.ToString(params["role"]))
+		if err != nil {
+			return nil, err
+		}
+
+		content, err := util.RenderTemplate(cast.ToString(params["template"]), templateVars(params))
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]interface{}{
+			"default":  content,
+			"messages": util.Messages{{Role: role, Content: content}},
+		}, nil
+	})
+}
+
+// newChatPromptTemplateCmd 实现 chat_prompt_template，按顺序渲染多个带角色的模板，输出 util.Messages
+func newChatPromptTemplateCmd() export.CMDer {
+	return util.NewFun(func(ctx context.Context, params map[string]interface{}) (rsp map[string]interface{}, err error) {
+		templates, err := util.ParseMessages(params["templates"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid templates: %w", err)
+		}
+		if len(templates) == 0 {
+			return nil, fmt.Errorf("templates is empty")
+		}
+
+		vars := templateVars(params)
+		messages := make(util.Messages, len(templates))
+		for i, t := range templates {
+			role, err := promptRole(t.Role)
+			if err != nil {
+				return nil, fmt.Errorf("template %d: %w", i, err)
+			}
+			content, err := util.RenderTemplate(t.Content, vars)
+			if err != nil {
+				return nil, fmt.Errorf("template %d: %w", i, err)
+			}
+			messages[i] = util.Message{Role: role, Content: content}
+		}
+
+		return map[string]interface{}{"default": messages}, nil
+	})
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"github.com/zbysir/writeflow_plugin_llm/util"
+	"strings"
+	"testing"
+)
+
+func TestPromptTemplate(t *testing.T) {
+	ctx := context.Background()
+	rsp, err := newPromptTemplateCmd().Exec(ctx, map[string]interface{}{
+		"template": `Translate to {{.lang}}: {{ .words | join ", " }}`,
+		"role":     util.RoleSystem,
+		"lang":     "French",
+		"words":    []interface{}{"cat", "dog"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp["default"] != "Translate to French: cat, dog" {
+		t.Errorf("unexpected prompt %q", rsp["default"])
+	}
+	ms := rsp["messages"].(util.Messages)
+	if len(ms) != 1 || ms[0].Role != util.RoleSystem || ms[0].Content != rsp["default"] {
+		t.Errorf("unexpected messages %+v", ms)
+	}
+
+	_, err = newPromptTemplateCmd().Exec(ctx, map[string]interface{}{
+		"template": `Translate to {{.lang}}`,
+	})
+	if err == nil || !strings.Contains(err.Error(), "lang") {
+		t.Errorf("missing variable should be an error, got %v", err)
+	}
+}
+
+func TestChatPromptTemplate(t *testing.T) {
+	rsp, err := newChatPromptTemplateCmd().Exec(context.Background(), map[string]interface{}{
+		"templates": `[
+			{"role": "system", "content": "You translate to {{.lang}}."},
+			{"role": "user", "content": "cat"},
+			{"role": "assistant", "content": "chat"},
+			{"content": "{{.word}}"}
+		]`,
+		"lang": "French",
+		"word": "dog",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms := rsp["default"].(util.Messages)
+	expect := util.Messages{
+		{Role: util.RoleSystem, Content: "You translate to French."},
+		{Role: util.RoleUser, Content: "cat"},
+		{Role: util.RoleAssistant, Content: "chat"},
+		{Role: util.RoleUser, Content: "dog"},
+	}
+	if len(ms) != len(expect) {
+		t.Fatalf("unexpected messages %+v", ms)
+	}
+	for i := range expect {
+		if ms[i] != expect[i] {
+			t.Errorf("message %d: expect %+v, got %+v", i, expect[i], ms[i])
+		}
+	}
+}
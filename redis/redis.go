@@ -0,0 +1,225 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/zbysir/writeflow_plugin_llm/util"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultKeyPrefix = "writeflow:chat_memory:"
+
+type Config struct {
+	// Addr is host:port of the server, e.g. localhost:6379
+	Addr     string
+	Username string
+	Password string
+	DB       int
+	// KeyPrefix is prepended to the session id to build the key of the list
+	KeyPrefix string
+	// TTL is refreshed on every append, 0 means the history never expires
+	TTL time.Duration
+}
+
+// Store 将每个 session 保存为一个 Redis list，每个元素是一条 JSON 格式的消息
+type Store struct {
+	config Config
+	client *client
+}
+
+var _ util.SessionStore = (*Store)(nil)
+
+// stores 缓存已经创建的 Store 以复用连接，chat_memory 每次运行都会调用 Open
+var stores = struct {
+	lock sync.Mutex
+	m    map[Config]*Store
+}{m: map[Config]*Store{}}
+
+// Open 返回 config 对应的 Store，相同的 config 会返回同一个 Store
+func Open(config Config) (*Store, error) {
+	if config.Addr == "" {
+		return nil, fmt.Errorf("addr is required")
+	}
+	if config.KeyPrefix == "" {
+		config.KeyPrefix = DefaultKeyPrefix
+	}
+
+	stores.lock.Lock()
+	defer stores.lock.Unlock()
+
+	if s, ok := stores.m[config]; ok {
+		return s, nil
+	}
+	s := &Store{config: config, client: newClient(config)}
+	stores.m[config] = s
+	return s, nil
+}
+
+func (s *Store) key(sessionId string) string {
+	return s.config.KeyPrefix + sessionId
+}
+
+func (s *Store) Load(ctx context.Context, sessionId string) (util.Messages, error) {
+	replies, err := s.client.Do(ctx, []string{"LRANGE", s.key(sessionId), "0", "-1"})
+	if err != nil {
+		return nil, err
+	}
+	items, _ := replies[0].([]interface{})
+
+	var ms util.Messages
+	for _, item := range items {
+		bs, ok := item.([]byte)
+		if !ok {
+			return nil, fmt.Errorf("unexpected LRANGE item %T", item)
+		}
+		var m util.Message
+		err = json.Unmarshal(bs, &m)
+		if err != nil {
+			return nil, fmt.Errorf("decode message error: %w", err)
+		}
+		ms = append(ms, m)
+	}
+	return ms, nil
+}
+
+func (s *Store) Append(ctx context.Context, sessionId string, messages ...util.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	cmds, err := s.pushCmds(sessionId, messages)
+	if err != nil {
+		return err
+	}
+	return s.exec(ctx, cmds...)
+}
+
+// pushCmds 返回追加消息并刷新 TTL 的命令
+func (s *Store) pushCmds(sessionId string, messages util.Messages) ([][]string, error) {
+	key := s.key(sessionId)
+	rpush := []string{"RPUSH", key}
+	for _, m := range messages {
+		bs, err := json.Marshal(m)
+		if err != nil {
+			return nil, err
+		}
+		rpush = append(rpush, string(bs))
+	}
+	cmds := [][]string{rpush}
+	if s.config.TTL > 0 {
+		cmds = append(cmds, []string{"PEXPIRE", key, strconv.FormatInt(s.config.TTL.Milliseconds(), 10)})
+	}
+	return cmds, nil
+}
+
+// exec 在 MULTI / EXEC 中执行 cmds
+func (s *Store) exec(ctx context.Context, cmds ...[]string) error {
+	cmds = append(append([][]string{{"MULTI"}}, cmds...), []string{"EXEC"})
+	replies, err := s.client.Do(ctx, cmds...)
+	if err != nil {
+		return err
+	}
+	results, _ := replies[len(replies)-1].([]interface{})
+	for _, r := range results {
+		if e, ok := r.(Error); ok {
+			return e
+		}
+	}
+	return nil
+}
+
+// ListSessions 使用 SCAN 遍历 KeyPrefix 下的 key，不会阻塞 Redis
+func (s *Store) ListSessions(ctx context.Context) ([]string, error) {
+	match := globEscape(s.config.KeyPrefix) + "*"
+	var ids []string
+	cursor := "0"
+	for {
+		replies, err := s.client.Do(ctx, []string{"SCAN", cursor, "MATCH", match, "COUNT", "100"})
+		if err != nil {
+			return nil, err
+		}
+		r, _ := replies[0].([]interface{})
+		if len(r) != 2 {
+			return nil, fmt.Errorf("unexpected SCAN reply %v", replies[0])
+		}
+		next, _ := r[0].([]byte)
+		keys, _ := r[1].([]interface{})
+		for _, k := range keys {
+			if bs, ok := k.([]byte); ok {
+				ids = append(ids, strings.TrimPrefix(string(bs), s.config.KeyPrefix))
+			}
+		}
+		cursor = string(next)
+		if cursor == "0" || cursor == "" {
+			break
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (s *Store) Delete(ctx context.Context, sessionId string) error {
+	_, err := s.client.Do(ctx, []string{"DEL", s.key(sessionId)})
+	return err
+}
+
+func (s *Store) Replace(ctx context.Context, sessionId string, messages util.Messages) error {
+	cmds := [][]string{{"DEL", s.key(sessionId)}}
+	if len(messages) != 0 {
+		push, err := s.pushCmds(sessionId, messages)
+		if err != nil {
+			return err
+		}
+		cmds = append(cmds, push...)
+	}
+	return s.exec(ctx, cmds...)
+}
+
+// compareAndReplaceScript 在 list 的长度为 ARGV[1] 时替换 list 并设置 TTL（ARGV[2] 毫秒，0 表示不过期），ARGV[3:] 是新的消息
+const compareAndReplaceScript = `
+if redis.call('LLEN', KEYS[1]) ~= tonumber(ARGV[1]) then
+	return 0
+end
+redis.call('DEL', KEYS[1])
+for i = 3, #ARGV do
+	redis.call('RPUSH', KEYS[1], ARGV[i])
+end
+if #ARGV > 2 and tonumber(ARGV[2]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 1`
+
+// CompareAndReplace 使用 Lua 脚本，比较与替换在 Redis 中原子地执行
+func (s *Store) CompareAndReplace(ctx context.Context, sessionId string, n int, messages util.Messages) (bool, error) {
+	cmd := []string{"EVAL", compareAndReplaceScript, "1", s.key(sessionId), strconv.Itoa(n), strconv.FormatInt(s.config.TTL.Milliseconds(), 10)}
+	for _, m := range messages {
+		bs, err := json.Marshal(m)
+		if err != nil {
+			return false, err
+		}
+		cmd = append(cmd, string(bs))
+	}
+	replies, err := s.client.Do(ctx, cmd)
+	if err != nil {
+		return false, err
+	}
+	return replies[0] == int64(1), nil
+}
+
+// globEscape 转义 SCAN MATCH 中的特殊字符
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,16 @@
+module github.com/zbysir/writeflow_plugin_llm/redis/redistest
+
+go 1.20
+
+replace github.com/zbysir/writeflow_plugin_llm => ../..
+
+require (
+	github.com/alicebob/miniredis/v2 v2.39.0
+	github.com/zbysir/writeflow_plugin_llm v0.0.0-00010101000000-000000000000
+)
+
+require (
+	github.com/spf13/cast v1.5.0 // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
+	github.com/zbysir/writeflow v0.0.0-20230627091418-5f4fa7ba9eed // indirect
+)
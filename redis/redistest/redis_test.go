@@ -0,0 +1,224 @@
+// Package redistest 是单独的 module，只在测试中引入 miniredis，这样插件本身不需要 vendor 它
+package redistest
+
+import (
+	"context"
+	"fmt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/zbysir/writeflow_plugin_llm/redis"
+	"github.com/zbysir/writeflow_plugin_llm/util"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	mr.RequireAuth("secret")
+
+	s, err := redis.Open(redis.Config{Addr: mr.Addr(), Password: "secret", KeyPrefix: "test:", TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := util.NewStoreChatMemory(s, "a", 0)
+	for _, msg := range []util.Message{
+		{Role: util.RoleUser, Content: "Weather?"},
+		{Role: util.RoleAssistant, FunctionCall: &util.FunctionCall{Name: "get_weather", Arguments: `{"city":"Paris"}`}},
+		{Role: util.RoleFunction, Name: "get_weather", Content: "line1\r\nline2"},
+	} {
+		if err := m.AppendHistory(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h, err := m.GetHistory(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h) != 3 || h[1].FunctionCall == nil || h[1].FunctionCall.Name != "get_weather" || h[2].Content != "line1\r\nline2" {
+		t.Fatalf("unexpected history %+v", h)
+	}
+
+	if ttl := mr.TTL("test:a"); ttl != time.Hour {
+		t.Errorf("unexpected ttl %v", ttl)
+	}
+	mr.FastForward(2 * time.Hour)
+	if h, err = m.GetHistory(ctx); err != nil || len(h) != 0 {
+		t.Errorf("history should be expired, got %+v %v", h, err)
+	}
+}
+
+func TestStoreError(t *testing.T) {
+	mr := miniredis.RunT(t)
+	mr.RequireAuth("secret")
+
+	s, err := redis.Open(redis.Config{Addr: mr.Addr(), Password: "wrong"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Load(context.Background(), "a")
+	if _, ok := err.(redis.Error); !ok {
+		t.Fatalf("expect auth error, got %v", err)
+	}
+}
+
+func TestStoreConcurrent(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+
+	s, err := redis.Open(redis.Config{Addr: mr.Addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				sessionId := fmt.Sprintf("s%d", i%4)
+				if err := s.Append(ctx, sessionId, util.Message{Role: util.RoleUser, Content: fmt.Sprint(j)}); err != nil {
+					t.Error(err)
+				}
+				if _, err := s.Load(ctx, sessionId); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < 4; i++ {
+		h, err := s.Load(ctx, fmt.Sprintf("s%d", i))
+		if err != nil || len(h) != 50 {
+			t.Fatalf("s%d: unexpected history len %d %v", i, len(h), err)
+		}
+	}
+}
+
+func TestStoreSessions(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	// 其他 key 与 prefix 中的特殊字符不影响 ListSessions
+	_ = mr.Set("other", "x")
+
+	s, err := redis.Open(redis.Config{Addr: mr.Addr(), KeyPrefix: "chat[1]:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 150; i++ {
+		_ = s.Append(ctx, fmt.Sprintf("s%03d", i), util.Message{Role: util.RoleUser, Content: "x"})
+	}
+
+	ids, err := s.ListSessions(ctx)
+	if err != nil || len(ids) != 150 || ids[0] != "s000" {
+		t.Fatalf("unexpected sessions %d %v", len(ids), err)
+	}
+
+	err = s.Replace(ctx, "s000", util.Messages{{Role: util.RoleSystem, Content: "a"}, {Role: util.RoleUser, Content: "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h, _ := s.Load(ctx, "s000"); len(h) != 2 || h[0].Content != "a" {
+		t.Fatalf("unexpected replaced history %+v", h)
+	}
+
+	if err = s.Delete(ctx, "s000"); err != nil {
+		t.Fatal(err)
+	}
+	if ids, _ = s.ListSessions(ctx); len(ids) != 149 {
+		t.Fatalf("unexpected sessions after delete %d", len(ids))
+	}
+}
+
+func TestStoreReconnect(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+
+	s, err := redis.Open(redis.Config{Addr: mr.Addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Append(ctx, "a", util.Message{Role: util.RoleUser, Content: "Hi"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 服务端重启后连接池中的连接已经被关闭，使用新连接重试
+	mr.Close()
+	if err = mr.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Append(ctx, "a", util.Message{Role: util.RoleUser, Content: "Hi"}); err != nil {
+		t.Fatal(err)
+	}
+	if h, err := s.Load(ctx, "a"); err != nil || len(h) != 2 {
+		t.Fatalf("unexpected history %+v %v", h, err)
+	}
+}
+
+func TestStoreCancel(t *testing.T) {
+	// 接受连接但从不回复的服务端
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	s, err := redis.Open(redis.Config{Addr: l.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err = s.Load(ctx, "a")
+	if err != context.Canceled || time.Since(start) > 5*time.Second {
+		t.Fatalf("unexpected error %v after %v", err, time.Since(start))
+	}
+}
+
+func TestStoreCompareAndReplace(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+
+	s, err := redis.Open(redis.Config{Addr: mr.Addr(), TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = s.Append(ctx, "a", util.Message{Role: util.RoleUser, Content: "1"}, util.Message{Role: util.RoleAssistant, Content: "2"})
+
+	ok, err := s.CompareAndReplace(ctx, "a", 1, util.Messages{{Role: util.RoleUser, Content: "x"}})
+	if err != nil || ok {
+		t.Fatalf("history with another length should not be replaced: %v %v", ok, err)
+	}
+	ok, err = s.CompareAndReplace(ctx, "a", 2, util.Messages{{Role: util.RoleUser, Content: "x"}})
+	if err != nil || !ok {
+		t.Fatalf("unexpected result %v %v", ok, err)
+	}
+	if h, _ := s.Load(ctx, "a"); len(h) != 1 || h[0].Content != "x" {
+		t.Fatalf("unexpected history %+v", h)
+	}
+	if ttl := mr.TTL(redis.DefaultKeyPrefix + "a"); ttl != time.Hour {
+		t.Errorf("unexpected ttl %v", ttl)
+	}
+
+	// 替换为空的历史删除 session
+	ok, err = s.CompareAndReplace(ctx, "a", 1, nil)
+	if err != nil || !ok || mr.Exists(redis.DefaultKeyPrefix+"a") {
+		t.Fatalf("unexpected result %v %v", ok, err)
+	}
+}
@@ -0,0 +1,249 @@
+package redis
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Error 是 Redis 返回的错误回复
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+// client 是一个只实现了 RESP2 的最小 Redis 客户端。
+// 不使用 go-redis 是因为它依赖泛型等特性，在 yaegi 中无法运行。
+type client struct {
+	config Config
+
+	lock sync.Mutex
+	idle []*conn
+}
+
+const maxIdleConns = 8
+
+type conn struct {
+	c net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func newClient(config Config) *client {
+	return &client{config: config}
+}
+
+// get 优先返回空闲的连接，pooled 表示连接来自连接池，可能已经被服务端关闭
+func (c *client) get(ctx context.Context) (cn *conn, pooled bool, err error) {
+	c.lock.Lock()
+	if n := len(c.idle); n != 0 {
+		cn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.lock.Unlock()
+		return cn, true, nil
+	}
+	c.lock.Unlock()
+
+	cn, err = c.dial(ctx)
+	return cn, false, err
+}
+
+func (c *client) dial(ctx context.Context) (*conn, error) {
+	d := net.Dialer{Timeout: 5 * time.Second}
+	nc, err := d.DialContext(ctx, "tcp", c.config.Addr)
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{c: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+
+	var init [][]string
+	if c.config.Password != "" {
+		if c.config.Username != "" {
+			init = append(init, []string{"AUTH", c.config.Username, c.config.Password})
+		} else {
+			init = append(init, []string{"AUTH", c.config.Password})
+		}
+	}
+	if c.config.DB != 0 {
+		init = append(init, []string{"SELECT", strconv.Itoa(c.config.DB)})
+	}
+	if len(init) != 0 {
+		_, err = cn.do(ctx, init...)
+		if err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	return cn, nil
+}
+
+func (c *client) put(cn *conn) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.idle) >= maxIdleConns {
+		cn.c.Close()
+		return
+	}
+	c.idle = append(c.idle, cn)
+}
+
+// Do 在同一个连接上依次发送多个命令（pipeline），返回每个命令的回复。
+// 任何一个命令返回错误时返回第一个错误。
+func (c *client) Do(ctx context.Context, cmds ...[]string) ([]interface{}, error) {
+	cn, pooled, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	replies, err := cn.do(ctx, cmds...)
+	// 空闲的连接可能已经被服务端关闭（如 timeout 配置或者服务端重启），在新连接上重试一次
+	if err != nil && pooled && isStale(err) && ctx.Err() == nil {
+		cn.c.Close()
+		cn, err = c.dial(ctx)
+		if err != nil {
+			return nil, err
+		}
+		replies, err = cn.do(ctx, cmds...)
+	}
+	if err != nil {
+		// 读写出错后连接的状态未知，不再复用；Redis 返回的错误不影响连接
+		if _, ok := err.(Error); !ok {
+			cn.c.Close()
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+	}
+	c.put(cn)
+	return replies, err
+}
+
+// isStale 判断错误是否说明连接在发送命令前已经被关闭，这时命令没有被执行，可以重试
+func isStale(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET)
+}
+
+func (cn *conn) do(ctx context.Context, cmds ...[]string) ([]interface{}, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = cn.c.SetDeadline(deadline)
+	} else {
+		_ = cn.c.SetDeadline(time.Time{})
+	}
+
+	// ctx 没有 deadline 时也需要在取消时打断阻塞的读写，返回前等待 goroutine 退出，避免它修改被复用的连接
+	if done := ctx.Done(); done != nil {
+		stop := make(chan struct{})
+		exited := make(chan struct{})
+		go func() {
+			defer close(exited)
+			select {
+			case <-done:
+				_ = cn.c.SetDeadline(time.Unix(1, 0))
+			case <-stop:
+			}
+		}()
+		defer func() {
+			close(stop)
+			<-exited
+		}()
+	}
+
+	for _, args := range cmds {
+		fmt.Fprintf(cn.w, "*%d\r\n", len(args))
+		for _, a := range args {
+			fmt.Fprintf(cn.w, "$%d\r\n%s\r\n", len(a), a)
+		}
+	}
+	err := cn.w.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	// 需要读完全部回复才能复用连接
+	replies := make([]interface{}, len(cmds))
+	var firstErr error
+	for i := range cmds {
+		replies[i], err = readReply(cn.r)
+		if err != nil {
+			if e, ok := err.(Error); ok {
+				if firstErr == nil {
+					firstErr = e
+				}
+				continue
+			}
+			if i != 0 {
+				// 已经读到回复说明命令被执行了，不能重试，所以不保留原始错误
+				return nil, fmt.Errorf("read reply %d error: %v", i, err)
+			}
+			return nil, err
+		}
+	}
+	return replies, firstErr
+}
+
+// readReply 读取一个回复，返回 string / int64 / []byte / []interface{} 或者 nil
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("invalid reply %q", line)
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, Error(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		bs := make([]byte, n+2)
+		_, err = io.ReadFull(r, bs)
+		if err != nil {
+			return nil, err
+		}
+		return bs[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		// 数组中的错误（如 EXEC 中某个命令失败）作为元素返回
+		items := make([]interface{}, n)
+		for i := range items {
+			items[i], err = readReply(r)
+			if err != nil {
+				if e, ok := err.(Error); ok {
+					items[i] = e
+					continue
+				}
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("invalid reply %q", line)
+}
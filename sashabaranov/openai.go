@@ -8,6 +8,7 @@ import (
 	"github.com/spf13/cast"
 	"github.com/zbysir/writeflow/pkg/export"
 	"github.com/zbysir/writeflow_plugin_llm/util"
+	"strings"
 )
 
 // Plugin implement PluginLLM
@@ -22,146 +23,197 @@ func (p *Plugin) NewOpenAICmd() export.CMDer {
 	return util.NewFun(func(ctx context.Context, params map[string]interface{}) (rsp map[string]interface{}, err error) {
 		key := params["api_key"].(string)
 		baseUrl := cast.ToString(params["base_url"])
-		config := openai.DefaultConfig(key)
-		if baseUrl != "" {
-			config.BaseURL = baseUrl
-		}
-		client := openai.NewClientWithConfig(config)
-		return map[string]interface{}{"default": client}, nil
-	})
-}
-
-func (p *Plugin) CallOpenAICmd() export.CMDer {
-	return util.NewFun(func(ctx context.Context, params map[string]interface{}) (rsp map[string]interface{}, err error) {
-		//log.Infof("langchain_call")
-		openaiClient := params["llm"].(*openai.Client)
-		promptI := params["prompt"]
-		functionI := params["functions"]
-		if promptI == nil {
-			return nil, fmt.Errorf("prompt is nil")
-		}
-		enableSteam := cast.ToBool(params["stream"])
-		prompt := promptI.(string)
-		var functions []*openai.FunctionDefine
-		if functionI != nil {
-			function := functionI.(string)
-			err = json.Unmarshal([]byte(function), &functions)
+		var config openai.ClientConfig
+		switch apiType := cast.ToString(params["api_type"]); apiType {
+		case "", APITypeOpenAI:
+			config = openai.DefaultConfig(key)
+			if baseUrl != "" {
+				config.BaseURL = baseUrl
+			}
+		case APITypeAzure, APITypeAzureAD:
+			if baseUrl == "" {
+				return nil, fmt.Errorf("base_url is required for %s, e.g. https://{resource}.openai.azure.com", apiType)
+			}
+			config = openai.DefaultAzureConfig(key, baseUrl)
+			if apiType == APITypeAzureAD {
+				config.APIType = openai.APITypeAzureAD
+			}
+			config.APIVersion = DefaultAzureAPIVersion
+			if v := cast.ToString(params["api_version"]); v != "" {
+				config.APIVersion = v
+			}
+			deployments, err := parseDeployments(params["deployments"])
 			if err != nil {
 				return nil, err
 			}
+			defaultMapper := config.AzureModelMapperFunc
+			config.AzureModelMapperFunc = func(model string) string {
+				if d, ok := deployments[model]; ok {
+					return d
+				}
+				return defaultMapper(model)
+			}
+		default:
+			return nil, fmt.Errorf("unknown api_type: %s", apiType)
 		}
+		return map[string]interface{}{"default": NewLLM(key, config)}, nil
+	})
+}
 
-		var messages []openai.ChatCompletionMessage
-		var chatMemory util.ChatMemory
-		if params["chat_memory"] != nil {
-			chatMemory = params["chat_memory"].(util.ChatMemory)
-		}
+const (
+	APITypeOpenAI  = "openai"
+	APITypeAzure   = "azure"
+	APITypeAzureAD = "azure_ad"
+)
 
-		if chatMemory != nil {
-			messages = append(messages, coverMessageListToSDK(chatMemory.GetHistory(ctx))...)
+// DefaultAzureAPIVersion 是支持 functions 的最早的 Azure API 版本，go-openai 默认的 2023-05-15 不支持
+const DefaultAzureAPIVersion = "2023-07-01-preview"
+
+// parseDeployments 解析模型到 Azure 部署名的映射，支持 JSON 对象或者一行一个的 model=deployment
+func parseDeployments(v interface{}) (map[string]string, error) {
+	s := strings.TrimSpace(cast.ToString(v))
+	if s == "" {
+		return nil, nil
+	}
+
+	m := map[string]string{}
+	if strings.HasPrefix(s, "{") {
+		err := json.Unmarshal([]byte(s), &m)
+		if err != nil {
+			return nil, fmt.Errorf("invalid deployments: %w", err)
 		}
+		return m, nil
+	}
 
-		userMsg := openai.ChatCompletionMessage{Content: prompt, Role: openai.ChatMessageRoleUser}
-		if chatMemory != nil {
-			chatMemory.AppendHistory(ctx, coverMessageToBase(userMsg))
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
 		}
-		messages = append(messages, userMsg)
-
-		// Delete stream feature, block by https://github.com/traefik/yaegi/issues/1573
-		enableSteam = false
-		if enableSteam {
-			//s, err := openaiClient.CreateChatCompletionStream(ctx, openai.ChatCompletionRequest{
-			//	Model:            "gpt-3.5-turbo-0613",
-			//	Messages:         messages,
-			//	MaxTokens:        2000,
-			//	Temperature:      0,
-			//	TopP:             0,
-			//	N:                0,
-			//	Stream:           true,
-			//	Stop:             nil,
-			//	PresencePenalty:  0,
-			//	FrequencyPenalty: 0,
-			//	LogitBias:        nil,
-			//	User:             "",
-			//	Functions:        functions,
-			//	FunctionCall:     "",
-			//})
-			//if err != nil {
-			//	return nil, err
-			//}
-			//
-			//steam := NewSteamResponse()
-			//go func() {
-			//	defer s.Close()
-			//	var content string
-			//	for {
-			//		recv, err := s.Recv()
-			//		if err != nil {
-			//			if err == io.EOF {
-			//				break
-			//			}
-			//			steam.Close(err)
-			//			break
-			//		}
-			//		if len(recv.Choices) == 0 {
-			//          // 心跳，通常是 30s 一次。
-			//			steam.Close(fmt.Errorf("recv.Choices is empty"))
-			//			break
-			//		}
-			//
-			//		c := recv.Choices[0].Delta.Content
-			//		if len(c) != 0 {
-			//			content += c
-			//			steam.Append(c)
-			//		}
-			//	}
-			//	steam.Close(nil)
-			//
-			//	if chatMemory != nil {
-			//		if content != "" {
-			//			chatMemory.AppendHistory(ctx, openai.ChatCompletionMessage{
-			//				Role:    openai.ChatMessageRoleAssistant,
-			//				Content: content,
-			//			})
-			//		}
-			//	}
-			//}()
-			//
-			//return map[string]interface{}{"default": steam, "function_call": ""}, nil
-			return map[string]interface{}{"default": ""}, nil
-		} else {
-			rsp, err := openaiClient.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
-				Model:            "gpt-3.5-turbo-0613",
-				Messages:         messages,
-				MaxTokens:        2000,
-				Temperature:      0,
-				TopP:             0,
-				N:                0,
-				Stream:           false,
-				Stop:             nil,
-				PresencePenalty:  0,
-				FrequencyPenalty: 0,
-				LogitBias:        nil,
-				User:             "",
-				Functions:        functions,
-				FunctionCall:     "",
-			})
-			if err != nil {
-				return nil, err
-			}
+		model, deployment, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid deployments line %q, should be model=deployment", line)
+		}
+		m[strings.TrimSpace(model)] = strings.TrimSpace(deployment)
+	}
+	return m, nil
+}
 
-			content := rsp.Choices[0].Message.Content
-			if chatMemory != nil {
-				chatMemory.AppendHistory(ctx, coverMessageToBase(rsp.Choices[0].Message))
-			}
+func (p *Plugin) SupportStream() bool {
+	return true
+}
 
-			return map[string]interface{}{"default": content, "function_call": rsp.Choices[0].Message.FunctionCall}, nil
-		}
+// LLM implement util.LLM
+type LLM struct {
+	client *openai.Client
+	// config and authToken are used by ChatCompletionStream which sends request by itself
+	config    openai.ClientConfig
+	authToken string
+}
+
+func NewLLM(authToken string, config openai.ClientConfig) *LLM {
+	return &LLM{
+		client:    openai.NewClientWithConfig(config),
+		config:    config,
+		authToken: authToken,
+	}
+}
+
+var _ util.LLM = (*LLM)(nil)
+
+func (l *LLM) ChatCompletion(ctx context.Context, req util.ChatRequest) (util.ChatResponse, error) {
+	functions, err := coverFunctionListToSDK(req.Functions)
+	if err != nil {
+		return util.ChatResponse{}, err
+	}
+
+	rsp, err := l.client.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
+		Model:            util.ChatModel(req.Model),
+		Messages:         coverMessageListToSDK(req.Messages),
+		MaxTokens:        req.MaxTokens,
+		Temperature:      util.KeepZero(req.Temperature),
+		TopP:             util.KeepZero(req.TopP),
+		N:                0,
+		Stream:           false,
+		Stop:             req.Stop,
+		PresencePenalty:  req.PresencePenalty,
+		FrequencyPenalty: req.FrequencyPenalty,
+		LogitBias:        req.LogitBias,
+		User:             req.User,
+		Functions:        functions,
+		FunctionCall:     "",
 	})
+	if err != nil {
+		return util.ChatResponse{}, err
+	}
+	if len(rsp.Choices) == 0 {
+		return util.ChatResponse{}, fmt.Errorf("rsp.Choices is empty")
+	}
+
+	return util.ChatResponse{
+		Message:      coverMessageToBase(rsp.Choices[0].Message),
+		FinishReason: string(rsp.Choices[0].FinishReason),
+		Usage: util.Usage{
+			PromptTokens:     rsp.Usage.PromptTokens,
+			CompletionTokens: rsp.Usage.CompletionTokens,
+			TotalTokens:      rsp.Usage.TotalTokens,
+		},
+	}, nil
 }
 
-func (p *Plugin) SupportStream() bool {
-	return false
+func (l *LLM) Embedding(ctx context.Context, req util.EmbeddingRequest) ([][]float32, error) {
+	model := req.Model
+	if model == "" {
+		model = util.DefaultEmbeddingModel
+	}
+	var m openai.EmbeddingModel
+	_ = m.UnmarshalText([]byte(model))
+	if m == openai.Unknown {
+		return nil, fmt.Errorf("unknown embedding model: %s", model)
+	}
+
+	rsp, err := l.client.CreateEmbeddings(ctx, openai.EmbeddingRequest{
+		Input: req.Input,
+		Model: m,
+		User:  req.User,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	vectors := make([][]float32, len(req.Input))
+	for _, d := range rsp.Data {
+		if d.Index < len(vectors) {
+			vectors[d.Index] = d.Embedding
+		}
+	}
+	return vectors, nil
+}
+
+func (l *LLM) Capabilities() util.Capabilities {
+	return util.Capabilities{
+		Stream:    true,
+		Functions: true,
+		Embedding: true,
+	}
+}
+
+func coverFunctionListToSDK(as []util.FunctionDefine) ([]*openai.FunctionDefine, error) {
+	var bs []*openai.FunctionDefine
+	for _, a := range as {
+		b := &openai.FunctionDefine{
+			Name:        a.Name,
+			Description: a.Description,
+		}
+		if len(a.Parameters) != 0 {
+			err := json.Unmarshal(a.Parameters, &b.Parameters)
+			if err != nil {
+				return nil, fmt.Errorf("invalid parameters of function %s: %w", a.Name, err)
+			}
+		}
+		bs = append(bs, b)
+	}
+	return bs, nil
 }
 
 func coverMessageToBase(a openai.ChatCompletionMessage) util.Message {
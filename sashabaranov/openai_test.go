@@ -0,0 +1,183 @@
+package sashabaranov
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/sashabaranov/go-openai"
+	"github.com/zbysir/writeflow_plugin_llm/util"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAzure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/openai/deployments/my-gpt35/chat/completions" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if r.URL.Query().Get("api-version") != "2023-07-01-preview" {
+			t.Errorf("unexpected api-version %s", r.URL.Query().Get("api-version"))
+		}
+		if r.Header.Get("api-key") != "key" {
+			t.Errorf("unexpected api-key %q", r.Header.Get("api-key"))
+		}
+		_, _ = io.WriteString(w, `{"choices":[{"index":0,"message":{"role":"assistant","content":"Hi"},"finish_reason":"stop"}]}`)
+	}))
+	defer srv.Close()
+
+	rsp, err := NewPlugin().NewOpenAICmd().Exec(context.Background(), map[string]interface{}{
+		"api_key":  "key",
+		"base_url": srv.URL,
+		"api_type": APITypeAzure,
+		// 没有填写 api_version 时使用支持 functions 的版本
+		"deployments": "gpt-4=my-gpt4\ngpt-3.5-turbo = my-gpt35\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := rsp["default"].(util.LLM).ChatCompletion(context.Background(), util.ChatRequest{
+		ChatOptions: util.DefaultChatOptions(),
+		Messages:    util.Messages{{Role: util.RoleUser, Content: "Hi"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Message.Content != "Hi" {
+		t.Errorf("unexpected message %+v", res.Message)
+	}
+}
+
+func TestZeroTemperature(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		// temperature 为 0 时不能被 omitempty 忽略，否则 API 会使用默认值 1
+		if v, ok := body["temperature"].(float64); !ok || v >= 1e-6 {
+			t.Errorf("unexpected temperature %v", body["temperature"])
+		}
+		// 没有选择模型时使用默认模型
+		if body["model"] != util.DefaultChatModel {
+			t.Errorf("unexpected model %v", body["model"])
+		}
+		_, _ = io.WriteString(w, `{"choices":[{"index":0,"message":{"role":"assistant","content":"Hi"},"finish_reason":"stop"}]}`)
+	}))
+	defer srv.Close()
+
+	rsp, err := NewPlugin().NewOpenAICmd().Exec(context.Background(), map[string]interface{}{
+		"api_key":  "key",
+		"base_url": srv.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options := util.DefaultChatOptions()
+	options.Temperature = 0
+	options.Model = ""
+	_, err = rsp["default"].(util.LLM).ChatCompletion(context.Background(), util.ChatRequest{
+		ChatOptions: options,
+		Messages:    util.Messages{{Role: util.RoleUser, Content: "Hi"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseDeployments(t *testing.T) {
+	m, err := parseDeployments(`{"gpt-4": "my-gpt4"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m["gpt-4"] != "my-gpt4" {
+		t.Errorf("unexpected deployments %v", m)
+	}
+
+	_, err = parseDeployments("gpt-4")
+	if err == nil {
+		t.Errorf("line without '=' should be rejected")
+	}
+}
+
+func TestChatCompletionStream(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/chat/completions" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if r.Header.Get("Authorization") != "Bearer key" {
+			t.Errorf("unexpected Authorization %q", r.Header.Get("Authorization"))
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, data := range []string{
+			`{"choices":[],"prompt_filter_results":[]}`,
+			`{"choices":[{"index":0,"delta":{"role":"assistant"}}]}`,
+			`{"choices":[{"index":0,"delta":{"content":"Hello"}}]}`,
+			`{"choices":[{"index":0,"delta":{"content":", John"}}]}`,
+			`{"choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}`,
+			`[DONE]`,
+		} {
+			_, _ = io.WriteString(w, "data: "+data+"\n\n")
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer srv.Close()
+
+	rsp, err := NewPlugin().NewOpenAICmd().Exec(context.Background(), map[string]interface{}{
+		"api_key":  "key",
+		"base_url": srv.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := rsp["default"].(util.LLM).ChatCompletionStream(context.Background(), util.ChatRequest{
+		ChatOptions: util.DefaultChatOptions(),
+		Messages:    util.Messages{{Role: util.RoleUser, Content: "Hi"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := s.NewReader().ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(data, "") != "Hello, John" {
+		t.Errorf("unexpected content %q", data)
+	}
+}
+
+func TestChatCompletionStreamError(t *testing.T) {
+	rateLimited := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = io.WriteString(w, `{"error":{"message":"Rate limit reached","type":"requests"}}`)
+	}))
+	defer rateLimited.Close()
+
+	config := openai.DefaultConfig("key")
+	config.BaseURL = rateLimited.URL
+	_, err := NewLLM("key", config).ChatCompletionStream(context.Background(), util.ChatRequest{ChatOptions: util.DefaultChatOptions()})
+	if err == nil || !strings.Contains(err.Error(), "Rate limit reached") {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"Hel\"}}]}\n\n")
+		_, _ = io.WriteString(w, "data: {\"error\":{\"message\":\"The server had an error\",\"type\":\"server_error\"}}\n\n")
+	}))
+	defer broken.Close()
+
+	config.BaseURL = broken.URL
+	s, err := NewLLM("key", config).ChatCompletionStream(context.Background(), util.ChatRequest{ChatOptions: util.DefaultChatOptions()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.NewReader().ReadAll()
+	if err == nil || !strings.Contains(err.Error(), "The server had an error") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
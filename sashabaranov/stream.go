@@ -0,0 +1,176 @@
+package sashabaranov
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sashabaranov/go-openai"
+	"github.com/zbysir/writeflow_plugin_llm/util"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// streamResponse is one chunk of the stream, go-openai's ChatCompletionStreamResponse is not used because it is read by a generic streamReader.
+type streamResponse struct {
+	Choices []streamChoice   `json:"choices"`
+	Error   *openai.APIError `json:"error,omitempty"`
+}
+
+type streamChoice struct {
+	Index        int                 `json:"index"`
+	Delta        streamDelta         `json:"delta"`
+	FinishReason openai.FinishReason `json:"finish_reason"`
+}
+
+type streamDelta struct {
+	Role         string               `json:"role,omitempty"`
+	Content      string               `json:"content,omitempty"`
+	FunctionCall *openai.FunctionCall `json:"function_call,omitempty"`
+}
+
+// ChatCompletionStream 不使用 CreateChatCompletionStream，因为它依赖泛型，在 yaegi 中无法运行，见 https://github.com/traefik/yaegi/issues/1573
+// 所以这里直接使用 client 的 HTTPClient 发送请求，并手写 SSE 的读取。
+func (l *LLM) ChatCompletionStream(ctx context.Context, req util.ChatRequest) (*util.StreamResponse, error) {
+	functions, err := coverFunctionListToSDK(req.Functions)
+	if err != nil {
+		return nil, err
+	}
+
+	bs, err := json.Marshal(openai.ChatCompletionRequest{
+		Model:            util.ChatModel(req.Model),
+		Messages:         coverMessageListToSDK(req.Messages),
+		MaxTokens:        req.MaxTokens,
+		Temperature:      util.KeepZero(req.Temperature),
+		TopP:             util.KeepZero(req.TopP),
+		N:                0,
+		Stream:           true,
+		Stop:             req.Stop,
+		PresencePenalty:  req.PresencePenalty,
+		FrequencyPenalty: req.FrequencyPenalty,
+		LogitBias:        req.LogitBias,
+		User:             req.User,
+		Functions:        functions,
+		FunctionCall:     "",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, l.chatCompletionsURL(util.ChatModel(req.Model)), bytes.NewReader(bs))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Accept", "text/event-stream")
+	httpReq.Header.Set("Cache-Control", "no-cache")
+	l.setAuthHeaders(httpReq)
+
+	httpClient := l.config.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	httpRsp, err := httpClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	if httpRsp.StatusCode < http.StatusOK || httpRsp.StatusCode >= http.StatusBadRequest {
+		defer httpRsp.Body.Close()
+		return nil, decodeErrorResponse(httpRsp)
+	}
+
+	steam := util.NewSteamResponse()
+	go func() {
+		defer httpRsp.Body.Close()
+		steam.Close(readStream(httpRsp.Body, steam))
+	}()
+
+	return steam, nil
+}
+
+// readStream 读取 SSE 并写入 steam，返回 nil 表示正常结束
+func readStream(body io.Reader, steam *util.StreamResponse) error {
+	r := util.NewSSEReader(body)
+	finished := false
+	for {
+		e, err := r.Next()
+		if err != nil {
+			if err == io.EOF {
+				// 有些兼容 OpenAI 的服务不会发送 [DONE]
+				if finished {
+					return nil
+				}
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if e.Data == "[DONE]" {
+			return nil
+		}
+
+		var chunk streamResponse
+		err = json.Unmarshal([]byte(e.Data), &chunk)
+		if err != nil {
+			return fmt.Errorf("decode stream chunk error: %w", err)
+		}
+		if chunk.Error != nil {
+			return chunk.Error
+		}
+		// Azure 的第一个 chunk 只有 prompt_filter_results，没有 choices
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+
+		c := chunk.Choices[0]
+		if c.Delta.Content != "" {
+			steam.Append(c.Delta.Content)
+		}
+		if c.Delta.FunctionCall != nil {
+			steam.AppendEvent(util.StreamEvent{
+				Type:         util.StreamEventFunctionCall,
+				FunctionCall: &util.FunctionCall{Name: c.Delta.FunctionCall.Name, Arguments: c.Delta.FunctionCall.Arguments},
+			})
+		}
+		if c.FinishReason != "" {
+			finished = true
+			steam.AppendEvent(util.StreamEvent{Type: util.StreamEventFinish, FinishReason: string(c.FinishReason)})
+		}
+	}
+}
+
+// chatCompletionsURL is the same as go-openai's Client.fullURL
+func (l *LLM) chatCompletionsURL(model string) string {
+	baseURL := strings.TrimRight(l.config.BaseURL, "/")
+	if l.config.APIType == openai.APITypeAzure || l.config.APIType == openai.APITypeAzureAD {
+		return fmt.Sprintf("%s/openai/deployments/%s/chat/completions?api-version=%s",
+			baseURL, l.config.GetAzureDeploymentByModel(model), l.config.APIVersion)
+	}
+	return baseURL + "/chat/completions"
+}
+
+// setAuthHeaders is the same as go-openai's Client.setCommonHeaders
+func (l *LLM) setAuthHeaders(req *http.Request) {
+	if l.config.APIType == openai.APITypeAzure {
+		req.Header.Set(openai.AzureAPIKeyHeader, l.authToken)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+l.authToken)
+	}
+	if l.config.OrgID != "" {
+		req.Header.Set("OpenAI-Organization", l.config.OrgID)
+	}
+}
+
+func decodeErrorResponse(rsp *http.Response) error {
+	bs, _ := io.ReadAll(rsp.Body)
+	var errRsp openai.ErrorResponse
+	err := json.Unmarshal(bs, &errRsp)
+	if err != nil || errRsp.Error == nil {
+		return &openai.RequestError{
+			HTTPStatusCode: rsp.StatusCode,
+			Err:            fmt.Errorf("%s", bs),
+		}
+	}
+	errRsp.Error.HTTPStatusCode = rsp.StatusCode
+	return errRsp.Error
+}
@@ -0,0 +1,393 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"github.com/zbysir/writeflow_plugin_llm/util"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultDriver 是 modernc.org/sqlite 注册的驱动名。
+// 插件本身不引入驱动（modernc.org/sqlite 太大，并且无法在 yaegi 中运行），需要由宿主程序引入一个纯 Go 的 SQLite 驱动。
+const DefaultDriver = "sqlite"
+
+const schema = `
+CREATE TABLE IF NOT EXISTS sessions (
+	id         TEXT PRIMARY KEY,
+	created_at INTEGER NOT NULL,
+	updated_at INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS messages (
+	id            INTEGER PRIMARY KEY AUTOINCREMENT,
+	session_id    TEXT NOT NULL REFERENCES sessions (id) ON DELETE CASCADE,
+	role          TEXT NOT NULL,
+	content       TEXT NOT NULL,
+	function_call TEXT,
+	name          TEXT NOT NULL DEFAULT '',
+	created_at    INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS messages_session_id ON messages (session_id, id);
+`
+
+// Store 是使用 SQLite 保存历史的 util.ChatStore
+type Store struct {
+	db *sql.DB
+}
+
+var _ util.SessionStore = (*Store)(nil)
+var _ util.HistoryPager = (*Store)(nil)
+var _ util.SessionPager = (*Store)(nil)
+
+// stores 缓存已经打开的数据库，chat_memory 每次运行都会调用 Open
+var stores = struct {
+	lock sync.Mutex
+	m    map[string]*Store
+}{m: map[string]*Store{}}
+
+// Open 打开（或者创建）数据库并初始化表，相同的 driver 与 dsn 会返回同一个 Store
+func Open(driver, dsn string) (*Store, error) {
+	if driver == "" {
+		driver = DefaultDriver
+	}
+	if dsn == "" {
+		return nil, fmt.Errorf("dsn is required")
+	}
+
+	stores.lock.Lock()
+	defer stores.lock.Unlock()
+
+	key := driver + "\x00" + dsn
+	if s, ok := stores.m[key]; ok {
+		return s, nil
+	}
+
+	if !DriverRegistered(driver) {
+		return nil, fmt.Errorf("sql driver %q is not registered, the host program must import a SQLite driver such as modernc.org/sqlite", driver)
+	}
+	err := makeDir(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	opened, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	// PRAGMA 只对一个连接生效，连接池中的连接可能被回收重建，所以在每个新连接上执行
+	db := sql.OpenDB(pragmaConnector{driver: opened.Driver(), dsn: dsn})
+	opened.Close()
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("open %s error: %w", dsn, err)
+	}
+	// SQLite 同时只能有一个写入者，使用一个连接来避免 SQLITE_BUSY，
+	// 其他进程的写入由 busy_timeout 等待
+	db.SetMaxOpenConns(1)
+
+	s := &Store{db: db}
+	err = s.init(context.Background())
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	stores.m[key] = s
+	return s, nil
+}
+
+// DriverRegistered 返回宿主程序是否注册了 driver
+func DriverRegistered(driver string) bool {
+	for _, d := range sql.Drivers() {
+		if d == driver {
+			return true
+		}
+	}
+	return false
+}
+
+// makeDir 创建数据库文件所在的目录，SQLite 只会创建文件，不会创建目录
+func makeDir(dsn string) error {
+	path := strings.TrimPrefix(dsn, "file:")
+	if i := strings.IndexByte(path, '?'); i != -1 {
+		path = path[:i]
+	}
+	if path == "" || path == ":memory:" {
+		return nil
+	}
+	return os.MkdirAll(filepath.Dir(path), 0o755)
+}
+
+// pragmas 在每个新连接上执行
+var pragmas = []string{
+	"PRAGMA journal_mode = WAL",
+	"PRAGMA busy_timeout = 5000",
+	"PRAGMA foreign_keys = ON",
+}
+
+// pragmaConnector 使用 driver 打开连接，并在每个新连接上执行 pragmas
+type pragmaConnector struct {
+	driver driver.Driver
+	dsn    string
+}
+
+func (c pragmaConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.driver.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	for _, pragma := range pragmas {
+		err = execConn(ctx, conn, pragma)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("exec %q error: %w", pragma, err)
+		}
+	}
+	return conn, nil
+}
+
+func (c pragmaConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+func execConn(ctx context.Context, conn driver.Conn, query string) error {
+	if e, ok := conn.(driver.ExecerContext); ok {
+		_, err := e.ExecContext(ctx, query, nil)
+		return err
+	}
+	stmt, err := conn.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(nil)
+	return err
+}
+
+func (s *Store) init(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, schema)
+	if err != nil {
+		return fmt.Errorf("create tables error: %w", err)
+	}
+	return nil
+}
+
+// Session 是 sessions 表中的一行
+type Session struct {
+	ID           string    `json:"id"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	MessageCount int       `json:"message_count"`
+}
+
+// Sessions 按最后写入的时间倒序返回 session，limit 为 0 表示不限制。
+// 使用自增的消息 id 而不是 updated_at 排序，同一毫秒内的写入也有确定的顺序
+func (s *Store) Sessions(ctx context.Context, offset, limit int) ([]Session, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := s.db.QueryContext(ctx, `
+SELECT s.id, s.created_at, s.updated_at, (SELECT COUNT(*) FROM messages m WHERE m.session_id = s.id)
+FROM sessions s
+ORDER BY (SELECT MAX(m.id) FROM messages m WHERE m.session_id = s.id) DESC, s.id
+LIMIT ? OFFSET ?`, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ss []Session
+	for rows.Next() {
+		var x Session
+		var createdAt, updatedAt int64
+		err = rows.Scan(&x.ID, &createdAt, &updatedAt, &x.MessageCount)
+		if err != nil {
+			return nil, err
+		}
+		x.CreatedAt = time.UnixMilli(createdAt)
+		x.UpdatedAt = time.UnixMilli(updatedAt)
+		ss = append(ss, x)
+	}
+	return ss, rows.Err()
+}
+
+func (s *Store) ListSessions(ctx context.Context) ([]string, error) {
+	return s.SessionPage(ctx, 0, 0)
+}
+
+// SessionPage 按 Sessions 的顺序返回一页 session id
+func (s *Store) SessionPage(ctx context.Context, offset, limit int) ([]string, error) {
+	ss, err := s.Sessions(ctx, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(ss))
+	for i, x := range ss {
+		ids[i] = x.ID
+	}
+	return ids, nil
+}
+
+func (s *Store) Load(ctx context.Context, sessionId string) (util.Messages, error) {
+	return s.History(ctx, sessionId, 0, 0)
+}
+
+// History 按时间顺序返回一页历史，limit 为 0 表示不限制
+func (s *Store) History(ctx context.Context, sessionId string, offset, limit int) (util.Messages, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := s.db.QueryContext(ctx, `
+SELECT role, content, function_call, name
+FROM messages
+WHERE session_id = ?
+ORDER BY id
+LIMIT ? OFFSET ?`, sessionId, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ms util.Messages
+	for rows.Next() {
+		var m util.Message
+		var functionCall sql.NullString
+		err = rows.Scan(&m.Role, &m.Content, &functionCall, &m.Name)
+		if err != nil {
+			return nil, err
+		}
+		if functionCall.Valid {
+			m.FunctionCall = &util.FunctionCall{}
+			err = json.Unmarshal([]byte(functionCall.String), m.FunctionCall)
+			if err != nil {
+				return nil, fmt.Errorf("decode function_call error: %w", err)
+			}
+		}
+		ms = append(ms, m)
+	}
+	return ms, rows.Err()
+}
+
+func (s *Store) Append(ctx context.Context, sessionId string, messages ...util.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = insertMessages(ctx, tx, sessionId, messages)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Store) Delete(ctx context.Context, sessionId string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = deleteSession(ctx, tx, sessionId)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Store) Replace(ctx context.Context, sessionId string, messages util.Messages) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = deleteSession(ctx, tx, sessionId)
+	if err != nil {
+		return err
+	}
+	if len(messages) != 0 {
+		err = insertMessages(ctx, tx, sessionId, messages)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *Store) CompareAndReplace(ctx context.Context, sessionId string, n int, messages util.Messages) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var count int
+	err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM messages WHERE session_id = ?`, sessionId).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	if count != n {
+		return false, nil
+	}
+
+	err = deleteSession(ctx, tx, sessionId)
+	if err != nil {
+		return false, err
+	}
+	if len(messages) != 0 {
+		err = insertMessages(ctx, tx, sessionId, messages)
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
+
+func deleteSession(ctx context.Context, tx *sql.Tx, sessionId string) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM messages WHERE session_id = ?`, sessionId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM sessions WHERE id = ?`, sessionId)
+	return err
+}
+
+func insertMessages(ctx context.Context, tx *sql.Tx, sessionId string, messages util.Messages) error {
+	now := time.Now().UnixMilli()
+	_, err := tx.ExecContext(ctx, `
+INSERT INTO sessions (id, created_at, updated_at) VALUES (?, ?, ?)
+ON CONFLICT (id) DO UPDATE SET updated_at = excluded.updated_at`, sessionId, now, now)
+	if err != nil {
+		return err
+	}
+	for _, message := range messages {
+		var functionCall sql.NullString
+		if message.FunctionCall != nil {
+			bs, err := json.Marshal(message.FunctionCall)
+			if err != nil {
+				return err
+			}
+			functionCall = sql.NullString{String: string(bs), Valid: true}
+		}
+
+		_, err = tx.ExecContext(ctx, `
+INSERT INTO messages (session_id, role, content, function_call, name, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+			sessionId, message.Role, message.Content, functionCall, message.Name, now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+// Package sqlitetest 是单独的 module，只在测试中引入 modernc.org/sqlite，这样插件本身不需要 vendor 它
+package sqlitetest
+
+import (
+	"context"
+	"fmt"
+	"github.com/zbysir/writeflow_plugin_llm/sqlite"
+	"github.com/zbysir/writeflow_plugin_llm/util"
+	_ "modernc.org/sqlite"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	dsn := filepath.Join(t.TempDir(), "chat.db")
+	s, err := sqlite.Open("", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s2, _ := sqlite.Open(sqlite.DefaultDriver, dsn); s2 != s {
+		t.Errorf("the same dsn should return the same store")
+	}
+
+	m := util.NewStoreChatMemory(s, "a", 0)
+	for _, msg := range []util.Message{
+		{Role: util.RoleUser, Content: "Weather?"},
+		{Role: util.RoleAssistant, FunctionCall: &util.FunctionCall{Name: "get_weather", Arguments: `{"city":"Paris"}`}},
+		{Role: util.RoleFunction, Name: "get_weather", Content: `{"temp":20}`},
+		{Role: util.RoleAssistant, Content: "20 degrees."},
+	} {
+		if err := m.AppendHistory(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Append(ctx, "b", util.Message{Role: util.RoleUser, Content: "Hi"}); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := m.GetHistory(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h) != 4 || h[1].FunctionCall == nil || h[1].FunctionCall.Arguments != `{"city":"Paris"}` || h[2].Name != "get_weather" || h[3].FunctionCall != nil {
+		t.Fatalf("unexpected history %+v", h)
+	}
+
+	page, err := s.History(ctx, "a", 1, 2)
+	if err != nil || len(page) != 2 || page[0].Role != util.RoleAssistant || page[1].Role != util.RoleFunction {
+		t.Fatalf("unexpected page %+v %v", page, err)
+	}
+
+	sessions, err := s.Sessions(ctx, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 || sessions[0].ID != "b" || sessions[1].ID != "a" || sessions[1].MessageCount != 4 {
+		t.Fatalf("unexpected sessions %+v", sessions)
+	}
+	if sessions, _ = s.Sessions(ctx, 1, 1); len(sessions) != 1 || sessions[0].ID != "a" {
+		t.Fatalf("unexpected sessions page %+v", sessions)
+	}
+
+	// 管理组件通过 util 的分页函数在数据库中分页
+	if ids, _ := util.SessionPage(ctx, s, 1, 1); len(ids) != 1 || ids[0] != "a" {
+		t.Fatalf("unexpected session ids page %v", ids)
+	}
+	if page, _ = util.HistoryPage(ctx, s, "a", 3, 0); len(page) != 1 || page[0].Content != "20 degrees." {
+		t.Fatalf("unexpected history page %+v", page)
+	}
+}
+
+func TestStoreConcurrentWriters(t *testing.T) {
+	ctx := context.Background()
+	s, err := sqlite.Open("", filepath.Join(t.TempDir(), "chat.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if err := s.Append(ctx, fmt.Sprintf("s%d", i%4), util.Message{Role: util.RoleUser, Content: fmt.Sprint(j)}); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < 4; i++ {
+		h, err := s.Load(ctx, fmt.Sprintf("s%d", i))
+		if err != nil || len(h) != 50 {
+			t.Fatalf("s%d: unexpected history len %d %v", i, len(h), err)
+		}
+	}
+}
+
+func TestStoreSessions(t *testing.T) {
+	ctx := context.Background()
+	s, err := sqlite.Open("", filepath.Join(t.TempDir(), "chat.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = s.Append(ctx, "a", util.Message{Role: util.RoleUser, Content: "1"})
+	_ = s.Append(ctx, "b", util.Message{Role: util.RoleUser, Content: "2"})
+
+	err = s.Replace(ctx, "a", util.Messages{{Role: util.RoleSystem, Content: "x"}, {Role: util.RoleUser, Content: "y"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h, _ := s.Load(ctx, "a"); len(h) != 2 || h[0].Content != "x" {
+		t.Fatalf("unexpected replaced history %+v", h)
+	}
+
+	err = s.Delete(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := s.ListSessions(ctx)
+	if err != nil || len(ids) != 1 || ids[0] != "a" {
+		t.Fatalf("unexpected sessions %v %v", ids, err)
+	}
+	if h, _ := s.Load(ctx, "b"); len(h) != 0 {
+		t.Fatalf("deleted history %+v", h)
+	}
+}
+
+func TestStoreOrder(t *testing.T) {
+	ctx := context.Background()
+	// 数据库所在的目录不存在时会被创建
+	s, err := sqlite.Open("", filepath.Join(t.TempDir(), "data", "chat.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 同一毫秒内的写入也按写入顺序排列
+	for _, id := range []string{"a", "b", "c", "a"} {
+		if err := s.Append(ctx, id, util.Message{Role: util.RoleUser, Content: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids, err := s.ListSessions(ctx)
+	if err != nil || strings.Join(ids, ",") != "a,c,b" {
+		t.Fatalf("unexpected sessions %v %v", ids, err)
+	}
+}
+
+func TestOpenUnknownDriver(t *testing.T) {
+	_, err := sqlite.Open("sqlite-not-registered", filepath.Join(t.TempDir(), "chat.db"))
+	if err == nil || !strings.Contains(err.Error(), "not registered") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestStoreCompareAndReplace(t *testing.T) {
+	ctx := context.Background()
+	s, err := sqlite.Open("", filepath.Join(t.TempDir(), "chat.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = s.Append(ctx, "a", util.Message{Role: util.RoleUser, Content: "1"}, util.Message{Role: util.RoleAssistant, Content: "2"})
+
+	ok, err := s.CompareAndReplace(ctx, "a", 1, util.Messages{{Role: util.RoleUser, Content: "x"}})
+	if err != nil || ok {
+		t.Fatalf("history with another length should not be replaced: %v %v", ok, err)
+	}
+	ok, err = s.CompareAndReplace(ctx, "a", 2, util.Messages{{Role: util.RoleUser, Content: "x"}})
+	if err != nil || !ok {
+		t.Fatalf("unexpected result %v %v", ok, err)
+	}
+	if h, _ := s.Load(ctx, "a"); len(h) != 1 || h[0].Content != "x" {
+		t.Fatalf("unexpected history %+v", h)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cast"
+	"github.com/zbysir/writeflow/pkg/export"
+	"github.com/zbysir/writeflow_plugin_llm/util"
+)
+
+// newToolCmd 实现 tool，将上游节点输出的 cmd 与函数定义组合为 util.Tool
+func newToolCmd() export.CMDer {
+	return util.NewFun(func(ctx context.Context, params map[string]interface{}) (rsp map[string]interface{}, err error) {
+		define := util.FunctionDefine{
+			Name:        cast.ToString(params["name"]),
+			Description: cast.ToString(params["description"]),
+		}
+		if p := cast.ToString(params["parameters"]); p != "" {
+			define.Parameters = json.RawMessage(p)
+		}
+
+		tool, err := util.NewTool(define, params["cmd"])
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"default": tool}, nil
+	})
+}
+
+// newFunctionDefineCmd 实现 function_define，参数由 properties 的参数行或者 parameters 的 JSON Schema 定义
+func newFunctionDefineCmd() export.CMDer {
+	return util.NewFun(func(ctx context.Context, params map[string]interface{}) (rsp map[string]interface{}, err error) {
+		define := util.FunctionDefine{
+			Name:        cast.ToString(params["name"]),
+			Description: cast.ToString(params["description"]),
+		}
+
+		properties, parameters := cast.ToString(params["properties"]), cast.ToString(params["parameters"])
+		switch {
+		case properties != "" && parameters != "":
+			return nil, fmt.Errorf("properties and parameters can not be used together")
+		case parameters != "":
+			define.Parameters = json.RawMessage(parameters)
+		default:
+			define.Parameters, err = util.ParsePropertyRows(properties)
+			if err != nil {
+				return nil, fmt.Errorf("invalid properties: %w", err)
+			}
+		}
+
+		err = util.ValidateFunction(define)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"default": define}, nil
+	})
+}
+
+// withTools 将 tools 的定义加入 functions，返回函数名对应的实现
+func withTools(functions []util.FunctionDefine, tools []*util.Tool) ([]util.FunctionDefine, map[string]export.CMDer, error) {
+	impls := map[string]export.CMDer{}
+	for _, t := range tools {
+		if util.HasFunction(functions, t.Define.Name) {
+			return nil, nil, fmt.Errorf("function %s is defined more than once", t.Define.Name)
+		}
+		impls[t.Define.Name] = t
+		functions = append(functions, t.Define)
+	}
+	return functions, impls, nil
+}
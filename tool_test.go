@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"github.com/zbysir/writeflow_plugin_llm/util"
+	"strings"
+	"testing"
+)
+
+func TestCallTools(t *testing.T) {
+	ctx := context.Background()
+	rsp, err := newToolCmd().Exec(ctx, map[string]interface{}{
+		"cmd": util.NewFun(func(ctx context.Context, params map[string]interface{}) (map[string]interface{}, error) {
+			return map[string]interface{}{"default": "20 degrees in " + params["city"].(string)}, nil
+		}),
+		"name":       "get_weather",
+		"parameters": `{"type":"object","properties":{"city":{"type":"string"}}}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	weather := rsp["default"].(*util.Tool)
+
+	memory := newRecordMemory()
+	llm := &fakeLLM{replies: util.Messages{
+		{Role: util.RoleAssistant, FunctionCall: &util.FunctionCall{Name: "get_weather", Arguments: `{"city":"Paris"}`}},
+		{Role: util.RoleAssistant, FunctionCall: &util.FunctionCall{Name: "send_mail", Arguments: `{"text":"20 degrees"}`}},
+	}}
+	rsp, err = newCallCmd().Exec(ctx, map[string]interface{}{
+		"llm":         llm,
+		"chat_memory": memory,
+		"functions":   `[{"name":"send_mail","parameters":{"type":"object"}}]`,
+		"tools":       []interface{}{weather},
+		"stream":      true,
+		"prompt":      "Mail me the weather in Paris",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(llm.req.Functions) != 2 || llm.req.Functions[1].Name != "get_weather" {
+		t.Errorf("tools should be advertised as functions, got %+v", llm.req.Functions)
+	}
+	if m := llm.req.Messages[len(llm.req.Messages)-1]; m.Role != util.RoleFunction || m.Content != "20 degrees in Paris" {
+		t.Errorf("unexpected function result %+v", m)
+	}
+	// 没有实现的函数交给下游执行
+	if fc, ok := rsp["function_call"].(*util.FunctionCall); !ok || fc.Name != "send_mail" {
+		t.Errorf("unexpected function_call %#v", rsp["function_call"])
+	}
+	if history, _ := memory.GetHistory(ctx); len(history) != 4 {
+		t.Errorf("unexpected history %+v", history)
+	}
+
+	_, err = newCallCmd().Exec(ctx, map[string]interface{}{
+		"llm":       llm,
+		"functions": `[{"name":"get_weather","parameters":{"type":"object"}}]`,
+		"tools":     []interface{}{weather},
+		"prompt":    "Hi",
+	})
+	if err == nil || !strings.Contains(err.Error(), "more than once") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestFunctionDefine(t *testing.T) {
+	ctx := context.Background()
+	rsp, err := newFunctionDefineCmd().Exec(ctx, map[string]interface{}{
+		"name":       "get_weather",
+		"properties": "city string required The city",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	define := rsp["default"]
+
+	llm := &fakeLLM{chunks: []string{"ok"}}
+	_, err = newCallCmd().Exec(ctx, map[string]interface{}{
+		"llm":       llm,
+		"functions": []interface{}{define, `[{"name":"send_mail"}]`},
+		"prompt":    "Hi",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(llm.req.Functions) != 2 || llm.req.Functions[0].Name != "get_weather" || !strings.Contains(string(llm.req.Functions[0].Parameters), `"required":["city"]`) {
+		t.Errorf("unexpected functions %+v", llm.req.Functions)
+	}
+
+	for _, params := range []map[string]interface{}{
+		{"name": "get weather"},
+		{"name": "f", "parameters": `{"type":"object","required":["city"]}`},
+		{"name": "f", "properties": "city string", "parameters": `{"type":"object"}`},
+	} {
+		if _, err = newFunctionDefineCmd().Exec(ctx, params); err == nil {
+			t.Errorf("%v should be invalid", params)
+		}
+	}
+}
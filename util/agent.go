@@ -0,0 +1,137 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/zbysir/writeflow/pkg/export"
+)
+
+const DefaultAgentMaxIterations = 5
+
+// ErrAgentMaxIterations 在执行函数的轮数超过限制时返回，这时 AgentResult 中是已经执行的部分
+var ErrAgentMaxIterations = errors.New("agent exceeded max iterations")
+
+// AgentStep 是 Agent 执行的一次函数调用
+type AgentStep struct {
+	Function  string `json:"function"`
+	Arguments string `json:"arguments"`
+	Result    string `json:"result"`
+	// Error 是函数执行失败的原因，它会作为结果交给模型
+	Error string `json:"error,omitempty"`
+}
+
+type AgentResult struct {
+	Response ChatResponse
+	// Messages 是本次调用新产生的消息，包括 function_call、函数结果与最后的回复
+	Messages Messages
+	Trace    []AgentStep
+}
+
+// Agent 循环地调用模型并执行模型要求的函数，直到模型直接回复
+type Agent struct {
+	llm LLM
+	// tools 是函数名对应的实现，参数是 JSON 解析后的对象
+	tools map[string]export.CMDer
+	// maxIterations 是最多执行函数的轮数
+	maxIterations int
+}
+
+func NewAgent(llm LLM, tools map[string]export.CMDer, maxIterations int) *Agent {
+	if maxIterations <= 0 {
+		maxIterations = DefaultAgentMaxIterations
+	}
+	return &Agent{llm: llm, tools: tools, maxIterations: maxIterations}
+}
+
+func (a *Agent) Run(ctx context.Context, req ChatRequest) (AgentResult, error) {
+	var result AgentResult
+	messages := append(Messages(nil), req.Messages...)
+	for i := 0; ; i++ {
+		req.Messages = messages
+		res, err := a.llm.ChatCompletion(ctx, req)
+		if err != nil {
+			return result, err
+		}
+		result.Response = res
+		result.Messages = append(result.Messages, res.Message)
+		messages = append(messages, res.Message)
+
+		fc := res.Message.FunctionCall
+		if fc == nil {
+			return result, nil
+		}
+		// 声明了但没有实现的函数交给调用方执行
+		if _, ok := a.tools[fc.Name]; !ok && HasFunction(req.Functions, fc.Name) {
+			return result, nil
+		}
+		if i == a.maxIterations {
+			return result, fmt.Errorf("%w %d", ErrAgentMaxIterations, a.maxIterations)
+		}
+
+		step := AgentStep{Function: fc.Name, Arguments: fc.Arguments}
+		step.Result, err = a.call(ctx, *fc)
+		if err != nil {
+			if ctx.Err() != nil {
+				return result, ctx.Err()
+			}
+			// 让模型知道函数失败了，它可以换一种方式重试
+			step.Error = err.Error()
+			bs, _ := json.Marshal(map[string]string{"error": step.Error})
+			step.Result = string(bs)
+		}
+		result.Trace = append(result.Trace, step)
+
+		m := Message{Role: RoleFunction, Name: fc.Name, Content: step.Result}
+		result.Messages = append(result.Messages, m)
+		messages = append(messages, m)
+	}
+}
+
+func (a *Agent) call(ctx context.Context, fc FunctionCall) (string, error) {
+	tool, ok := a.tools[fc.Name]
+	if !ok {
+		return "", fmt.Errorf("function %s not found", fc.Name)
+	}
+	return CallTool(ctx, tool, fc.Arguments)
+}
+
+// HasFunction 返回 functions 中是否有名为 name 的函数
+func HasFunction(functions []FunctionDefine, name string) bool {
+	for _, f := range functions {
+		if f.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// CallTool 使用 JSON 格式的参数执行 tool，返回 default 输出，不是字符串的输出会被序列化为 JSON
+func CallTool(ctx context.Context, tool export.CMDer, arguments string) (string, error) {
+	params := map[string]interface{}{}
+	if arguments != "" {
+		err := json.Unmarshal([]byte(arguments), &params)
+		if err != nil {
+			return "", fmt.Errorf("invalid arguments: %w", err)
+		}
+	}
+
+	rsp, err := tool.Exec(ctx, params)
+	if err != nil {
+		return "", err
+	}
+
+	var v interface{} = rsp
+	if d, ok := rsp["default"]; ok {
+		v = d
+	}
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("encode result error: %w", err)
+	}
+	return string(bs), nil
+}
@@ -0,0 +1,59 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/zbysir/writeflow/pkg/export"
+	"strings"
+	"testing"
+)
+
+func TestAgent(t *testing.T) {
+	ctx := context.Background()
+	llm := &fakeLLM{replies: Messages{
+		{Role: RoleAssistant, FunctionCall: &FunctionCall{Name: "add", Arguments: `{"a":1,"b":2}`}},
+		{Role: RoleAssistant, FunctionCall: &FunctionCall{Name: "fail"}},
+		{Role: RoleAssistant, FunctionCall: &FunctionCall{Name: "unknown"}},
+		{Role: RoleAssistant, Content: "1 + 2 = 3"},
+	}}
+	tools := map[string]export.CMDer{
+		"add": NewFun(func(ctx context.Context, params map[string]interface{}) (map[string]interface{}, error) {
+			return map[string]interface{}{"default": params["a"].(float64) + params["b"].(float64)}, nil
+		}),
+		"fail": NewFun(func(ctx context.Context, params map[string]interface{}) (map[string]interface{}, error) {
+			return nil, fmt.Errorf("boom")
+		}),
+	}
+
+	res, err := NewAgent(llm, tools, 0).Run(ctx, ChatRequest{Messages: Messages{{Role: RoleUser, Content: "1 + 2?"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Response.Message.Content != "1 + 2 = 3" {
+		t.Errorf("unexpected answer %+v", res.Response.Message)
+	}
+	if len(res.Trace) != 3 || res.Trace[0].Result != "3" || res.Trace[1].Error != "boom" || !strings.Contains(res.Trace[2].Error, "not found") {
+		t.Errorf("unexpected trace %+v", res.Trace)
+	}
+	if len(res.Messages) != 7 || res.Messages[1] != (Message{Role: RoleFunction, Name: "add", Content: "3"}) || res.Messages[3].Content != `{"error":"boom"}` {
+		t.Errorf("unexpected messages %+v", res.Messages)
+	}
+	// 每次请求都带上之前的函数结果
+	if len(llm.reqs) != 4 || len(llm.reqs[3].Messages) != 7 {
+		t.Errorf("unexpected requests %+v", llm.reqs)
+	}
+
+	loop := &fakeLLM{}
+	for i := 0; i < 10; i++ {
+		loop.replies = append(loop.replies, Message{Role: RoleAssistant, FunctionCall: &FunctionCall{Name: "add", Arguments: `{"a":1,"b":1}`}})
+	}
+	res, err = NewAgent(loop, tools, 2).Run(ctx, ChatRequest{})
+	if !errors.Is(err, ErrAgentMaxIterations) || len(loop.reqs) != 3 {
+		t.Errorf("unexpected error %v after %d requests", err, len(loop.reqs))
+	}
+	// 超过最大轮数时返回已经执行的部分
+	if len(res.Trace) != 2 || res.Trace[1].Result != "2" {
+		t.Errorf("unexpected partial trace %+v", res.Trace)
+	}
+}
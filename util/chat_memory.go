@@ -2,7 +2,17 @@ package util
 
 import (
 	"context"
-	"github.com/sashabaranov/go-openai"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+const (
+	RoleSystem    = "system"
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+	RoleFunction  = "function"
 )
 
 type Message struct {
@@ -29,44 +39,303 @@ type FunctionCall struct {
 
 type Messages = []Message
 
+// ChatMemory 保存一个会话的历史，持久化的实现可能会返回 IO 错误
 type ChatMemory interface {
-	GetHistory(ctx context.Context) Messages
-	AppendHistory(ctx context.Context, message Message)
+	GetHistory(ctx context.Context) (Messages, error)
+	// AppendHistory 原子地追加多条消息，要么全部写入，要么都不写入
+	AppendHistory(ctx context.Context, messages ...Message) error
+}
+
+// memoryStore 保存所有 session 的历史，所有 MemoryChatMemory 共享，这样多次运行之间可以保持对话
+type memoryStore struct {
+	lock     sync.Mutex
+	sessions map[string]Messages
+}
+
+var history = &memoryStore{sessions: map[string]Messages{}}
+
+var _ SessionStore = (*memoryStore)(nil)
+
+func (s *memoryStore) Load(ctx context.Context, sessionId string) (Messages, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append(Messages(nil), s.sessions[sessionId]...), nil
+}
+
+func (s *memoryStore) Append(ctx context.Context, sessionId string, messages ...Message) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(messages) != 0 {
+		s.sessions[sessionId] = append(s.sessions[sessionId], messages...)
+	}
+	return nil
+}
+
+func (s *memoryStore) ListSessions(ctx context.Context) ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ids := make([]string, 0, len(s.sessions))
+	for id := range s.sessions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (s *memoryStore) Delete(ctx context.Context, sessionId string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.sessions, sessionId)
+	return nil
+}
+
+func (s *memoryStore) Replace(ctx context.Context, sessionId string, messages Messages) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(messages) == 0 {
+		delete(s.sessions, sessionId)
+		return nil
+	}
+	s.sessions[sessionId] = append(Messages(nil), messages...)
+	return nil
 }
 
-var history map[string][]openai.ChatCompletionMessage
+func (s *memoryStore) CompareAndReplace(ctx context.Context, sessionId string, n int, messages Messages) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
-func init() {
-	history = map[string][]openai.ChatCompletionMessage{}
+	if len(s.sessions[sessionId]) != n {
+		return false, nil
+	}
+	if len(messages) == 0 {
+		delete(s.sessions, sessionId)
+		return true, nil
+	}
+	s.sessions[sessionId] = append(Messages(nil), messages...)
+	return true, nil
 }
 
+// MemoryChatMemory 是保存在进程内存中的 ChatMemory，可以被多个节点并发使用
 type MemoryChatMemory struct {
 	sessionId string
-	maxSize   int
+	// maxSize 是读取时返回的最大消息数，0 表示不限制，保存的历史不会被删除
+	maxSize int
 }
 
-func NewMemoryChatMemory(sessionId string) *MemoryChatMemory {
+var _ SessionChatMemory = (*MemoryChatMemory)(nil)
+
+func NewMemoryChatMemory(sessionId string, maxSize int) *MemoryChatMemory {
 	return &MemoryChatMemory{
 		sessionId: sessionId,
+		maxSize:   maxSize,
 	}
 }
 
-func (m *MemoryChatMemory) GetHistory(ctx context.Context) []openai.ChatCompletionMessage {
+func (m *MemoryChatMemory) SessionId() string {
+	return m.sessionId
+}
+
+// Store 返回所有 MemoryChatMemory 共享的存储
+func (m *MemoryChatMemory) Store() ChatStore {
+	return history
+}
+
+// GetHistory 返回历史的副本，调用方修改它不会影响到保存的历史
+func (m *MemoryChatMemory) GetHistory(ctx context.Context) (Messages, error) {
 	if m.sessionId == "" {
+		return nil, nil
+	}
+
+	ms, err := history.Load(ctx, m.sessionId)
+	if err != nil {
+		return nil, err
+	}
+	return TrimTurns(ms, m.maxSize), nil
+}
+
+func (m *MemoryChatMemory) AppendHistory(ctx context.Context, messages ...Message) error {
+	if m.sessionId == "" || len(messages) == 0 {
 		return nil
 	}
-	return history[m.sessionId]
+
+	return history.Append(ctx, m.sessionId, messages...)
 }
 
-func (m *MemoryChatMemory) AppendHistory(ctx context.Context, message openai.ChatCompletionMessage) {
-	if m.sessionId == "" {
-		return
+// TrimTurns 按整轮删除最早的对话，直到 system 以外的消息不超过 maxSize，
+// 一轮从一条 user 消息开始，function_call 与它的结果不会被分开。system 消息总是保留，
+// 最后一轮超过 maxSize 时也完整保留，没有 user 消息时不截取，maxSize 为 0 表示不限制
+func TrimTurns(ms Messages, maxSize int) Messages {
+	if maxSize <= 0 {
+		return ms
+	}
+	// start 是保留的第一轮的位置
+	start := len(ms)
+	count := 0
+	for i := len(ms) - 1; i >= 0; i-- {
+		if ms[i].Role != RoleSystem {
+			count++
+		}
+		if ms[i].Role != RoleUser {
+			continue
+		}
+		if count > maxSize && start != len(ms) {
+			break
+		}
+		start = i
+		if count >= maxSize {
+			break
+		}
+	}
+	if start == len(ms) || start == 0 {
+		return ms
 	}
 
-	history[m.sessionId] = append(history[m.sessionId], message)
-	if m.maxSize != 0 {
-		if len(history[m.sessionId]) > m.maxSize {
-			history[m.sessionId] = history[m.sessionId][1:]
+	trimmed := make(Messages, 0, len(ms)-start)
+	for _, m := range ms[:start] {
+		if m.Role == RoleSystem {
+			trimmed = append(trimmed, m)
 		}
 	}
+	return append(trimmed, ms[start:]...)
+}
+
+// HistoryQuery 描述 langchain_call 本次需要的历史
+type HistoryQuery struct {
+	// TokenBudget 是留给历史消息的 token 数，不大于 0 时不限制
+	TokenBudget int
+	// Prompt 是本次的用户输入，用于查找相关的历史
+	Prompt string
+}
+
+// HistoryWindower 由能按需截取历史的 ChatMemory 实现，langchain_call 会优先使用它
+type HistoryWindower interface {
+	GetHistoryWindow(ctx context.Context, q HistoryQuery) (Messages, error)
+}
+
+// TokenWindowChatMemory 在读取历史时按 token 预算截取，保存的历史不受影响
+type TokenWindowChatMemory struct {
+	ChatMemory
+}
+
+var _ HistoryWindower = (*TokenWindowChatMemory)(nil)
+var _ ChatMemoryWrapper = (*TokenWindowChatMemory)(nil)
+
+func NewTokenWindowChatMemory(m ChatMemory) *TokenWindowChatMemory {
+	return &TokenWindowChatMemory{ChatMemory: m}
+}
+
+func (m *TokenWindowChatMemory) Unwrap() ChatMemory {
+	return m.ChatMemory
+}
+
+func (m *TokenWindowChatMemory) GetHistoryWindow(ctx context.Context, q HistoryQuery) (Messages, error) {
+	ms, err := m.GetHistory(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if q.TokenBudget <= 0 {
+		return ms, nil
+	}
+	return TrimMessages(ms, q.TokenBudget), nil
+}
+
+// ChatMemoryTx 暂存一次调用需要写入 ChatMemory 的消息，只在调用成功后一次性写入，
+// 避免失败或者被取消的调用留下一条没有回复的用户消息。
+type ChatMemoryTx struct {
+	// memory 为 nil 时所有操作都不做任何事
+	memory   ChatMemory
+	messages Messages
+	// cut 不小于 0 时，Commit 将历史替换为 snapshot 的前 cut 条与暂存的消息，memory 需要能 Unwrap 为 ForkableChatMemory
+	snapshot Messages
+	cut      int
+}
+
+func NewChatMemoryTx(memory ChatMemory) *ChatMemoryTx {
+	return &ChatMemoryTx{memory: memory, cut: -1}
+}
+
+// Replace 暂存一次替换，用于重新生成：Commit 时只保留 snapshot 的前 cut 条消息再追加暂存的消息。
+// snapshot 是读取到的完整历史，如果 Commit 前历史被修改了，Commit 返回 ErrHistoryChanged
+func (t *ChatMemoryTx) Replace(snapshot Messages, cut int) {
+	t.snapshot, t.cut = snapshot, cut
+}
+
+func (t *ChatMemoryTx) Stage(messages ...Message) {
+	t.messages = append(t.messages, messages...)
+}
+
+// Commit 写入暂存的消息
+func (t *ChatMemoryTx) Commit(ctx context.Context) error {
+	ms, snapshot, cut := t.messages, t.snapshot, t.cut
+	t.reset()
+	if t.memory == nil {
+		return nil
+	}
+
+	if cut >= 0 {
+		m, ok := BaseChatMemory(t.memory).(ForkableChatMemory)
+		if !ok {
+			return fmt.Errorf("chat memory %T does not support truncate", t.memory)
+		}
+		// 截断与追加在一次替换中完成，不会出现只删除了旧的回复而没有写入新的回复
+		kept := append(append(Messages(nil), snapshot[:cut]...), ms...)
+		return m.ReplaceHistory(ctx, len(snapshot), kept)
+	}
+	if len(ms) == 0 {
+		return nil
+	}
+	return t.memory.AppendHistory(ctx, ms...)
+}
+
+func (t *ChatMemoryTx) reset() {
+	t.messages, t.snapshot, t.cut = nil, nil, -1
+}
+
+// Fail 在调用失败时使用，record 为 true 时将错误作为一条带注释的回复一起写入，否则丢弃暂存的消息
+func (t *ChatMemoryTx) Fail(ctx context.Context, cause error, record bool) error {
+	if !record {
+		t.reset()
+		return nil
+	}
+	t.Stage(Message{Role: RoleAssistant, Content: fmt.Sprintf("[failed: %v]", cause)})
+	return t.Commit(ctx)
+}
+
+// ParseMessages 读取 JSON 字符串或者上游节点输出的消息列表
+func ParseMessages(v interface{}) (Messages, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case Messages:
+		return v, nil
+	case Message:
+		return Messages{v}, nil
+	case string:
+		if v == "" {
+			return nil, nil
+		}
+		var ms Messages
+		err := json.Unmarshal([]byte(v), &ms)
+		if err != nil {
+			return nil, fmt.Errorf("invalid messages: %w", err)
+		}
+		return ms, nil
+	}
+
+	// 如 []interface{}{map[string]interface{}{...}}，通过 JSON 转换
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid messages: %w", err)
+	}
+	var ms Messages
+	err = json.Unmarshal(bs, &ms)
+	if err != nil {
+		return nil, fmt.Errorf("messages must be a list of message, got %T", v)
+	}
+	return ms, nil
 }
@@ -0,0 +1,103 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestMemoryChatMemoryConcurrentSessions(t *testing.T) {
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		sessionId := fmt.Sprintf("concurrent-%d", i)
+		for j := 0; j < 5; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				m := NewMemoryChatMemory(sessionId, 0)
+				for k := 0; k < 20; k++ {
+					_ = m.AppendHistory(ctx, Message{Role: RoleUser, Content: sessionId})
+					_, _ = m.GetHistory(ctx)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	for i := 0; i < 10; i++ {
+		sessionId := fmt.Sprintf("concurrent-%d", i)
+		h, _ := NewMemoryChatMemory(sessionId, 0).GetHistory(ctx)
+		if len(h) != 100 {
+			t.Fatalf("%s: expect 100 messages, got %d", sessionId, len(h))
+		}
+		for _, m := range h {
+			if m.Content != sessionId {
+				t.Fatalf("%s: message of other session %q", sessionId, m.Content)
+			}
+		}
+	}
+}
+
+func TestMemoryChatMemoryMaxSize(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryChatMemory("max-size", 3)
+	for i := 0; i < 5; i++ {
+		_ = m.AppendHistory(ctx, Message{Role: RoleUser, Content: fmt.Sprint(i)})
+	}
+
+	h, _ := m.GetHistory(ctx)
+	if len(h) != 3 || h[0].Content != "2" || h[2].Content != "4" {
+		t.Fatalf("unexpected history %+v", h)
+	}
+
+	// 修改返回值不影响保存的历史
+	h[0].Content = "changed"
+	if h, _ := m.GetHistory(ctx); h[0].Content != "2" {
+		t.Errorf("history should not be changed by caller")
+	}
+
+	empty := NewMemoryChatMemory("", 0)
+	_ = empty.AppendHistory(ctx, Message{Role: RoleUser, Content: "x"})
+	if h, _ := empty.GetHistory(ctx); len(h) != 0 {
+		t.Errorf("empty session id should not keep history")
+	}
+}
+
+func TestTrimTurns(t *testing.T) {
+	ms := Messages{
+		{Role: RoleSystem, Content: "system"},
+		{Role: RoleUser, Content: "1"},
+		{Role: RoleAssistant, Content: "1"},
+		{Role: RoleUser, Content: "2"},
+		{Role: RoleAssistant, FunctionCall: &FunctionCall{Name: "f"}},
+		{Role: RoleFunction, Name: "f", Content: "{}"},
+		{Role: RoleAssistant, Content: "2"},
+	}
+
+	// 只保留整轮，function_call 不会与结果分开，system 消息总是保留
+	h := TrimTurns(ms, 5)
+	if len(h) != 5 || h[0].Role != RoleSystem || h[1].Content != "2" {
+		t.Fatalf("unexpected history %+v", h)
+	}
+	// 最后一轮超过 maxSize 时完整保留
+	if h := TrimTurns(ms, 2); len(h) != 5 {
+		t.Fatalf("unexpected history %+v", h)
+	}
+	if h := TrimTurns(ms, 6); len(h) != len(ms) {
+		t.Fatalf("unexpected history %+v", h)
+	}
+
+	// 保存的历史不会被 max_size 删除
+	ctx := context.Background()
+	t.Cleanup(func() { _ = history.Delete(ctx, "trim-turns") })
+	_ = NewMemoryChatMemory("trim-turns", 0).AppendHistory(ctx, ms...)
+	if h, _ := NewMemoryChatMemory("trim-turns", 2).GetHistory(ctx); len(h) != 5 {
+		t.Fatalf("unexpected history %+v", h)
+	}
+	if h, _ := NewMemoryChatMemory("trim-turns", 0).GetHistory(ctx); len(h) != len(ms) {
+		t.Fatalf("history should not be trimmed on write, got %+v", h)
+	}
+}
@@ -0,0 +1,144 @@
+package util
+
+import (
+	"context"
+)
+
+// ChatStore 是按 session 保存历史的存储，StoreChatMemory 将它绑定到一个 session 上作为 ChatMemory 使用
+type ChatStore interface {
+	Load(ctx context.Context, sessionId string) (Messages, error)
+	// Append 原子地追加多条消息
+	Append(ctx context.Context, sessionId string, messages ...Message) error
+}
+
+// SessionStore 是可以管理 session 的 ChatStore，用于 chat_memory_list 等管理组件
+type SessionStore interface {
+	ChatStore
+	// ListSessions 返回所有有历史的 session
+	ListSessions(ctx context.Context) ([]string, error)
+	// Delete 删除 session 的全部历史，session 不存在时不返回错误
+	Delete(ctx context.Context, sessionId string) error
+	// Replace 原子地将 session 的历史替换为 messages
+	Replace(ctx context.Context, sessionId string, messages Messages) error
+	// CompareAndReplace 只在 session 的历史仍然是 n 条消息时将它替换为 messages，返回是否替换，
+	// 用于先读取再修改历史（如截断与重新生成），避免覆盖并发追加的消息
+	CompareAndReplace(ctx context.Context, sessionId string, n int, messages Messages) (bool, error)
+}
+
+// HistoryPager 由能在存储中分页读取历史的 ChatStore 实现（如 sqlite）
+type HistoryPager interface {
+	// History 按时间顺序返回一页历史，limit 为 0 表示不限制
+	History(ctx context.Context, sessionId string, offset, limit int) (Messages, error)
+}
+
+// SessionPager 由能在存储中分页列出 session 的 SessionStore 实现
+type SessionPager interface {
+	SessionPage(ctx context.Context, offset, limit int) ([]string, error)
+}
+
+// HistoryPage 返回 session 的一页历史，limit 为 0 表示不限制，没有实现 HistoryPager 的存储读取全部历史后截取
+func HistoryPage(ctx context.Context, store ChatStore, sessionId string, offset, limit int) (Messages, error) {
+	if p, ok := store.(HistoryPager); ok {
+		return p.History(ctx, sessionId, offset, limit)
+	}
+	ms, err := store.Load(ctx, sessionId)
+	if err != nil {
+		return nil, err
+	}
+	start, end := pageRange(len(ms), offset, limit)
+	return ms[start:end], nil
+}
+
+// SessionPage 返回一页 session id，limit 为 0 表示不限制，没有实现 SessionPager 的存储列出全部 session 后截取
+func SessionPage(ctx context.Context, store SessionStore, offset, limit int) ([]string, error) {
+	if p, ok := store.(SessionPager); ok {
+		return p.SessionPage(ctx, offset, limit)
+	}
+	ids, err := store.ListSessions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	start, end := pageRange(len(ids), offset, limit)
+	return ids[start:end], nil
+}
+
+func pageRange(n, offset, limit int) (int, int) {
+	start := offset
+	if start > n {
+		start = n
+	}
+	end := n
+	if limit > 0 && start+limit < n {
+		end = start + limit
+	}
+	return start, end
+}
+
+// SessionChatMemory 由绑定在某个 session 上的 ChatMemory 实现，管理组件通过它得到 session 与存储
+type SessionChatMemory interface {
+	ChatMemory
+	SessionId() string
+	Store() ChatStore
+}
+
+// ChatMemoryWrapper 由包装了其他 ChatMemory 的 ChatMemory 实现，如 TokenWindowChatMemory 与 SummaryChatMemory
+type ChatMemoryWrapper interface {
+	Unwrap() ChatMemory
+}
+
+// BaseChatMemory 逐层 Unwrap，返回最终保存历史的 ChatMemory
+func BaseChatMemory(m ChatMemory) ChatMemory {
+	for {
+		w, ok := m.(ChatMemoryWrapper)
+		if !ok {
+			return m
+		}
+		m = w.Unwrap()
+	}
+}
+
+// StoreChatMemory 是使用 ChatStore 保存历史的 ChatMemory
+type StoreChatMemory struct {
+	store     ChatStore
+	sessionId string
+	// maxSize 是读取时返回的最大消息数，0 表示不限制，保存的历史不会被删除
+	maxSize int
+}
+
+var _ SessionChatMemory = (*StoreChatMemory)(nil)
+
+func NewStoreChatMemory(store ChatStore, sessionId string, maxSize int) *StoreChatMemory {
+	return &StoreChatMemory{
+		store:     store,
+		sessionId: sessionId,
+		maxSize:   maxSize,
+	}
+}
+
+func (m *StoreChatMemory) SessionId() string {
+	return m.sessionId
+}
+
+func (m *StoreChatMemory) Store() ChatStore {
+	return m.store
+}
+
+func (m *StoreChatMemory) GetHistory(ctx context.Context) (Messages, error) {
+	if m.sessionId == "" {
+		return nil, nil
+	}
+
+	ms, err := m.store.Load(ctx, m.sessionId)
+	if err != nil {
+		return nil, err
+	}
+	return TrimTurns(ms, m.maxSize), nil
+}
+
+func (m *StoreChatMemory) AppendHistory(ctx context.Context, messages ...Message) error {
+	if m.sessionId == "" || len(messages) == 0 {
+		return nil
+	}
+
+	return m.store.Append(ctx, m.sessionId, messages...)
+}
@@ -0,0 +1,304 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FileChatStore 将每个 session 保存为 dir 下的一个 JSONL 文件，只追加不修改。
+// 每行是一条消息，或者是一次追加的多条消息组成的数组。
+//
+// 每次追加都是一行、一次 write 并且 fsync，进程崩溃时最多留下一行不完整的数据，
+// 读取时会忽略它，下次追加前会将它截断，所以一次追加的多条消息要么全部写入，要么都不写入。
+type FileChatStore struct {
+	dir string
+}
+
+var _ SessionStore = (*FileChatStore)(nil)
+
+// fileLocks 保证同一个文件在进程内不会被并发写，多个 FileChatStore 可以指向同一个目录
+var fileLocks = struct {
+	lock  sync.Mutex
+	files map[string]*sync.Mutex
+}{files: map[string]*sync.Mutex{}}
+
+func fileLock(path string) *sync.Mutex {
+	fileLocks.lock.Lock()
+	defer fileLocks.lock.Unlock()
+
+	l, ok := fileLocks.files[path]
+	if !ok {
+		l = &sync.Mutex{}
+		fileLocks.files[path] = l
+	}
+	return l
+}
+
+func NewFileChatStore(dir string) (*FileChatStore, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("dir is required")
+	}
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	return &FileChatStore{dir: dir}, nil
+}
+
+// path 返回 session 对应的文件，sessionId 会被转义，不能用来访问 dir 之外的文件
+func (s *FileChatStore) path(sessionId string) string {
+	return filepath.Join(s.dir, url.PathEscape(sessionId)+".jsonl")
+}
+
+func (s *FileChatStore) Load(ctx context.Context, sessionId string) (Messages, error) {
+	path := s.path(sessionId)
+	l := fileLock(path)
+	l.Lock()
+	defer l.Unlock()
+
+	return load(path)
+}
+
+// load 读取文件中的历史，调用方需要持有文件锁
+func load(path string) (Messages, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	// 最后一行没有换行符说明写入时崩溃了，忽略它
+	if i := bytes.LastIndexByte(bs, '\n'); i != len(bs)-1 {
+		bs = bs[:i+1]
+	}
+
+	var ms Messages
+	for n, line := range bytes.Split(bs, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] == '[' {
+			var batch Messages
+			err = json.Unmarshal(line, &batch)
+			if err != nil {
+				return nil, fmt.Errorf("decode %s line %d error: %w", path, n+1, err)
+			}
+			ms = append(ms, batch...)
+			continue
+		}
+
+		var m Message
+		err = json.Unmarshal(line, &m)
+		if err != nil {
+			return nil, fmt.Errorf("decode %s line %d error: %w", path, n+1, err)
+		}
+		ms = append(ms, m)
+	}
+	return ms, nil
+}
+
+func (s *FileChatStore) Append(ctx context.Context, sessionId string, messages ...Message) error {
+	var v interface{} = messages
+	switch len(messages) {
+	case 0:
+		return nil
+	case 1:
+		v = messages[0]
+	}
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	path := s.path(sessionId)
+	l := fileLock(path)
+	l.Lock()
+	defer l.Unlock()
+
+	_, err = os.Stat(path)
+	created := os.IsNotExist(err)
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	end, err := truncateTornLine(f)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(line, end)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+
+	// 新建的文件需要 fsync 目录才能保证崩溃后文件还在
+	if created {
+		return syncDir(s.dir)
+	}
+	return nil
+}
+
+func (s *FileChatStore) ListSessions(ctx context.Context) ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".jsonl") {
+			continue
+		}
+		id, err := url.PathUnescape(strings.TrimSuffix(name, ".jsonl"))
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (s *FileChatStore) Delete(ctx context.Context, sessionId string) error {
+	path := s.path(sessionId)
+	l := fileLock(path)
+	l.Lock()
+	defer l.Unlock()
+
+	return s.replace(path, nil)
+}
+
+// Replace 先写入临时文件再 rename，崩溃时文件要么是旧的历史，要么是新的历史。
+// messages 为空时删除文件，与 Delete 一样不再出现在 ListSessions 中
+func (s *FileChatStore) Replace(ctx context.Context, sessionId string, messages Messages) error {
+	path := s.path(sessionId)
+	l := fileLock(path)
+	l.Lock()
+	defer l.Unlock()
+
+	return s.replace(path, messages)
+}
+
+func (s *FileChatStore) CompareAndReplace(ctx context.Context, sessionId string, n int, messages Messages) (bool, error) {
+	path := s.path(sessionId)
+	l := fileLock(path)
+	l.Lock()
+	defer l.Unlock()
+
+	ms, err := load(path)
+	if err != nil {
+		return false, err
+	}
+	if len(ms) != n {
+		return false, nil
+	}
+	return true, s.replace(path, messages)
+}
+
+// replace 替换文件中的历史，调用方需要持有文件锁
+func (s *FileChatStore) replace(path string, messages Messages) error {
+	if len(messages) == 0 {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return syncDir(s.dir)
+	}
+
+	var buf bytes.Buffer
+	for _, m := range messages {
+		line, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	f, err := os.CreateTemp(s.dir, ".replace-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(f.Name(), path)
+	if err != nil {
+		return err
+	}
+	return syncDir(s.dir)
+}
+
+// truncateTornLine 删除文件末尾不完整的一行，返回文件的新长度
+func truncateTornLine(f *os.File) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+	if size == 0 {
+		return 0, nil
+	}
+
+	last := make([]byte, 1)
+	_, err = f.ReadAt(last, size-1)
+	if err != nil {
+		return 0, err
+	}
+	if last[0] == '\n' {
+		return size, nil
+	}
+
+	bs := make([]byte, size)
+	_, err = f.ReadAt(bs, 0)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	end := int64(bytes.LastIndexByte(bs, '\n') + 1)
+	err = f.Truncate(end)
+	if err != nil {
+		return 0, err
+	}
+	return end, nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	// 有些平台（如 Windows）不支持 fsync 目录，忽略错误
+	_ = d.Sync()
+	return nil
+}
@@ -0,0 +1,185 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestFileChatStore(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s, err := NewFileChatStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewStoreChatMemory(s, "user/1", 0)
+	err = m.AppendHistory(ctx, Message{Role: RoleUser, Content: "Weather?"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.AppendHistory(ctx, Message{Role: RoleAssistant, FunctionCall: &FunctionCall{Name: "get_weather", Arguments: `{"city":"Paris"}`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sessionId 被转义，不会创建子目录
+	if _, err := os.Stat(filepath.Join(dir, "user%2F1.jsonl")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重新打开后仍然可以读到历史
+	s2, err := NewFileChatStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewStoreChatMemory(s2, "user/1", 0).GetHistory(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h) != 2 || h[0].Content != "Weather?" || h[1].FunctionCall == nil || h[1].FunctionCall.Arguments != `{"city":"Paris"}` {
+		t.Fatalf("unexpected history %+v", h)
+	}
+
+	// max_size 按整轮截取，不会只返回 function_call
+	h, err = NewStoreChatMemory(s2, "user/1", 1).GetHistory(ctx)
+	if err != nil || len(h) != 2 || h[0].Role != RoleUser {
+		t.Fatalf("unexpected max size history %+v %v", h, err)
+	}
+
+	h, err = NewStoreChatMemory(s2, "other", 0).GetHistory(ctx)
+	if err != nil || len(h) != 0 {
+		t.Fatalf("unexpected empty history %+v %v", h, err)
+	}
+}
+
+func TestFileChatStoreTornWrite(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s, err := NewFileChatStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Append(ctx, "torn", Message{Role: RoleUser, Content: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟写入一半时崩溃
+	f, err := os.OpenFile(filepath.Join(dir, "torn.jsonl"), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString(`{"role":"assistant","cont`)
+	_ = f.Close()
+
+	h, err := s.Load(ctx, "torn")
+	if err != nil || len(h) != 1 || h[0].Content != "a" {
+		t.Fatalf("torn line should be ignored, got %+v %v", h, err)
+	}
+
+	err = s.Append(ctx, "torn", Message{Role: RoleAssistant, Content: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err = s.Load(ctx, "torn")
+	if err != nil || len(h) != 2 || h[1].Content != "b" {
+		t.Fatalf("unexpected history after repair %+v %v", h, err)
+	}
+}
+
+func TestFileChatStoreConcurrent(t *testing.T) {
+	ctx := context.Background()
+	s, err := NewFileChatStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sessionId := fmt.Sprintf("s%d", i%4)
+			for j := 0; j < 10; j++ {
+				if err := s.Append(ctx, sessionId, Message{Role: RoleUser, Content: fmt.Sprint(j)}); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < 4; i++ {
+		h, err := s.Load(ctx, fmt.Sprintf("s%d", i))
+		if err != nil || len(h) != 50 {
+			t.Fatalf("s%d: unexpected history len %d %v", i, len(h), err)
+		}
+	}
+}
+
+func TestFileChatStoreBatch(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s, err := NewFileChatStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Append(ctx, "batch", Message{Role: RoleUser, Content: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Append(ctx, "batch", Message{Role: RoleUser, Content: "b"}, Message{Role: RoleAssistant, Content: "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 写入一半的批量追加整个被忽略
+	f, err := os.OpenFile(filepath.Join(dir, "batch.jsonl"), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString(`[{"role":"user","content":"d"},{"role":"assi`)
+	_ = f.Close()
+
+	h, err := s.Load(ctx, "batch")
+	if err != nil || len(h) != 3 || h[1].Content != "b" || h[2].Content != "c" {
+		t.Fatalf("unexpected history %+v %v", h, err)
+	}
+}
+
+func TestFileChatStoreReplace(t *testing.T) {
+	ctx := context.Background()
+	s, err := NewFileChatStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"c", "a", "b"} {
+		err = s.Append(ctx, id, Message{Role: RoleUser, Content: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids, err := s.ListSessions(ctx)
+	if err != nil || strings.Join(ids, ",") != "a,b,c" {
+		t.Fatalf("unexpected sessions %v %v", ids, err)
+	}
+
+	// 替换为空的历史与 Delete 相同
+	err = s.Replace(ctx, "b", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err = s.ListSessions(ctx)
+	if err != nil || strings.Join(ids, ",") != "a,c" {
+		t.Fatalf("unexpected sessions %v %v", ids, err)
+	}
+}
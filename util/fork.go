@@ -0,0 +1,171 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrHistoryChanged 表示读取历史之后，历史被其他调用修改了
+var ErrHistoryChanged = errors.New("history was changed by another call")
+
+// maxReplaceRetries 是 Truncate 遇到并发修改时的最大重试次数
+const maxReplaceRetries = 3
+
+// ForkableChatMemory 是支持快照、截断与分叉的 ChatMemory，用于重新生成回复与从某一轮开始分叉对话
+type ForkableChatMemory interface {
+	ChatMemory
+	// Snapshot 返回完整历史的副本，不受 max_size 等读取限制的影响
+	Snapshot(ctx context.Context) (Messages, error)
+	// ReplaceHistory 在历史仍然是 n 条消息时将它替换为 messages，否则返回 ErrHistoryChanged
+	ReplaceHistory(ctx context.Context, n int, messages Messages) error
+	// Truncate 只保留前 n 条消息
+	Truncate(ctx context.Context, n int) error
+	// Fork 将前 n 条消息复制到 sessionId，返回绑定在新 session 上的 ChatMemory，n 小于 0 表示复制全部，
+	// sessionId 已经有历史时返回错误
+	Fork(ctx context.Context, sessionId string, n int) (ChatMemory, error)
+}
+
+var _ ForkableChatMemory = (*MemoryChatMemory)(nil)
+var _ ForkableChatMemory = (*StoreChatMemory)(nil)
+
+// TurnIndex 返回前 turn 轮对话的消息数，一轮从一条 user 消息开始，开头的 system 消息总是被包含
+func TurnIndex(ms Messages, turn int) int {
+	users := 0
+	for i, m := range ms {
+		if m.Role == RoleUser {
+			if users == turn {
+				return i
+			}
+			users++
+		}
+	}
+	return len(ms)
+}
+
+// LastTurnIndex 返回最后一条 user 消息的位置，没有时返回 -1
+func LastTurnIndex(ms Messages) int {
+	for i := len(ms) - 1; i >= 0; i-- {
+		if ms[i].Role == RoleUser {
+			return i
+		}
+	}
+	return -1
+}
+
+func sessionStoreOf(store ChatStore, op string) (SessionStore, error) {
+	s, ok := store.(SessionStore)
+	if !ok {
+		return nil, fmt.Errorf("store %T does not support %s", store, op)
+	}
+	return s, nil
+}
+
+func replaceSession(ctx context.Context, store ChatStore, sessionId string, n int, messages Messages) error {
+	s, err := sessionStoreOf(store, "replace")
+	if err != nil {
+		return err
+	}
+	ok, err := s.CompareAndReplace(ctx, sessionId, n, messages)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrHistoryChanged
+	}
+	return nil
+}
+
+// truncateSession 使用 CompareAndReplace 截断，读取之后被并发追加的消息不会丢失
+func truncateSession(ctx context.Context, store ChatStore, sessionId string, n int) error {
+	s, err := sessionStoreOf(store, "truncate")
+	if err != nil {
+		return err
+	}
+	for i := 0; i < maxReplaceRetries; i++ {
+		ms, err := s.Load(ctx, sessionId)
+		if err != nil {
+			return err
+		}
+		if n < 0 || n >= len(ms) {
+			return nil
+		}
+		ok, err := s.CompareAndReplace(ctx, sessionId, len(ms), ms[:n])
+		if err != nil || ok {
+			return err
+		}
+	}
+	return ErrHistoryChanged
+}
+
+func forkSession(ctx context.Context, store ChatStore, from, to string, n int) error {
+	if to == "" || to == from {
+		return fmt.Errorf("fork needs a new session id")
+	}
+	s, err := sessionStoreOf(store, "fork")
+	if err != nil {
+		return err
+	}
+	ms, err := s.Load(ctx, from)
+	if err != nil {
+		return err
+	}
+	if n >= 0 && n < len(ms) {
+		ms = ms[:n]
+	}
+	// 只写入空的 session，不覆盖已有的历史
+	ok, err := s.CompareAndReplace(ctx, to, 0, ms)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("session %s already has history", to)
+	}
+	return nil
+}
+
+func (m *MemoryChatMemory) Snapshot(ctx context.Context) (Messages, error) {
+	if m.sessionId == "" {
+		return nil, nil
+	}
+	return history.Load(ctx, m.sessionId)
+}
+
+func (m *MemoryChatMemory) ReplaceHistory(ctx context.Context, n int, messages Messages) error {
+	return replaceSession(ctx, history, m.sessionId, n, messages)
+}
+
+func (m *MemoryChatMemory) Truncate(ctx context.Context, n int) error {
+	return truncateSession(ctx, history, m.sessionId, n)
+}
+
+func (m *MemoryChatMemory) Fork(ctx context.Context, sessionId string, n int) (ChatMemory, error) {
+	err := forkSession(ctx, history, m.sessionId, sessionId, n)
+	if err != nil {
+		return nil, err
+	}
+	return NewMemoryChatMemory(sessionId, m.maxSize), nil
+}
+
+func (m *StoreChatMemory) Snapshot(ctx context.Context) (Messages, error) {
+	if m.sessionId == "" {
+		return nil, nil
+	}
+	return m.store.Load(ctx, m.sessionId)
+}
+
+func (m *StoreChatMemory) ReplaceHistory(ctx context.Context, n int, messages Messages) error {
+	return replaceSession(ctx, m.store, m.sessionId, n, messages)
+}
+
+func (m *StoreChatMemory) Truncate(ctx context.Context, n int) error {
+	return truncateSession(ctx, m.store, m.sessionId, n)
+}
+
+func (m *StoreChatMemory) Fork(ctx context.Context, sessionId string, n int) (ChatMemory, error) {
+	err := forkSession(ctx, m.store, m.sessionId, sessionId, n)
+	if err != nil {
+		return nil, err
+	}
+	return NewStoreChatMemory(m.store, sessionId, m.maxSize), nil
+}
@@ -0,0 +1,81 @@
+package util
+
+import (
+	"context"
+	"testing"
+)
+
+func TestForkAndTruncate(t *testing.T) {
+	ctx := context.Background()
+	ms := Messages{
+		{Role: RoleSystem, Content: "sys"},
+		{Role: RoleUser, Content: "q1"},
+		{Role: RoleAssistant, Content: "a1"},
+		{Role: RoleUser, Content: "q2"},
+		{Role: RoleAssistant, FunctionCall: &FunctionCall{Name: "f"}},
+		{Role: RoleFunction, Name: "f", Content: "r"},
+		{Role: RoleAssistant, Content: "a2"},
+	}
+	if n := TurnIndex(ms, 0); n != 1 {
+		t.Errorf("turn 0: %d", n)
+	}
+	if n := TurnIndex(ms, 1); n != 3 {
+		t.Errorf("turn 1: %d", n)
+	}
+	if n := TurnIndex(ms, 5); n != len(ms) {
+		t.Errorf("turn 5: %d", n)
+	}
+	if n := LastTurnIndex(ms); n != 3 {
+		t.Errorf("last turn: %d", n)
+	}
+
+	s, err := NewFileChatStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 进程内的历史是全局的，测试结束时删除
+	t.Cleanup(func() {
+		_ = history.Delete(ctx, "fork-a")
+		_ = history.Delete(ctx, "fork-b")
+	})
+	for _, m := range []ForkableChatMemory{NewMemoryChatMemory("fork-a", 0), NewStoreChatMemory(s, "fork-a", 0)} {
+		_ = m.AppendHistory(ctx, ms...)
+
+		forked, err := m.Fork(ctx, "fork-b", TurnIndex(ms, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, _ := forked.GetHistory(ctx)
+		if len(h) != 3 || h[2].Content != "a1" {
+			t.Fatalf("%T: unexpected forked history %+v", m, h)
+		}
+		// 分叉后互不影响
+		_ = forked.AppendHistory(ctx, Message{Role: RoleUser, Content: "q2'"})
+		if h, _ = m.Snapshot(ctx); len(h) != len(ms) {
+			t.Fatalf("%T: source should not be changed, got %+v", m, h)
+		}
+
+		if _, err = m.Fork(ctx, "fork-a", -1); err == nil {
+			t.Errorf("%T: fork to the same session should fail", m)
+		}
+		if _, err = m.Fork(ctx, "fork-b", -1); err == nil {
+			t.Errorf("%T: fork to a session with history should fail", m)
+		}
+
+		// 历史与读取时的长度不同时不替换
+		if err = m.ReplaceHistory(ctx, len(ms)-1, nil); err != ErrHistoryChanged {
+			t.Errorf("%T: unexpected error %v", m, err)
+		}
+		if h, _ = m.Snapshot(ctx); len(h) != len(ms) {
+			t.Fatalf("%T: history should not be replaced, got %+v", m, h)
+		}
+
+		err = m.Truncate(ctx, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h, _ = m.GetHistory(ctx); len(h) != 3 {
+			t.Fatalf("%T: unexpected truncated history %+v", m, h)
+		}
+	}
+}
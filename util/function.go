@@ -0,0 +1,145 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// functionName 是 OpenAI 对函数名的要求
+var functionName = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+var schemaTypes = map[string]bool{
+	"object":  true,
+	"string":  true,
+	"number":  true,
+	"integer": true,
+	"boolean": true,
+	"array":   true,
+	"null":    true,
+}
+
+// jsonSchema 是校验函数参数时需要读取的 JSON Schema 字段，发送给 SDK 的仍然是原始的 JSON。
+// type 可以是字符串或字符串数组（如 ["string","null"]），enum 的值可以是任意类型，所以保留原始值
+type jsonSchema struct {
+	Type        json.RawMessage        `json:"type,omitempty"`
+	Description string                 `json:"description,omitempty"`
+	Enum        []interface{}          `json:"enum,omitempty"`
+	Properties  map[string]*jsonSchema `json:"properties,omitempty"`
+	Required    []string               `json:"required,omitempty"`
+	Items       *jsonSchema            `json:"items,omitempty"`
+}
+
+// schemaType 返回只有一个类型的 type 字段
+func schemaType(typ string) json.RawMessage {
+	bs, _ := json.Marshal(typ)
+	return bs
+}
+
+// types 返回 type 中的所有类型，没有 type 时返回空
+func (s *jsonSchema) types() ([]string, error) {
+	if len(s.Type) == 0 {
+		return nil, nil
+	}
+	var typ string
+	if json.Unmarshal(s.Type, &typ) == nil {
+		return []string{typ}, nil
+	}
+	var types []string
+	if json.Unmarshal(s.Type, &types) == nil {
+		return types, nil
+	}
+	return nil, fmt.Errorf("type must be a string or a list of string, got %s", s.Type)
+}
+
+func (s *jsonSchema) validate(path string) error {
+	types, err := s.types()
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for _, typ := range types {
+		if !schemaTypes[typ] {
+			return fmt.Errorf("%s: unsupported type %q", path, typ)
+		}
+	}
+	for _, r := range s.Required {
+		if _, ok := s.Properties[r]; !ok {
+			return fmt.Errorf("%s: required property %s is not defined", path, r)
+		}
+	}
+	for name, p := range s.Properties {
+		if p == nil {
+			return fmt.Errorf("%s.%s: schema is null", path, name)
+		}
+		err := p.validate(path + "." + name)
+		if err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		return s.Items.validate(path + "[]")
+	}
+	return nil
+}
+
+// ValidateFunction 检查函数名与参数，参数需要是 type 为 object 的 JSON Schema，
+// 这样错误在定义函数时就能发现，而不是在 SDK 发送请求时
+func ValidateFunction(f FunctionDefine) error {
+	if !functionName.MatchString(f.Name) {
+		return fmt.Errorf("invalid function name %q, it must be 1-64 letters, digits, _ or -", f.Name)
+	}
+	if len(f.Parameters) == 0 {
+		return nil
+	}
+
+	var s jsonSchema
+	err := json.Unmarshal(f.Parameters, &s)
+	if err != nil {
+		return fmt.Errorf("invalid parameters of function %s: %w", f.Name, err)
+	}
+	if types, _ := s.types(); len(types) != 1 || types[0] != "object" {
+		return fmt.Errorf("invalid parameters of function %s: type must be object, got %s", f.Name, s.Type)
+	}
+	err = s.validate("parameters")
+	if err != nil {
+		return fmt.Errorf("invalid parameters of function %s: %w", f.Name, err)
+	}
+	return nil
+}
+
+// ParsePropertyRows 将参数行转换为 JSON Schema，每行是 "名称 类型 [required] 描述"，如：
+//
+//	city string required 城市名
+//	days integer 预报的天数
+func ParsePropertyRows(rows string) (json.RawMessage, error) {
+	s := jsonSchema{Type: schemaType("object"), Properties: map[string]*jsonSchema{}}
+	for n, line := range strings.Split(rows, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: expect \"name type [required] description\", got %q", n+1, line)
+		}
+		name, typ := fields[0], fields[1]
+		if !schemaTypes[typ] {
+			return nil, fmt.Errorf("line %d: unsupported type %q", n+1, typ)
+		}
+		if _, ok := s.Properties[name]; ok {
+			return nil, fmt.Errorf("line %d: property %s is defined more than once", n+1, name)
+		}
+		fields = fields[2:]
+		if len(fields) != 0 && fields[0] == "required" {
+			s.Required = append(s.Required, name)
+			fields = fields[1:]
+		}
+		s.Properties[name] = &jsonSchema{Type: schemaType(typ), Description: strings.Join(fields, " ")}
+	}
+
+	bs, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	return bs, nil
+}
@@ -0,0 +1,64 @@
+package util
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestValidateFunction(t *testing.T) {
+	for _, c := range []struct {
+		f   FunctionDefine
+		err string
+	}{
+		{f: FunctionDefine{Name: "get_weather"}},
+		{f: FunctionDefine{Name: "get_weather", Parameters: json.RawMessage(`{"type":"object","properties":{"city":{"type":"string","enum":["Paris"]}},"required":["city"]}`)}},
+		{f: FunctionDefine{Name: "f", Parameters: json.RawMessage(`{"type":"object","properties":{"n":{"type":"integer","enum":[1,2]},"s":{"type":["string","null"]}}}`)}},
+		{f: FunctionDefine{Name: "get weather"}, err: "invalid function name"},
+		{f: FunctionDefine{Name: "f", Parameters: json.RawMessage(`{"type":"string"}`)}, err: "type must be object"},
+		{f: FunctionDefine{Name: "f", Parameters: json.RawMessage(`{"type":"object","properties":{"a":{"type":"text"}}}`)}, err: "parameters.a: unsupported type"},
+		{f: FunctionDefine{Name: "f", Parameters: json.RawMessage(`{"type":"object","properties":{"a":{"type":["string","text"]}}}`)}, err: "parameters.a: unsupported type"},
+		{f: FunctionDefine{Name: "f", Parameters: json.RawMessage(`{"type":"object","properties":{"a":{"type":1}}}`)}, err: "type must be a string or a list of string"},
+		{f: FunctionDefine{Name: "f", Parameters: json.RawMessage(`{"type":"object","required":["a"]}`)}, err: "required property a"},
+	} {
+		err := ValidateFunction(c.f)
+		if c.err == "" && err != nil || c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Errorf("%s %s: expect error %q, got %v", c.f.Name, c.f.Parameters, c.err, err)
+		}
+	}
+}
+
+func TestParsePropertyRows(t *testing.T) {
+	s, err := ParsePropertyRows("city string required 城市 名\n\n  days integer\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := `{"type":"object","properties":{"city":{"type":"string","description":"城市 名"},"days":{"type":"integer"}},"required":["city"]}`
+	if string(s) != expect {
+		t.Errorf("unexpected schema %s", s)
+	}
+
+	for _, rows := range []string{"city", "city text", "a string\na number"} {
+		if _, err = ParsePropertyRows(rows); err == nil {
+			t.Errorf("%q should be invalid", rows)
+		}
+	}
+}
+
+func TestParseFunctions(t *testing.T) {
+	fs, err := ParseFunctions([]interface{}{
+		FunctionDefine{Name: "a"},
+		`[{"name":"b"},{"name":"c"}]`,
+		nil,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fs) != 3 || fs[0].Name != "a" || fs[2].Name != "c" {
+		t.Errorf("unexpected functions %+v", fs)
+	}
+
+	if _, err = ParseFunctions(`[{"name":"b","parameters":{"type":"array"}}]`); err == nil {
+		t.Errorf("invalid parameters should be an error")
+	}
+}
@@ -0,0 +1,103 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// LLM 是 langchain/llm 锚点上传递的值，屏蔽不同 SDK 的差异，langchain_call 只依赖这个接口。
+type LLM interface {
+	ChatCompletion(ctx context.Context, req ChatRequest) (ChatResponse, error)
+	// ChatCompletionStream 返回的 StreamResponse 会在上游结束时被关闭，只有 Capabilities().Stream 为 true 时可用
+	ChatCompletionStream(ctx context.Context, req ChatRequest) (*StreamResponse, error)
+	Embedding(ctx context.Context, req EmbeddingRequest) ([][]float32, error)
+	Capabilities() Capabilities
+}
+
+// ContextWindower 由知道自己上下文长度的 LLM 实现，如 Ollama 的 num_ctx，
+// 没有实现时按 langchain_call 选择的模型查表（见 ContextWindow）
+type ContextWindower interface {
+	ContextWindow() int
+}
+
+// Capabilities 描述 LLM 支持的功能
+type Capabilities struct {
+	Stream    bool
+	Functions bool
+	Embedding bool
+}
+
+type ChatRequest struct {
+	ChatOptions
+	Messages  Messages
+	Functions []FunctionDefine
+}
+
+type ChatResponse struct {
+	Message      Message
+	FinishReason string
+	Usage        Usage
+}
+
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+const DefaultEmbeddingModel = "text-embedding-ada-002"
+
+type EmbeddingRequest struct {
+	Model string
+	Input []string
+	User  string
+}
+
+// FunctionDefine is a function which the model is allowed to call, Parameters is a JSON Schema object.
+type FunctionDefine struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters"`
+}
+
+// ParseFunctions reads the functions param of langchain_call, it is a JSON array of FunctionDefine,
+// a FunctionDefine from function_define, or a list of them. Every function is validated.
+func ParseFunctions(v interface{}) ([]FunctionDefine, error) {
+	var functions []FunctionDefine
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		if v == "" {
+			return nil, nil
+		}
+		err := json.Unmarshal([]byte(v), &functions)
+		if err != nil {
+			return nil, fmt.Errorf("invalid functions: %w", err)
+		}
+	case FunctionDefine:
+		functions = []FunctionDefine{v}
+	case []FunctionDefine:
+		functions = v
+	case []interface{}:
+		for _, i := range v {
+			fs, err := ParseFunctions(i)
+			if err != nil {
+				return nil, err
+			}
+			functions = append(functions, fs...)
+		}
+		return functions, nil
+	default:
+		return nil, fmt.Errorf("functions must be a JSON string or function defines, got %T", v)
+	}
+
+	for _, f := range functions {
+		err := ValidateFunction(f)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return functions, nil
+}
@@ -0,0 +1,71 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// fakeLLM 是 util 测试共用的 LLM，记录每次请求。
+// ChatCompletion 按顺序返回 replies，用完后返回 "summary N"（N 是请求的次数）；
+// Embedding 的每一维是 keywords 中的关键词是否出现，最后一维是常数，避免零向量
+type fakeLLM struct {
+	replies  Messages
+	keywords []string
+	err      error
+
+	reqs []ChatRequest
+	// inputs 是计算过 embedding 的文本数，batch 是一次请求中最多的文本数
+	inputs int
+	batch  int
+}
+
+var _ LLM = (*fakeLLM)(nil)
+
+func (l *fakeLLM) ChatCompletion(ctx context.Context, req ChatRequest) (ChatResponse, error) {
+	l.reqs = append(l.reqs, req)
+	if l.err != nil {
+		return ChatResponse{}, l.err
+	}
+	if len(l.replies) != 0 {
+		m := l.replies[0]
+		l.replies = l.replies[1:]
+		return ChatResponse{Message: m}, nil
+	}
+	return ChatResponse{Message: Message{Role: RoleAssistant, Content: fmt.Sprintf("summary %d", len(l.reqs))}}, nil
+}
+
+func (l *fakeLLM) ChatCompletionStream(ctx context.Context, req ChatRequest) (*StreamResponse, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+func (l *fakeLLM) Embedding(ctx context.Context, req EmbeddingRequest) ([][]float32, error) {
+	if l.err != nil {
+		return nil, l.err
+	}
+	if len(req.Input) > l.batch {
+		l.batch = len(req.Input)
+	}
+	var r [][]float32
+	for _, text := range req.Input {
+		l.inputs++
+		v := make([]float32, len(l.keywords)+1)
+		v[len(l.keywords)] = 0.1
+		for i, k := range l.keywords {
+			if strings.Contains(text, k) {
+				v[i] = 1
+			}
+		}
+		r = append(r, v)
+	}
+	return r, nil
+}
+
+func (l *fakeLLM) Capabilities() Capabilities {
+	return Capabilities{Embedding: true, Functions: true}
+}
+
+// prompt 返回请求的第一条消息，如生成摘要的 prompt
+func prompt(req ChatRequest) string {
+	return req.Messages[0].Content
+}
@@ -0,0 +1,181 @@
+package util
+
+import (
+	"fmt"
+	"github.com/spf13/cast"
+	"math"
+	"strings"
+)
+
+// ChatModels 是 langchain_call 中 model 下拉框的可选项
+var ChatModels = []string{
+	"gpt-3.5-turbo",
+	"gpt-3.5-turbo-16k",
+	"gpt-3.5-turbo-0613",
+	"gpt-3.5-turbo-16k-0613",
+	"gpt-4",
+	"gpt-4-0613",
+	"gpt-4-32k",
+	"gpt-4-32k-0613",
+	"claude-3-5-sonnet-latest",
+	"claude-3-5-haiku-latest",
+	"claude-3-opus-latest",
+}
+
+const (
+	DefaultChatModel   = "gpt-3.5-turbo"
+	DefaultMaxTokens   = 2000
+	DefaultTemperature = 1
+	DefaultTopP        = 1
+)
+
+// ChatOptions 是调用对话模型时的模型与采样参数
+type ChatOptions struct {
+	Model            string
+	MaxTokens        int
+	Temperature      float32
+	TopP             float32
+	Stop             []string
+	PresencePenalty  float32
+	FrequencyPenalty float32
+	LogitBias        map[string]int
+	User             string
+}
+
+func DefaultChatOptions() ChatOptions {
+	return ChatOptions{
+		Model:       DefaultChatModel,
+		MaxTokens:   DefaultMaxTokens,
+		Temperature: DefaultTemperature,
+		TopP:        DefaultTopP,
+	}
+}
+
+// ParseChatOptions 读取 langchain_call 的模型与采样参数，未填写的参数使用 DefaultChatOptions
+func ParseChatOptions(params map[string]interface{}) (o ChatOptions, err error) {
+	o = DefaultChatOptions()
+
+	if v := cast.ToString(params["model"]); v != "" {
+		o.Model = v
+	}
+	if v := params["max_tokens"]; !isEmptyParam(v) {
+		o.MaxTokens, err = cast.ToIntE(v)
+		if err != nil {
+			return o, fmt.Errorf("invalid max_tokens: %w", err)
+		}
+		if o.MaxTokens < 0 {
+			return o, fmt.Errorf("max_tokens must be >= 0, got %d", o.MaxTokens)
+		}
+	}
+	if v := params["temperature"]; !isEmptyParam(v) {
+		o.Temperature, err = cast.ToFloat32E(v)
+		if err != nil {
+			return o, fmt.Errorf("invalid temperature: %w", err)
+		}
+		if o.Temperature < 0 || o.Temperature > 2 {
+			return o, fmt.Errorf("temperature must be between 0 and 2, got %v", o.Temperature)
+		}
+	}
+	if v := params["top_p"]; !isEmptyParam(v) {
+		o.TopP, err = cast.ToFloat32E(v)
+		if err != nil {
+			return o, fmt.Errorf("invalid top_p: %w", err)
+		}
+		if o.TopP < 0 || o.TopP > 1 {
+			return o, fmt.Errorf("top_p must be between 0 and 1, got %v", o.TopP)
+		}
+	}
+	if v := params["presence_penalty"]; !isEmptyParam(v) {
+		o.PresencePenalty, err = cast.ToFloat32E(v)
+		if err != nil {
+			return o, fmt.Errorf("invalid presence_penalty: %w", err)
+		}
+		if o.PresencePenalty < -2 || o.PresencePenalty > 2 {
+			return o, fmt.Errorf("presence_penalty must be between -2 and 2, got %v", o.PresencePenalty)
+		}
+	}
+	if v := params["frequency_penalty"]; !isEmptyParam(v) {
+		o.FrequencyPenalty, err = cast.ToFloat32E(v)
+		if err != nil {
+			return o, fmt.Errorf("invalid frequency_penalty: %w", err)
+		}
+		if o.FrequencyPenalty < -2 || o.FrequencyPenalty > 2 {
+			return o, fmt.Errorf("frequency_penalty must be between -2 and 2, got %v", o.FrequencyPenalty)
+		}
+	}
+
+	o.Stop, err = parseStop(params["stop"])
+	if err != nil {
+		return o, err
+	}
+
+	if v := params["logit_bias"]; !isEmptyParam(v) {
+		o.LogitBias, err = cast.ToStringMapIntE(v)
+		if err != nil {
+			return o, fmt.Errorf("invalid logit_bias: %w", err)
+		}
+		for token, bias := range o.LogitBias {
+			if bias < -100 || bias > 100 {
+				return o, fmt.Errorf("logit_bias of token %s must be between -100 and 100, got %d", token, bias)
+			}
+		}
+	}
+
+	o.User = cast.ToString(params["user"])
+
+	return o, nil
+}
+
+// ChatModel 用于 OpenAI 的请求，model 为空（如 summary_memory 没有选择模型）时使用 DefaultChatModel
+func ChatModel(model string) string {
+	if model == "" {
+		return DefaultChatModel
+	}
+	return model
+}
+
+// KeepZero 用于 OpenAI SDK 中带有 omitempty 的 temperature 与 top_p，
+// 0 会被 omitempty 忽略而使用 API 的默认值 1，所以用最小的正数代替 0，效果与 0 相同
+func KeepZero(v float32) float32 {
+	if v == 0 {
+		return math.SmallestNonzeroFloat32
+	}
+	return v
+}
+
+// parseStop 支持一行一个的字符串或者字符串数组，最多 4 个
+func parseStop(v interface{}) ([]string, error) {
+	var stop []string
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		for _, s := range strings.Split(v, "\n") {
+			if s != "" {
+				stop = append(stop, s)
+			}
+		}
+	default:
+		s, err := cast.ToStringSliceE(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid stop: %w", err)
+		}
+		stop = s
+	}
+
+	if len(stop) > 4 {
+		return nil, fmt.Errorf("stop supports up to 4 sequences, got %d", len(stop))
+	}
+	return stop, nil
+}
+
+// isEmptyParam 判断未填写的参数，前端未填写的数字输入框会传入空字符串
+func isEmptyParam(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	if s, ok := v.(string); ok && strings.TrimSpace(s) == "" {
+		return true
+	}
+	return false
+}
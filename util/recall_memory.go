@@ -0,0 +1,275 @@
+package util
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	DefaultRecallRecent = 4
+	DefaultRecallTopK   = 3
+)
+
+// maxEmbeddingText 是一轮对话用于计算 embedding 的最大字符数，避免超出 embedding 模型的输入长度
+const maxEmbeddingText = 8000
+
+// maxEmbeddingBatch 是一次 Embedding 请求的最大文本数，很长的历史分多次请求，避免超出请求的大小限制
+const maxEmbeddingBatch = 64
+
+// maxEmbeddingCache 是缓存的最大数量，超过时清空缓存，避免内存无限增长
+const maxEmbeddingCache = 10000
+
+// embeddingCache 以 LLM 的类型、模型与文本的 hash 为 key 缓存 embedding，所有 RecallChatMemory 共享，历史不变时不会重复计算
+var embeddingCache = struct {
+	lock sync.Mutex
+	m    map[string][]float32
+}{m: map[string][]float32{}}
+
+// RecallChatMemory 返回最近的 recent 轮对话，以及更早的对话中与本次输入最相似的 topK 轮，
+// 这样很长的对话也能回忆起很早之前的内容，而不需要发送全部历史。
+type RecallChatMemory struct {
+	memory ChatMemory
+	llm    LLM
+	// model 为空时由 llm 选择默认的 embedding 模型
+	model  string
+	recent int
+	topK   int
+}
+
+var _ HistoryWindower = (*RecallChatMemory)(nil)
+var _ ChatMemoryWrapper = (*RecallChatMemory)(nil)
+
+func NewRecallChatMemory(memory ChatMemory, llm LLM, model string, recent, topK int) *RecallChatMemory {
+	if recent <= 0 {
+		recent = DefaultRecallRecent
+	}
+	if topK < 0 {
+		topK = DefaultRecallTopK
+	}
+	return &RecallChatMemory{
+		memory: memory,
+		llm:    llm,
+		model:  model,
+		recent: recent,
+		topK:   topK,
+	}
+}
+
+func (m *RecallChatMemory) Unwrap() ChatMemory {
+	return m.memory
+}
+
+// AppendHistory 追加消息，并为离开最近 recent 轮的对话计算 embedding，这样读取时通常只需要计算输入的 embedding。
+// embedding 只是缓存，计算失败时不返回错误，缺少的 embedding 在下次追加或者读取时重新计算
+func (m *RecallChatMemory) AppendHistory(ctx context.Context, messages ...Message) error {
+	err := m.memory.AppendHistory(ctx, messages...)
+	if err != nil {
+		return err
+	}
+
+	_ = m.embedOlder(ctx)
+	return nil
+}
+
+// embedOlder 为最近 recent 轮之前的对话计算 embedding，已经缓存的不会重复计算
+func (m *RecallChatMemory) embedOlder(ctx context.Context) error {
+	if m.topK == 0 {
+		return nil
+	}
+	ms, err := m.memory.GetHistory(ctx)
+	if err != nil {
+		return err
+	}
+	_, turns := splitTurns(ms)
+	if len(turns) <= m.recent {
+		return nil
+	}
+	older := turns[:len(turns)-m.recent]
+	texts := make([]string, len(older))
+	for i, t := range older {
+		texts[i] = turnText(t)
+	}
+	_, err = m.embed(ctx, texts, false)
+	if err != nil {
+		return fmt.Errorf("embed history error: %w", err)
+	}
+	return nil
+}
+
+// GetHistory 没有输入可以比较，只返回最近的对话
+func (m *RecallChatMemory) GetHistory(ctx context.Context) (Messages, error) {
+	return m.GetHistoryWindow(ctx, HistoryQuery{})
+}
+
+func (m *RecallChatMemory) GetHistoryWindow(ctx context.Context, q HistoryQuery) (Messages, error) {
+	ms, err := m.memory.GetHistory(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pinned, turns := splitTurns(ms)
+	older := Messages(nil)
+	if len(turns) > m.recent {
+		var recalled []Messages
+		if q.Prompt != "" && m.topK > 0 {
+			recalled, err = m.recall(ctx, q.Prompt, turns[:len(turns)-m.recent])
+			if err != nil {
+				return nil, fmt.Errorf("recall error: %w", err)
+			}
+		}
+		for _, t := range recalled {
+			older = append(older, t...)
+		}
+		turns = turns[len(turns)-m.recent:]
+	}
+
+	r := append(append(Messages(nil), pinned...), older...)
+	for _, t := range turns {
+		r = append(r, t...)
+	}
+	if q.TokenBudget > 0 {
+		r = TrimMessages(r, q.TokenBudget)
+	}
+	return r, nil
+}
+
+// recall 返回与 prompt 最相似的 topK 轮对话，保持原来的顺序
+func (m *RecallChatMemory) recall(ctx context.Context, prompt string, turns []Messages) ([]Messages, error) {
+	texts := make([]string, len(turns)+1)
+	texts[0] = prompt
+	for i, t := range turns {
+		texts[i+1] = turnText(t)
+	}
+	vectors, err := m.embed(ctx, texts, true)
+	if err != nil {
+		return nil, err
+	}
+
+	type scored struct {
+		index int
+		score float64
+	}
+	scores := make([]scored, len(turns))
+	for i := range turns {
+		scores[i] = scored{index: i, score: cosine(vectors[0], vectors[i+1])}
+	}
+	sort.SliceStable(scores, func(i, j int) bool { return scores[i].score > scores[j].score })
+	if len(scores) > m.topK {
+		scores = scores[:m.topK]
+	}
+	sort.Slice(scores, func(i, j int) bool { return scores[i].index < scores[j].index })
+
+	r := make([]Messages, len(scores))
+	for i, s := range scores {
+		r[i] = turns[s.index]
+	}
+	return r, nil
+}
+
+// embed 返回 texts 的 embedding，只为缓存中没有的文本调用 Embedding，每次最多 maxEmbeddingBatch 个。
+// withPrompt 为 true 时 texts[0] 是本次的输入，很少会重复，不缓存
+func (m *RecallChatMemory) embed(ctx context.Context, texts []string, withPrompt bool) ([][]float32, error) {
+	keys := make([]string, len(texts))
+	vectors := make([][]float32, len(texts))
+	var missing []string
+	var missingIndex []int
+
+	embeddingCache.lock.Lock()
+	for i, text := range texts {
+		h := sha256.Sum256([]byte(text))
+		keys[i] = m.cacheKey(h[:])
+		if v, ok := embeddingCache.m[keys[i]]; ok {
+			vectors[i] = v
+		} else {
+			missing = append(missing, text)
+			missingIndex = append(missingIndex, i)
+		}
+	}
+	embeddingCache.lock.Unlock()
+
+	for start := 0; start < len(missing); start += maxEmbeddingBatch {
+		end := start + maxEmbeddingBatch
+		if end > len(missing) {
+			end = len(missing)
+		}
+		rsp, err := m.llm.Embedding(ctx, EmbeddingRequest{Model: m.model, Input: missing[start:end]})
+		if err != nil {
+			return nil, err
+		}
+		if len(rsp) != end-start {
+			return nil, fmt.Errorf("expect %d embeddings, got %d", end-start, len(rsp))
+		}
+
+		embeddingCache.lock.Lock()
+		if len(embeddingCache.m)+len(rsp) > maxEmbeddingCache {
+			embeddingCache.m = map[string][]float32{}
+		}
+		for i, v := range rsp {
+			index := missingIndex[start+i]
+			vectors[index] = v
+			if !withPrompt || index != 0 {
+				embeddingCache.m[keys[index]] = v
+			}
+		}
+		embeddingCache.lock.Unlock()
+	}
+	return vectors, nil
+}
+
+// cacheKey 包含 llm 的类型，model 为空时不同的 llm 可能使用不同的默认模型
+func (m *RecallChatMemory) cacheKey(hash []byte) string {
+	return fmt.Sprintf("%T:%s:%s", m.llm, m.model, hex.EncodeToString(hash))
+}
+
+// splitTurns 将历史分为开头的 system 消息与每一轮对话，一轮从一条 user 消息开始
+func splitTurns(ms Messages) (Messages, []Messages) {
+	first := TurnIndex(ms, 0)
+	pinned := ms[:first]
+
+	var turns []Messages
+	for i, msg := range ms[first:] {
+		if msg.Role == RoleUser || i == 0 {
+			turns = append(turns, nil)
+		}
+		turns[len(turns)-1] = append(turns[len(turns)-1], msg)
+	}
+	return pinned, turns
+}
+
+func turnText(t Messages) string {
+	var b strings.Builder
+	for _, m := range t {
+		content := m.Content
+		if m.FunctionCall != nil {
+			content = m.FunctionCall.Name + "(" + m.FunctionCall.Arguments + ")"
+		}
+		fmt.Fprintf(&b, "%s: %s\n", m.Role, content)
+	}
+	s := b.String()
+	if len(s) > maxEmbeddingText {
+		s = strings.ToValidUTF8(s[:maxEmbeddingText], "")
+	}
+	return s
+}
+
+func cosine(a, b []float32) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
@@ -0,0 +1,107 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestRecallChatMemory(t *testing.T) {
+	ctx := context.Background()
+	inner := NewMemoryChatMemory("recall", 0)
+	_ = inner.AppendHistory(ctx, Message{Role: RoleSystem, Content: "You are a bot."})
+	for i := 0; i < 20; i++ {
+		q := fmt.Sprintf("chat %d", i)
+		switch i {
+		case 3:
+			q = "my cat is called Tom"
+		case 7:
+			q = "I live in Paris"
+		}
+		_ = inner.AppendHistory(ctx, Message{Role: RoleUser, Content: q}, Message{Role: RoleAssistant, Content: "ok"})
+	}
+
+	llm := &fakeLLM{keywords: []string{"cat", "Paris"}}
+	m := NewRecallChatMemory(inner, llm, "test-embedding", 2, 1)
+
+	h, err := m.GetHistoryWindow(ctx, HistoryQuery{Prompt: "What is the name of my cat?"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var contents []string
+	for _, msg := range h {
+		contents = append(contents, msg.Content)
+	}
+	expect := "You are a bot.|my cat is called Tom|ok|chat 18|ok|chat 19|ok"
+	if strings.Join(contents, "|") != expect {
+		t.Fatalf("unexpected history %q", contents)
+	}
+
+	// 历史的 embedding 被缓存，只需要计算新的 prompt
+	inputs := llm.inputs
+	h, err = m.GetHistoryWindow(ctx, HistoryQuery{Prompt: "Where do I live? Paris?"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if llm.inputs != inputs+1 {
+		t.Errorf("expect 1 new embedding, got %d", llm.inputs-inputs)
+	}
+	if h[1].Content != "I live in Paris" {
+		t.Errorf("unexpected recalled turn %+v", h[1])
+	}
+
+	if h, _ = m.GetHistory(ctx); len(h) != 5 {
+		t.Errorf("GetHistory should return pinned and recent turns, got %+v", h)
+	}
+}
+
+func TestRecallChatMemoryAppend(t *testing.T) {
+	ctx := context.Background()
+	inner := NewMemoryChatMemory("recall-append", 0)
+	t.Cleanup(func() { _ = history.Delete(ctx, "recall-append") })
+	for i := 0; i < 100; i++ {
+		_ = inner.AppendHistory(ctx, Message{Role: RoleUser, Content: fmt.Sprintf("old %d", i)}, Message{Role: RoleAssistant, Content: "ok"})
+	}
+
+	// 追加时计算离开最近对话的 embedding，很长的历史分批计算
+	llm := &fakeLLM{keywords: []string{"cat"}}
+	m := NewRecallChatMemory(inner, llm, "test-embedding-append", 2, 1)
+	err := m.AppendHistory(ctx, Message{Role: RoleUser, Content: "my cat is called Tom"}, Message{Role: RoleAssistant, Content: "ok"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if llm.inputs != 99 || llm.batch > maxEmbeddingBatch {
+		t.Fatalf("unexpected embeddings %d, batch %d", llm.inputs, llm.batch)
+	}
+	for i := 0; i < 2; i++ {
+		_ = m.AppendHistory(ctx, Message{Role: RoleUser, Content: fmt.Sprintf("new %d", i)}, Message{Role: RoleAssistant, Content: "ok"})
+	}
+	if llm.inputs != 101 {
+		t.Fatalf("only the turns leaving the recent window should be embedded, got %d", llm.inputs)
+	}
+
+	// 读取时只需要计算输入的 embedding
+	h, err := m.GetHistoryWindow(ctx, HistoryQuery{Prompt: "my cat?"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if llm.inputs != 102 || h[0].Content != "my cat is called Tom" {
+		t.Fatalf("unexpected embeddings %d, history %+v", llm.inputs, h)
+	}
+
+	// embedding 失败不影响保存，缺少的 embedding 在下次追加时计算
+	llm.err = fmt.Errorf("boom")
+	err = m.AppendHistory(ctx, Message{Role: RoleUser, Content: "new 2"}, Message{Role: RoleAssistant, Content: "ok"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h, _ = inner.GetHistory(ctx); h[len(h)-2].Content != "new 2" {
+		t.Fatalf("history should be stored, got %+v", h[len(h)-2:])
+	}
+	llm.err = nil
+	_ = m.AppendHistory(ctx, Message{Role: RoleUser, Content: "new 3"}, Message{Role: RoleAssistant, Content: "ok"})
+	if llm.inputs != 104 {
+		t.Fatalf("missing embeddings should be computed on the next append, got %d", llm.inputs)
+	}
+}
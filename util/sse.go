@@ -0,0 +1,70 @@
+package util
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// SSEEvent is one event of a text/event-stream response.
+type SSEEvent struct {
+	Event string
+	Data  string
+}
+
+// SSEReader 是手写的 server-sent events 读取器，不使用泛型，可以在 yaegi 中运行。
+type SSEReader struct {
+	r *bufio.Reader
+}
+
+func NewSSEReader(r io.Reader) *SSEReader {
+	return &SSEReader{r: bufio.NewReader(r)}
+}
+
+// Next returns the next event, io.EOF is returned when the body ends.
+// See https://html.spec.whatwg.org/multipage/server-sent-events.html#event-stream-interpretation
+func (s *SSEReader) Next() (SSEEvent, error) {
+	var e SSEEvent
+	var data []string
+	hasData := false
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return e, err
+		}
+		if err == io.EOF && line == "" {
+			if hasData {
+				e.Data = strings.Join(data, "\n")
+				return e, nil
+			}
+			return e, io.EOF
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		if line == "" {
+			if hasData {
+				e.Data = strings.Join(data, "\n")
+				return e, nil
+			}
+			// 没有数据的事件直接丢弃
+			e = SSEEvent{}
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			// comment, usually used as heartbeat
+			continue
+		}
+
+		field, value := line, ""
+		if i := strings.Index(line, ":"); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "event":
+			e.Event = value
+		case "data":
+			data = append(data, value)
+			hasData = true
+		}
+	}
+}
@@ -3,17 +3,47 @@ package util
 import (
 	"github.com/zbysir/writeflow/pkg/export"
 	"io"
+	"strings"
 	"sync"
-	"time"
 )
 
+type StreamEventType string
+
+const (
+	StreamEventContent      StreamEventType = "content"
+	StreamEventFunctionCall StreamEventType = "function_call"
+	StreamEventFinish       StreamEventType = "finish"
+	StreamEventUsage        StreamEventType = "usage"
+	StreamEventError        StreamEventType = "error"
+)
+
+// StreamEvent 是流中的一个事件，根据 Type 只有对应的字段有值
+type StreamEvent struct {
+	Type StreamEventType `json:"type"`
+	// Content is the content delta
+	Content string `json:"content,omitempty"`
+	// FunctionCall is the function_call delta, Name comes with the first delta and Arguments should be concatenated
+	FunctionCall *FunctionCall `json:"function_call,omitempty"`
+	// FinishReason is the same as finish_reason of OpenAI, e.g. stop / length / function_call
+	FinishReason string `json:"finish_reason,omitempty"`
+	Usage        *Usage `json:"usage,omitempty"`
+	// Err is the error that ends the stream
+	Err error `json:"-"`
+}
+
+// EventStream 由 StreamResponse 实现，能处理事件的下游节点可以断言为这个接口
+type EventStream interface {
+	NewEventReader() *EventReader
+}
+
 // StreamResponse 是可以重复使用的 流，因为一个流可以被多个节点使用
+// 所有读写都在 lock 下进行，Append 与 Close 通过 cond 唤醒等待中的 Reader，不需要轮询。
 type StreamResponse struct {
-	lock      sync.Mutex // lock for slice append
-	data      []string
-	err       error
-	done      chan struct{}
-	closeOnce sync.Once
+	lock   sync.Mutex
+	cond   *sync.Cond
+	events []StreamEvent
+	err    error
+	closed bool
 }
 
 // Display 返回空，不能被序列化
@@ -22,73 +52,171 @@ func (s *StreamResponse) Display() string {
 }
 
 func NewSteamResponse() *StreamResponse {
-	return &StreamResponse{done: make(chan struct{}, 1)}
+	s := &StreamResponse{}
+	s.cond = sync.NewCond(&s.lock)
+	return s
 }
 
 var _ export.Stream = (*StreamResponse)(nil)
+var _ EventStream = (*StreamResponse)(nil)
 
+// NewReader 返回一个从头开始读的 Reader，只包含 content，在流结束后创建的 Reader 也可以读到全部数据
 func (s *StreamResponse) NewReader() export.Reader {
-	return &Read{s: s}
+	return &Read{r: s.NewEventReader()}
 }
 
-type Read struct {
+// NewEventReader 返回一个从头开始读全部事件的 Reader
+func (s *StreamResponse) NewEventReader() *EventReader {
+	return &EventReader{s: s}
+}
+
+type EventReader struct {
 	s   *StreamResponse
 	idx int
 }
 
-func (r *Read) Read() (string, error) {
-	if r.idx < len(r.s.data) {
-		t := r.s.data[r.idx]
+// Read 阻塞直到有新事件或者流结束，流结束后返回 io.EOF。
+// Close 传入的 error 会作为最后一个 StreamEventError 事件返回。
+func (r *EventReader) Read() (StreamEvent, error) {
+	s := r.s
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for r.idx >= len(s.events) && !s.closed {
+		s.cond.Wait()
+	}
+
+	if r.idx < len(s.events) {
+		e := s.events[r.idx]
 		r.idx++
-		return t, nil
+		return e, nil
+	}
+	return StreamEvent{}, io.EOF
+}
+
+// ReadAll 等待流结束，返回全部事件
+func (r *EventReader) ReadAll() []StreamEvent {
+	s := r.s
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for !s.closed {
+		s.cond.Wait()
 	}
+	r.idx = len(s.events)
+
+	return append([]StreamEvent(nil), s.events...)
+}
 
+// Read 是只读取 content 的 export.Reader
+type Read struct {
+	r *EventReader
+}
+
+// Read 阻塞直到有新内容或者流结束，流结束时返回 io.EOF 或者 Close 传入的 error
+func (r *Read) Read() (string, error) {
 	for {
-		select {
-		case <-r.s.done:
-			if r.idx < len(r.s.data) {
-				t := r.s.data[r.idx]
-				r.idx++
-				return t, nil
-			} else {
-				var t string
-				if r.s.err != nil {
-					return t, r.s.err
-				}
-				return t, io.EOF
-			}
-		case <-time.After(time.Second / 20):
-			if r.idx < len(r.s.data) {
-				t := r.s.data[r.idx]
-				r.idx++
-				return t, nil
-			}
+		e, err := r.r.Read()
+		if err != nil {
+			return "", err
+		}
+		switch e.Type {
+		case StreamEventContent:
+			return e.Content, nil
+		case StreamEventError:
+			return "", e.Err
 		}
 	}
 }
 
+// ReadAll 等待流结束，返回全部内容
 func (r *Read) ReadAll() ([]string, error) {
-	r.s.Wait()
-
-	return r.s.data, r.s.err
+	var data []string
+	var err error
+	for _, e := range r.r.ReadAll() {
+		switch e.Type {
+		case StreamEventContent:
+			data = append(data, e.Content)
+		case StreamEventError:
+			err = e.Err
+		}
+	}
+	return data, err
 }
 
+// Append 追加一段内容
 func (s *StreamResponse) Append(a string) {
+	s.AppendEvent(StreamEvent{Type: StreamEventContent, Content: a})
+}
+
+func (s *StreamResponse) AppendEvent(e StreamEvent) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	s.data = append(s.data, a)
+	if s.closed {
+		return
+	}
+	s.events = append(s.events, e)
+	s.cond.Broadcast()
 }
 
+// Close 结束流，只有第一次调用生效，e 不为空时会追加一个 StreamEventError 事件
 func (s *StreamResponse) Close(e error) {
-	s.closeOnce.Do(func() {
-		s.err = e
-		close(s.done)
-	})
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return
+	}
+	if e != nil {
+		s.events = append(s.events, StreamEvent{Type: StreamEventError, Err: e})
+	}
+	s.err = e
+	s.closed = true
+	s.cond.Broadcast()
+}
+
+// Err returns the error passed to Close, it should be called after Wait
+func (s *StreamResponse) Err() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.err
 }
 
 func (s *StreamResponse) Wait() {
-	select {
-	case <-s.done:
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for !s.closed {
+		s.cond.Wait()
 	}
 }
+
+// Response 等待流结束，将全部事件合并为一个 ChatResponse，function_call 的增量会被拼接为完整的调用
+func (s *StreamResponse) Response() (ChatResponse, error) {
+	rsp := ChatResponse{Message: Message{Role: RoleAssistant}}
+	var content strings.Builder
+	var err error
+	for _, e := range s.NewEventReader().ReadAll() {
+		switch e.Type {
+		case StreamEventContent:
+			content.WriteString(e.Content)
+		case StreamEventFunctionCall:
+			if rsp.Message.FunctionCall == nil {
+				rsp.Message.FunctionCall = &FunctionCall{}
+			}
+			rsp.Message.FunctionCall.Name += e.FunctionCall.Name
+			rsp.Message.FunctionCall.Arguments += e.FunctionCall.Arguments
+		case StreamEventFinish:
+			rsp.FinishReason = e.FinishReason
+		case StreamEventUsage:
+			rsp.Usage = *e.Usage
+		case StreamEventError:
+			err = e.Err
+		}
+	}
+	rsp.Message.Content = content.String()
+
+	return rsp, err
+}
@@ -0,0 +1,223 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func readAll(r interface {
+	Read() (string, error)
+}) (string, error) {
+	var b strings.Builder
+	for {
+		s, err := r.Read()
+		if err != nil {
+			if err == io.EOF {
+				return b.String(), nil
+			}
+			return b.String(), err
+		}
+		b.WriteString(s)
+	}
+}
+
+func TestStreamConcurrentReaders(t *testing.T) {
+	s := NewSteamResponse()
+
+	var expect strings.Builder
+	for i := 0; i < 200; i++ {
+		expect.WriteString(fmt.Sprintf("%d,", i))
+	}
+
+	var wg sync.WaitGroup
+	results := make([]string, 50)
+	errs := make([]error, 50)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = readAll(s.NewReader())
+		}(i)
+	}
+
+	go func() {
+		for i := 0; i < 200; i++ {
+			s.Append(fmt.Sprintf("%d,", i))
+		}
+		s.Close(nil)
+	}()
+
+	wg.Wait()
+	for i := range results {
+		if errs[i] != nil {
+			t.Fatalf("reader %d: %v", i, errs[i])
+		}
+		if results[i] != expect.String() {
+			t.Fatalf("reader %d: unexpected data %q", i, results[i])
+		}
+	}
+}
+
+func TestStreamLateReader(t *testing.T) {
+	s := NewSteamResponse()
+	s.Append("a")
+	s.Append("b")
+
+	early := s.NewReader()
+	if v, err := early.Read(); err != nil || v != "a" {
+		t.Fatalf("unexpected read %q %v", v, err)
+	}
+
+	s.Close(nil)
+	s.Append("c")
+
+	late := s.NewReader()
+	v, err := readAll(late)
+	if err != nil || v != "ab" {
+		t.Fatalf("late reader: unexpected data %q %v", v, err)
+	}
+	data, err := s.NewReader().ReadAll()
+	if err != nil || strings.Join(data, "") != "ab" {
+		t.Fatalf("ReadAll: unexpected data %q %v", data, err)
+	}
+	v, err = readAll(early)
+	if err != nil || v != "b" {
+		t.Fatalf("early reader: unexpected data %q %v", v, err)
+	}
+}
+
+func TestStreamCloseWithError(t *testing.T) {
+	s := NewSteamResponse()
+	e := errors.New("upstream error")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			v, err := readAll(s.NewReader())
+			if err != e || v != "partial" {
+				t.Errorf("unexpected read %q %v", v, err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			data, err := s.NewReader().ReadAll()
+			if err != e || strings.Join(data, "") != "partial" {
+				t.Errorf("unexpected ReadAll %q %v", data, err)
+			}
+		}()
+	}
+
+	s.Append("partial")
+	s.Close(e)
+	s.Close(nil)
+	wg.Wait()
+
+	v, err := readAll(s.NewReader())
+	if err != e || v != "partial" {
+		t.Fatalf("late reader: unexpected read %q %v", v, err)
+	}
+}
+
+func TestStreamReadBlocksUntilAppend(t *testing.T) {
+	s := NewSteamResponse()
+	r := s.NewReader()
+
+	got := make(chan string, 1)
+	go func() {
+		v, _ := r.Read()
+		got <- v
+	}()
+
+	select {
+	case v := <-got:
+		t.Fatalf("Read should block on an empty stream, got %q", v)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	s.Append("x")
+	select {
+	case v := <-got:
+		if v != "x" {
+			t.Errorf("unexpected read %q", v)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("reader was not woken up")
+	}
+
+	s.Close(nil)
+	s.Wait()
+}
+
+func TestStreamEvents(t *testing.T) {
+	s := NewSteamResponse()
+	e := errors.New("upstream error")
+	s.Append("Hel")
+	s.AppendEvent(StreamEvent{Type: StreamEventFunctionCall, FunctionCall: &FunctionCall{Name: "get_weather"}})
+	s.AppendEvent(StreamEvent{Type: StreamEventFunctionCall, FunctionCall: &FunctionCall{Arguments: `{"city":`}})
+	s.Append("lo")
+	s.AppendEvent(StreamEvent{Type: StreamEventUsage, Usage: &Usage{TotalTokens: 3}})
+	s.Close(e)
+
+	var types []StreamEventType
+	r := s.NewEventReader()
+	for {
+		ev, err := r.Read()
+		if err != nil {
+			if err != io.EOF {
+				t.Fatal(err)
+			}
+			break
+		}
+		types = append(types, ev.Type)
+		if ev.Type == StreamEventError && ev.Err != e {
+			t.Errorf("unexpected error event %+v", ev)
+		}
+	}
+	expect := []StreamEventType{StreamEventContent, StreamEventFunctionCall, StreamEventFunctionCall, StreamEventContent, StreamEventUsage, StreamEventError}
+	if fmt.Sprint(types) != fmt.Sprint(expect) {
+		t.Errorf("unexpected events %v", types)
+	}
+
+	// the string reader only yields content and ends with the error
+	v, err := readAll(s.NewReader())
+	if err != e || v != "Hello" {
+		t.Errorf("unexpected read %q %v", v, err)
+	}
+	if s.Err() != e {
+		t.Errorf("unexpected Err %v", s.Err())
+	}
+}
+
+func TestStreamResponse(t *testing.T) {
+	s := NewSteamResponse()
+	go func() {
+		s.Append("Let me check.")
+		s.AppendEvent(StreamEvent{Type: StreamEventFunctionCall, FunctionCall: &FunctionCall{Name: "get_weather"}})
+		s.AppendEvent(StreamEvent{Type: StreamEventFunctionCall, FunctionCall: &FunctionCall{Arguments: `{"city":`}})
+		s.AppendEvent(StreamEvent{Type: StreamEventFunctionCall, FunctionCall: &FunctionCall{Arguments: `"Paris"}`}})
+		s.AppendEvent(StreamEvent{Type: StreamEventUsage, Usage: &Usage{TotalTokens: 7}})
+		s.AppendEvent(StreamEvent{Type: StreamEventFinish, FinishReason: "function_call"})
+		s.Close(nil)
+	}()
+
+	rsp, err := s.Response()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp.Message.Role != RoleAssistant || rsp.Message.Content != "Let me check." {
+		t.Errorf("unexpected message %+v", rsp.Message)
+	}
+	if rsp.Message.FunctionCall == nil || rsp.Message.FunctionCall.Name != "get_weather" || rsp.Message.FunctionCall.Arguments != `{"city":"Paris"}` {
+		t.Errorf("unexpected function_call %+v", rsp.Message.FunctionCall)
+	}
+	if rsp.FinishReason != "function_call" || rsp.Usage.TotalTokens != 7 {
+		t.Errorf("unexpected response %+v", rsp)
+	}
+}
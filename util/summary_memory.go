@@ -0,0 +1,216 @@
+package util
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const (
+	DefaultSummaryThreshold = 20
+	DefaultSummaryKeep      = 6
+)
+
+// maxSummaryCache 是缓存的最大数量，超过时清空缓存，避免内存无限增长
+const maxSummaryCache = 10000
+
+// summaryCache 以 模型 + 被合并的消息的 hash 为 key 缓存摘要，所有 SummaryChatMemory 共享。
+// 摘要不写入历史，fork、chat_memory_get 等直接读取历史的地方不会看到它，也不会被发送给其他 LLM
+var summaryCache = struct {
+	lock sync.Mutex
+	m    map[string]string
+}{m: map[string]string{}}
+
+const summaryPrompt = `Progressively summarize the conversation, adding onto the previous summary and returning a new summary.
+Keep names, facts, decisions and open questions, and write the summary in the language of the conversation.
+
+Previous summary:
+%s
+
+New lines of conversation:
+%s
+
+New summary:`
+
+// SummaryChatMemory 在历史超过 threshold 条时，使用 llm 将较早的消息合并为一条摘要，只保留最近的 keep 条原文。
+//
+// 合并的位置只由历史决定（见 foldPoints），摘要在 AppendHistory 时生成并缓存在进程内，不修改下层的 ChatMemory；
+// GetHistory 从最后一个已有的摘要开始读取，没有副作用，还没有摘要的消息原文返回。
+type SummaryChatMemory struct {
+	memory ChatMemory
+	llm    LLM
+	// model 为空时由 llm 选择默认的模型
+	model     string
+	threshold int
+	keep      int
+}
+
+var _ ChatMemory = (*SummaryChatMemory)(nil)
+var _ ChatMemoryWrapper = (*SummaryChatMemory)(nil)
+
+func NewSummaryChatMemory(memory ChatMemory, llm LLM, model string, threshold, keep int) *SummaryChatMemory {
+	if threshold <= 0 {
+		threshold = DefaultSummaryThreshold
+	}
+	if keep < 0 || keep >= threshold {
+		keep = DefaultSummaryKeep
+	}
+	return &SummaryChatMemory{
+		memory:    memory,
+		llm:       llm,
+		model:     model,
+		threshold: threshold,
+		keep:      keep,
+	}
+}
+
+func (m *SummaryChatMemory) Unwrap() ChatMemory {
+	return m.memory
+}
+
+// AppendHistory 追加消息，历史超过 threshold 条时生成新的摘要。
+// 摘要只是减少发送的历史，生成失败时不返回错误，下次追加时会重试
+func (m *SummaryChatMemory) AppendHistory(ctx context.Context, messages ...Message) error {
+	err := m.memory.AppendHistory(ctx, messages...)
+	if err != nil {
+		return err
+	}
+
+	_ = m.updateSummary(ctx)
+	return nil
+}
+
+// updateSummary 为最后一个合并位置生成摘要，从已有的最后一个摘要开始，只需要一次请求
+func (m *SummaryChatMemory) updateSummary(ctx context.Context) error {
+	ms, err := m.memory.GetHistory(ctx)
+	if err != nil {
+		return err
+	}
+	points := m.foldPoints(ms)
+	if len(points) == 0 {
+		return nil
+	}
+	keys := m.summaryKeys(ms, points)
+	i, summary := lastSummary(keys)
+	if i == len(points)-1 {
+		return nil
+	}
+
+	start := 0
+	if i >= 0 {
+		start = points[i]
+	}
+	summary, err = m.summarize(ctx, summary, ms[start:points[len(points)-1]])
+	if err != nil {
+		return fmt.Errorf("summarize error: %w", err)
+	}
+
+	summaryCache.lock.Lock()
+	defer summaryCache.lock.Unlock()
+	if len(summaryCache.m) >= maxSummaryCache {
+		summaryCache.m = map[string]string{}
+	}
+	summaryCache.m[keys[len(keys)-1]] = summary
+	return nil
+}
+
+// GetHistory 返回最后一个已有的摘要与它之后的消息
+func (m *SummaryChatMemory) GetHistory(ctx context.Context) (Messages, error) {
+	ms, err := m.memory.GetHistory(ctx)
+	if err != nil {
+		return nil, err
+	}
+	points := m.foldPoints(ms)
+	i, summary := lastSummary(m.summaryKeys(ms, points))
+	if i < 0 {
+		return ms, nil
+	}
+	return withSummary(summary, ms[points[i]:]), nil
+}
+
+// foldPoints 返回合并历史的位置：上一个位置之后超过 threshold 条消息时，合并到只剩 keep 条。
+// 位置只由历史决定，多个实例、多次运行得到同样的位置，所以可以用位置之前的消息查找摘要
+func (m *SummaryChatMemory) foldPoints(ms Messages) []int {
+	var points []int
+	p := 0
+	for len(ms)-p > m.threshold {
+		next := p + m.threshold + 1 - m.keep
+		// 不能将 function_call 与它的结果分开
+		for next > p && ms[next].Role == RoleFunction {
+			next--
+		}
+		if next == p {
+			break
+		}
+		points = append(points, next)
+		p = next
+	}
+	return points
+}
+
+// summaryKeys 返回每个合并位置的摘要在缓存中的 key
+func (m *SummaryChatMemory) summaryKeys(ms Messages, points []int) []string {
+	h := sha256.New()
+	keys := make([]string, len(points))
+	start := 0
+	for i, p := range points {
+		for _, msg := range ms[start:p] {
+			bs, _ := json.Marshal(msg)
+			h.Write(bs)
+			h.Write([]byte{'\n'})
+		}
+		start = p
+		keys[i] = m.model + ":" + hex.EncodeToString(h.Sum(nil))
+	}
+	return keys
+}
+
+// lastSummary 返回缓存中最后一个摘要的序号，没有时返回 -1
+func lastSummary(keys []string) (int, string) {
+	summaryCache.lock.Lock()
+	defer summaryCache.lock.Unlock()
+
+	for i := len(keys) - 1; i >= 0; i-- {
+		if summary, ok := summaryCache.m[keys[i]]; ok {
+			return i, summary
+		}
+	}
+	return -1, ""
+}
+
+func (m *SummaryChatMemory) summarize(ctx context.Context, summary string, ms Messages) (string, error) {
+	var lines strings.Builder
+	for _, msg := range ms {
+		switch {
+		case msg.FunctionCall != nil:
+			fmt.Fprintf(&lines, "%s: call %s(%s)\n", msg.Role, msg.FunctionCall.Name, msg.FunctionCall.Arguments)
+		case msg.Role == RoleFunction:
+			fmt.Fprintf(&lines, "%s %s: %s\n", msg.Role, msg.Name, msg.Content)
+		default:
+			fmt.Fprintf(&lines, "%s: %s\n", msg.Role, msg.Content)
+		}
+	}
+
+	options := DefaultChatOptions()
+	options.Model = m.model
+	options.Temperature = 0
+	rsp, err := m.llm.ChatCompletion(ctx, ChatRequest{
+		ChatOptions: options,
+		Messages:    Messages{{Role: RoleUser, Content: fmt.Sprintf(summaryPrompt, summary, lines.String())}},
+	})
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(rsp.Message.Content), nil
+}
+
+func withSummary(summary string, recent Messages) Messages {
+	if summary == "" {
+		return recent
+	}
+	return append(Messages{{Role: RoleSystem, Content: "Summary of the earlier conversation:\n" + summary}}, recent...)
+}
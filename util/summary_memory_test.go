@@ -0,0 +1,130 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func resetSummaryCache() {
+	summaryCache.lock.Lock()
+	summaryCache.m = map[string]string{}
+	summaryCache.lock.Unlock()
+}
+
+func TestSummaryChatMemory(t *testing.T) {
+	ctx := context.Background()
+	inner := NewMemoryChatMemory("summary", 0)
+	t.Cleanup(func() {
+		_ = history.Delete(ctx, "summary")
+		resetSummaryCache()
+	})
+	llm := &fakeLLM{}
+	m := NewSummaryChatMemory(inner, llm, "", 4, 2)
+
+	for i := 0; i < 4; i++ {
+		_ = m.AppendHistory(ctx, Message{Role: RoleUser, Content: fmt.Sprint(i)})
+	}
+	h, err := m.GetHistory(ctx)
+	if err != nil || len(h) != 4 || len(llm.reqs) != 0 {
+		t.Fatalf("should not summarize under threshold: %+v %v", h, err)
+	}
+
+	// 摘要在追加时生成，读取没有副作用
+	_ = m.AppendHistory(ctx, Message{Role: RoleUser, Content: "4"})
+	if len(llm.reqs) != 1 {
+		t.Fatalf("should summarize on append, calls %d", len(llm.reqs))
+	}
+	// 没有选择模型时由 llm 决定，摘要使用 temperature 0
+	if llm.reqs[0].Model != "" || llm.reqs[0].Temperature != 0 {
+		t.Errorf("unexpected options %+v", llm.reqs[0].ChatOptions)
+	}
+	h, err = m.GetHistory(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(llm.reqs) != 1 || len(h) != 3 || !strings.Contains(h[0].Content, "summary 1") || h[1].Content != "3" || h[2].Content != "4" {
+		t.Fatalf("unexpected history %+v", h)
+	}
+	// 摘要不写入下层的历史
+	if h, _ = inner.GetHistory(ctx); len(h) != 5 || h[0].Content != "0" {
+		t.Errorf("summary should not be stored in history %+v", h)
+	}
+
+	// 摘要被缓存，不会重新计算
+	if h, _ = m.GetHistory(ctx); len(llm.reqs) != 1 || len(h) != 3 {
+		t.Fatalf("summary should be cached, calls %d, history %+v", len(llm.reqs), h)
+	}
+
+	// 下一次摘要包含上一次的摘要
+	for i := 5; i < 8; i++ {
+		_ = m.AppendHistory(ctx, Message{Role: RoleUser, Content: fmt.Sprint(i)})
+	}
+	h, _ = m.GetHistory(ctx)
+	if len(llm.reqs) != 2 || !strings.Contains(prompt(llm.reqs[1]), "summary 1") || !strings.Contains(prompt(llm.reqs[1]), "user: 3") {
+		t.Fatalf("unexpected prompt %q", prompt(llm.reqs[1]))
+	}
+	if len(h) != 3 || !strings.Contains(h[0].Content, "summary 2") || h[1].Content != "6" || h[2].Content != "7" {
+		t.Fatalf("unexpected history %+v", h)
+	}
+}
+
+func TestSummaryChatMemoryKeepFunctionCall(t *testing.T) {
+	ctx := context.Background()
+	inner := NewMemoryChatMemory("summary-function", 0)
+	t.Cleanup(func() {
+		_ = history.Delete(ctx, "summary-function")
+		resetSummaryCache()
+	})
+	m := NewSummaryChatMemory(inner, &fakeLLM{}, "", 3, 1)
+
+	for _, msg := range []Message{
+		{Role: RoleUser, Content: "a"},
+		{Role: RoleUser, Content: "b"},
+		{Role: RoleAssistant, FunctionCall: &FunctionCall{Name: "f"}},
+		{Role: RoleFunction, Name: "f", Content: "c"},
+	} {
+		_ = m.AppendHistory(ctx, msg)
+	}
+
+	h, err := m.GetHistory(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h) != 3 || h[1].FunctionCall == nil || h[2].Role != RoleFunction {
+		t.Fatalf("function_call should be kept with its result %+v", h)
+	}
+}
+
+func TestSummaryChatMemoryFailure(t *testing.T) {
+	ctx := context.Background()
+	inner := NewMemoryChatMemory("summary-failure", 0)
+	t.Cleanup(func() {
+		_ = history.Delete(ctx, "summary-failure")
+		resetSummaryCache()
+	})
+	llm := &fakeLLM{err: fmt.Errorf("boom")}
+	m := NewSummaryChatMemory(inner, llm, "", 2, 1)
+
+	// 生成摘要失败不影响保存，读取时返回原文
+	for i := 0; i < 3; i++ {
+		if err := m.AppendHistory(ctx, Message{Role: RoleUser, Content: fmt.Sprint(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if h, _ := m.GetHistory(ctx); len(llm.reqs) != 1 || len(h) != 3 {
+		t.Fatalf("unexpected history %+v after %d calls", h, len(llm.reqs))
+	}
+
+	// 下次追加时重试，一次请求合并到最后的位置
+	llm.err = nil
+	_ = m.AppendHistory(ctx, Message{Role: RoleUser, Content: "3"}, Message{Role: RoleUser, Content: "4"})
+	h, _ := m.GetHistory(ctx)
+	if len(llm.reqs) != 2 || !strings.Contains(prompt(llm.reqs[1]), "user: 0") || !strings.Contains(prompt(llm.reqs[1]), "user: 3") {
+		t.Fatalf("unexpected prompt %q", prompt(llm.reqs[1]))
+	}
+	if len(h) != 2 || !strings.Contains(h[0].Content, "summary 2") || h[1].Content != "4" {
+		t.Fatalf("unexpected history %+v", h)
+	}
+}
@@ -0,0 +1,82 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cast"
+	"reflect"
+	"strings"
+	"text/template"
+)
+
+// TemplateFuncs 是 prompt 模板中可以使用的函数，参数顺序适合在管道中使用，如 {{ .items | join ", " }}
+var TemplateFuncs = template.FuncMap{
+	// join 使用 sep 连接列表中的每一项
+	"join": func(sep string, v interface{}) (string, error) {
+		items, err := toList(v)
+		if err != nil {
+			return "", err
+		}
+		ss := make([]string, len(items))
+		for i, item := range items {
+			ss[i] = cast.ToString(item)
+		}
+		return strings.Join(ss, sep), nil
+	},
+	// json 将任意值序列化为 JSON
+	"json": func(v interface{}) (string, error) {
+		bs, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		return string(bs), nil
+	},
+	// truncate 只保留前 n 个字符
+	"truncate": func(n int, v interface{}) string {
+		rs := []rune(cast.ToString(v))
+		if n < 0 || len(rs) <= n {
+			return string(rs)
+		}
+		return string(rs[:n])
+	},
+	"trim": func(v interface{}) string {
+		return strings.TrimSpace(cast.ToString(v))
+	},
+	// default 在 v 为空时返回 d
+	"default": func(d interface{}, v interface{}) interface{} {
+		if v == nil || cast.ToString(v) == "" {
+			return d
+		}
+		return v
+	},
+}
+
+func toList(v interface{}) ([]interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, fmt.Errorf("expect a list, got %T", v)
+	}
+	items := make([]interface{}, rv.Len())
+	for i := range items {
+		items[i] = rv.Index(i).Interface()
+	}
+	return items, nil
+}
+
+// RenderTemplate 使用 vars 渲染 Go text/template，使用不存在的变量会返回错误
+func RenderTemplate(tpl string, vars map[string]interface{}) (string, error) {
+	t, err := template.New("prompt").Funcs(TemplateFuncs).Option("missingkey=error").Parse(tpl)
+	if err != nil {
+		return "", fmt.Errorf("parse template error: %w", err)
+	}
+
+	var b strings.Builder
+	err = t.Execute(&b, vars)
+	if err != nil {
+		return "", fmt.Errorf("render template error: %w", err)
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,32 @@
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	s, err := RenderTemplate(`Hi {{.name}}, {{ .items | join ", " }}; {{ .obj | json }}; {{ .long | truncate 5 }}; {{ .empty | default "none" }}`, map[string]interface{}{
+		"name":  "John",
+		"items": []interface{}{"a", 1, true},
+		"obj":   map[string]interface{}{"k": "v"},
+		"long":  "你好世界，再见",
+		"empty": "",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != `Hi John, a, 1, true; {"k":"v"}; 你好世界，; none` {
+		t.Errorf("unexpected result %q", s)
+	}
+
+	_, err = RenderTemplate(`Hi {{.missing}}`, map[string]interface{}{"name": "John"})
+	if err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("missing variable should be an error, got %v", err)
+	}
+
+	_, err = RenderTemplate(`{{ .name | join "," }}`, map[string]interface{}{"name": "John"})
+	if err == nil {
+		t.Errorf("join a string should be an error")
+	}
+}
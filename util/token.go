@@ -0,0 +1,141 @@
+package util
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// DefaultContextWindow 用于不认识的模型
+const DefaultContextWindow = 4096
+
+// contextWindows 是模型的上下文长度，按前缀匹配，更长的前缀优先
+var contextWindows = map[string]int{
+	"gpt-3.5-turbo":      16385,
+	"gpt-3.5-turbo-0613": 4096,
+	"gpt-3.5-turbo-16k":  16385,
+	"gpt-4":              8192,
+	"gpt-4-32k":          32768,
+	"gpt-4-1106":         128000,
+	"gpt-4-0125":         128000,
+	"gpt-4-turbo":        128000,
+	"gpt-4o":             128000,
+	"chatgpt-4o":         128000,
+	"gpt-4.1":            1047576,
+	"o1":                 200000,
+	"o1-mini":            128000,
+	"o3":                 200000,
+	"o4-mini":            200000,
+	"claude-":            200000,
+}
+
+// ContextWindow 返回模型的上下文长度（token 数），实现了 ContextWindower 的 LLM 以它为准（见 LLMContextWindow）
+func ContextWindow(model string) int {
+	window := DefaultContextWindow
+	prefix := ""
+	for k, v := range contextWindows {
+		if strings.HasPrefix(model, k) && len(k) > len(prefix) {
+			prefix = k
+			window = v
+		}
+	}
+	return window
+}
+
+// LLMContextWindow 返回 llm 的上下文长度，llm 没有实现 ContextWindower 时按 model 查表
+func LLMContextWindow(llm LLM, model string) int {
+	if w, ok := llm.(ContextWindower); ok {
+		if n := w.ContextWindow(); n > 0 {
+			return n
+		}
+	}
+	return ContextWindow(model)
+}
+
+// messageTokenOverhead 是每条消息中 role 等格式带来的额外 token
+const messageTokenOverhead = 4
+
+// CountTokens 估算文本的 token 数。
+// 在 yaegi 中无法使用 tiktoken，所以这里按 4 个 ASCII 字符或者 1 个非 ASCII 字符（如中文）为一个 token 估算，结果偏大是可以接受的。
+func CountTokens(s string) int {
+	ascii := 0
+	other := 0
+	for _, r := range s {
+		if r < utf8.RuneSelf {
+			ascii++
+		} else {
+			other++
+		}
+	}
+	return (ascii+3)/4 + other
+}
+
+// CountMessageTokens 估算一条消息的 token 数
+func CountMessageTokens(m Message) int {
+	n := messageTokenOverhead + CountTokens(m.Content) + CountTokens(m.Name)
+	if m.FunctionCall != nil {
+		n += CountTokens(m.FunctionCall.Name) + CountTokens(m.FunctionCall.Arguments)
+	}
+	return n
+}
+
+// CountFunctionTokens 估算 functions 定义的 token 数
+func CountFunctionTokens(fs []FunctionDefine) int {
+	n := 0
+	for _, f := range fs {
+		n += CountTokens(f.Name) + CountTokens(f.Description) + CountTokens(string(f.Parameters))
+	}
+	return n
+}
+
+// TrimMessages 从最新的消息开始保留，直到超出 budget 个 token。
+// system 消息总是会被保留（即使超出 budget），function_call 与它的结果（function 消息）会被一起保留或者一起丢弃。
+func TrimMessages(ms Messages, budget int) Messages {
+	used := 0
+	for _, m := range ms {
+		if m.Role == RoleSystem {
+			used += CountMessageTokens(m)
+		}
+	}
+
+	keep := make([]bool, len(ms))
+	for end := len(ms); end > 0; {
+		if ms[end-1].Role == RoleSystem {
+			keep[end-1] = true
+			end--
+			continue
+		}
+
+		// 将 function 结果与前面的 function_call 作为一组
+		start := end - 1
+		for start > 0 && ms[start].Role == RoleFunction && ms[start-1].FunctionCall != nil {
+			start--
+		}
+		// 没有对应 function_call 的 function 结果单独发送没有意义
+		if ms[start].Role == RoleFunction {
+			end = start
+			continue
+		}
+
+		n := 0
+		for _, m := range ms[start:end] {
+			n += CountMessageTokens(m)
+		}
+		if used+n > budget {
+			break
+		}
+		used += n
+		for i := start; i < end; i++ {
+			keep[i] = true
+		}
+		end = start
+	}
+
+	// 更早的 system 消息在 break 之后仍然要保留
+	var r Messages
+	for i, m := range ms {
+		if keep[i] || m.Role == RoleSystem {
+			r = append(r, m)
+		}
+	}
+	return r
+}
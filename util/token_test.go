@@ -0,0 +1,82 @@
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestContextWindow(t *testing.T) {
+	cases := map[string]int{
+		"gpt-3.5-turbo":            16385,
+		"gpt-3.5-turbo-0613":       4096,
+		"gpt-4o-mini":              128000,
+		"o1-mini-2024-09-12":       128000,
+		"gpt-3.5-turbo-16k-0613":   16385,
+		"gpt-4-32k":                32768,
+		"claude-3-5-sonnet-latest": 200000,
+		"llama3":                   DefaultContextWindow,
+	}
+	for model, expect := range cases {
+		if got := ContextWindow(model); got != expect {
+			t.Errorf("%s: expect %d, got %d", model, expect, got)
+		}
+	}
+}
+
+func TestCountTokens(t *testing.T) {
+	if n := CountTokens("hello world!"); n != 3 {
+		t.Errorf("unexpected ascii tokens %d", n)
+	}
+	if n := CountTokens("你好"); n != 2 {
+		t.Errorf("unexpected cjk tokens %d", n)
+	}
+}
+
+func TestTrimMessages(t *testing.T) {
+	// 每条消息 4 + 25 = 29 个 token
+	text := strings.Repeat("a", 100)
+	ms := Messages{
+		{Role: RoleSystem, Content: text},
+		{Role: RoleUser, Content: text},
+		{Role: RoleAssistant, Content: text},
+		{Role: RoleUser, Content: text},
+		{Role: RoleAssistant, FunctionCall: &FunctionCall{Name: "f", Arguments: text}},
+		{Role: RoleFunction, Name: "f", Content: text},
+		{Role: RoleAssistant, Content: text},
+	}
+
+	roles := func(ms Messages) string {
+		var rs []string
+		for _, m := range ms {
+			rs = append(rs, m.Role)
+		}
+		return strings.Join(rs, ",")
+	}
+
+	cases := []struct {
+		budget int
+		expect string
+	}{
+		// 预算不足时也保留 system
+		{budget: 0, expect: "system"},
+		{budget: 29 * 2, expect: "system,assistant"},
+		// function_call 与结果不能拆开，预算不够两条时都丢弃
+		{budget: 29 * 3, expect: "system,assistant"},
+		{budget: 29*4 + 2, expect: "system,assistant,function,assistant"},
+		{budget: 29 * 100, expect: "system,user,assistant,user,assistant,function,assistant"},
+	}
+	for _, c := range cases {
+		if got := roles(TrimMessages(ms, c.budget)); got != c.expect {
+			t.Errorf("budget %d: expect %s, got %s", c.budget, c.expect, got)
+		}
+	}
+
+	// 开头没有对应 function_call 的 function 结果会被丢弃
+	orphan := Messages{
+		{Role: RoleFunction, Name: "f", Content: "x"},
+		{Role: RoleUser, Content: "x"},
+	}
+	if got := roles(TrimMessages(orphan, 1000)); got != "user" {
+		t.Errorf("unexpected orphan result %s", got)
+	}
+}
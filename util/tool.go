@@ -0,0 +1,63 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/zbysir/writeflow/pkg/export"
+)
+
+// Tool 是带有定义的函数实现，由 tool 组件输出，langchain_call 会将它作为 function 发给模型并在模型调用它时执行
+type Tool struct {
+	Define FunctionDefine
+	// CMDer 是函数的实现，参数是 JSON 解析后的对象，default 输出作为函数的结果
+	export.CMDer
+}
+
+// NewTool 检查函数定义，impl 可以是 export.CMDer 或者与 Exec 签名相同的函数
+func NewTool(define FunctionDefine, impl interface{}) (*Tool, error) {
+	if len(define.Parameters) == 0 {
+		define.Parameters = json.RawMessage(`{"type":"object","properties":{}}`)
+	}
+	err := ValidateFunction(define)
+	if err != nil {
+		return nil, err
+	}
+
+	var cmd export.CMDer
+	switch impl := impl.(type) {
+	case export.CMDer:
+		cmd = impl
+	case func(ctx context.Context, params map[string]interface{}) (map[string]interface{}, error):
+		cmd = NewFun(impl)
+	default:
+		return nil, fmt.Errorf("tool %s: implementation must be a cmd, got %T", define.Name, impl)
+	}
+	return &Tool{Define: define, CMDer: cmd}, nil
+}
+
+// ParseTools 读取连接到 tools 的一个或多个 Tool
+func ParseTools(v interface{}) ([]*Tool, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case *Tool:
+		return []*Tool{v}, nil
+	case []*Tool:
+		return v, nil
+	case []interface{}:
+		tools := make([]*Tool, 0, len(v))
+		for _, i := range v {
+			if i == nil {
+				continue
+			}
+			t, ok := i.(*Tool)
+			if !ok {
+				return nil, fmt.Errorf("tools must be langchain/tool, got %T", i)
+			}
+			tools = append(tools, t)
+		}
+		return tools, nil
+	}
+	return nil, fmt.Errorf("tools must be langchain/tool, got %T", v)
+}
@@ -0,0 +1,42 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestNewTool(t *testing.T) {
+	impl := func(ctx context.Context, params map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{"default": "ok"}, nil
+	}
+
+	tool, err := NewTool(FunctionDefine{Name: "ping"}, impl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(tool.Define.Parameters) != `{"type":"object","properties":{}}` {
+		t.Errorf("unexpected default parameters %s", tool.Define.Parameters)
+	}
+	if r, err := CallTool(context.Background(), tool, ""); err != nil || r != "ok" {
+		t.Errorf("unexpected result %q %v", r, err)
+	}
+
+	if _, err = NewTool(FunctionDefine{}, impl); err == nil {
+		t.Errorf("name should be required")
+	}
+	if _, err = NewTool(FunctionDefine{Name: "ping", Parameters: json.RawMessage(`{"type":`)}, impl); err == nil {
+		t.Errorf("invalid parameters should be an error")
+	}
+	if _, err = NewTool(FunctionDefine{Name: "ping"}, "not a cmd"); err == nil {
+		t.Errorf("invalid implementation should be an error")
+	}
+
+	tools, err := ParseTools([]interface{}{tool, nil, tool})
+	if err != nil || len(tools) != 2 {
+		t.Errorf("unexpected tools %v %v", tools, err)
+	}
+	if _, err = ParseTools([]interface{}{"ping"}); err == nil {
+		t.Errorf("invalid tools should be an error")
+	}
+}